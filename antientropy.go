@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+const defaultAntiEntropyInterval = time.Minute
+
+// MessageSyncRoot starts an anti-entropy round. The peer answers with a
+// MessageSyncRootResponse carrying the same RequestID.
+type MessageSyncRoot struct{
+	RequestID string
+	Root []byte
+}
+
+// MessageSyncRootResponse carries the peer's bucket hashes, or none if
+// its root matched ours.
+type MessageSyncRootResponse struct{
+	RequestID string
+	Buckets [][]byte
+}
+
+// MessageSyncLeaves asks for the leaves of the buckets that differ. The
+// peer answers with a MessageSyncLeavesResponse.
+type MessageSyncLeaves struct{
+	RequestID string
+	Buckets []int
+}
+
+type MessageSyncLeavesResponse struct{
+	RequestID string
+	Leaves []MerkleLeaf
+}
+
+// MessageFetchObject asks a peer to send an object as it is stored on
+// disk over the stream with the given ID.
+type MessageFetchObject struct{
+	ID string
+	Path string
+	StreamID uint32
+}
+
+// antiEntropyLoop periodically compares our replicas with every peer and
+// pulls the ones we miss or hold an older copy of. Transfers that broke
+// off and were not resumed within StagingTTL are dropped on the way, and
+// so are chunks whose manifest did not arrive within it.
+func (s *FileServer) antiEntropyLoop(){
+	ctx, cancel := s.quitContext()
+	defer cancel()
+
+	ticker := time.NewTicker(s.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <- ticker.C:
+			if err := s.store.ExpireStaged(s.StagingTTL); err != nil{
+				log.Printf("[%s] could not expire staged transfers: %s", s.Transport.Addr(), err)
+			}
+			if err := s.collectChunks(s.StagingTTL); err != nil{
+				log.Printf("[%s] could not collect unused chunks: %s", s.Transport.Addr(), err)
+			}
+			for _, peer := range s.peersSupporting(FeatureAntiEntropy){
+				if err := s.syncWith(ctx, peer); err != nil{
+					log.Printf("[%s] anti-entropy with (%s) failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+				}
+			}
+		case <- ctx.Done():
+			return
+		}
+	}
+}
+
+// merkleTree builds a tree over the replicas we hold, leaving out the
+// namespaces of the given nodes, all shards and chunked files. A node
+// holds its own files unencrypted under their plain keys, so they are
+// never compared with a peer's. The leaves come with the hashes recorded
+// when the objects were written, and the tree is reused until any of
+// them change.
+func (s *FileServer) merkleTree(exclude ...string) (*MerkleTree, error){
+	version := [3]uint64{s.store.leaves.Version(), s.tombstones.Version(), s.chunkRefs.Version()}
+	key := strings.Join(exclude, "/")
+
+	s.treeLock.Lock()
+	defer s.treeLock.Unlock()
+
+	if version != s.treeVersion{
+		s.trees = make(map[string]*MerkleTree)
+		s.treeVersion = version
+	}
+	if tree, ok := s.trees[key]; ok{
+		return tree, nil
+	}
+
+	excluded := map[string]bool{}
+	for _, id := range exclude{
+		excluded[id] = true
+	}
+
+	tombstones, err := s.tombstones.List()
+	if err != nil{
+		return nil, err
+	}
+	deleted := map[string]time.Time{}
+	for _, t := range tombstones{
+		deleted[tombstoneID(t.ID, s.store.pathOf(t.Key))] = t.Deleted
+	}
+	// manifests are useless without their chunks, which are repaired
+	// by hinted handoff and read repair instead
+	chunked := map[string]bool{}
+	for _, r := range s.chunkRefs.Replicas(){
+		chunked[tombstoneID(r.ID, s.store.pathOf(r.Key))] = true
+	}
+
+	all, _ := s.store.leaves.List()
+	leaves := []MerkleLeaf{}
+	for _, leaf := range all{
+		if excluded[leaf.ID] || isShardNamespace(leaf.ID) || leaf.ID == chunkNamespace || chunked[tombstoneID(leaf.ID, leaf.Path)]{
+			continue
+		}
+		// a replica deleted by its owner is about to be dropped
+		if t, ok := deleted[tombstoneID(leaf.ID, leaf.Path)]; ok && !leaf.ModTime.After(t){
+			continue
+		}
+		leaves = append(leaves, leaf)
+	}
+
+	tree := NewMerkleTree(leaves)
+	s.trees[key] = tree
+	return tree, nil
+}
+
+// syncWith runs one anti-entropy round with the peer. The roots are
+// compared first, then the buckets, and only the leaves of the buckets
+// that differ are exchanged.
+//
+// Without the original keys on disk we cannot tell which replicas a peer
+// is responsible for, so with a replication factor only replicas both of
+// us already hold are repaired.
+func (s *FileServer) syncWith(ctx context.Context, peer p2p.Peer) error{
+	tree, err := s.merkleTree(s.ID, peer.ID())
+	if err != nil{
+		return err
+	}
+
+	requestID := generateId()
+	respCh, done := s.registerRequest(requestID, 1)
+	defer done()
+
+	resp, err := s.request(ctx, peer, respCh, MessageSyncRoot{RequestID: requestID, Root: tree.Root()})
+	if err != nil{
+		return err
+	}
+	rootResp, ok := resp.(MessageSyncRootResponse)
+	if !ok{
+		return fmt.Errorf("unexpected response %T to sync root", resp)
+	}
+	if len(rootResp.Buckets) == 0{
+		return nil
+	}
+
+	diff := tree.Diff(rootResp.Buckets)
+	resp, err = s.request(ctx, peer, respCh, MessageSyncLeaves{RequestID: requestID, Buckets: diff})
+	if err != nil{
+		return err
+	}
+	leavesResp, ok := resp.(MessageSyncLeavesResponse)
+	if !ok{
+		return fmt.Errorf("unexpected response %T to sync leaves", resp)
+	}
+
+	ours := map[string]MerkleLeaf{}
+	for _, b := range diff{
+		for _, leaf := range tree.Leaves(b){
+			ours[tombstoneID(leaf.ID, leaf.Path)] = leaf
+		}
+	}
+
+	var errs []error
+	for _, theirs := range leavesResp.Leaves{
+		if theirs.ID == s.ID || theirs.ID == peer.ID(){
+			continue
+		}
+
+		leaf, ok := ours[tombstoneID(theirs.ID, theirs.Path)]
+		switch{
+		case !ok && s.ReplicationFactor > 0:
+			continue
+		case ok && (bytes.Equal(leaf.Hash, theirs.Hash) || !s.isNewer(theirs, leaf)):
+			continue
+		}
+
+		if err := s.fetchObject(ctx, peer, theirs); err != nil{
+			if ctx.Err() != nil{
+				return ctx.Err()
+			}
+			errs = append(errs, fmt.Errorf("fetching (%s/%s): %w", theirs.ID, theirs.Path, err))
+			continue
+		}
+		log.Printf("[%s] repaired (%s/%s) from (%s)", s.Transport.Addr(), theirs.ID, theirs.Path, peer.RemoteAddr())
+	}
+
+	return errors.Join(errs...)
+}
+
+// isNewer reports whether the peer's copy of the replica is a later
+// version than ours, going by when the owner last wrote the file. When
+// either copy lacks that time it cannot be told, and ours is kept rather
+// than going by when the copies were written to disk.
+func (s *FileServer) isNewer(theirs, ours MerkleLeaf) bool{
+	meta, _ := s.store.readMeta(fmt.Sprintf("%s/%s", ours.ID, ours.Path))
+	if theirs.Meta.Modified.IsZero() || meta.Modified.IsZero(){
+		return false
+	}
+	return theirs.Meta.Modified.After(meta.Modified)
+}
+
+// request sends the payload to the peer and waits for its response on respCh.
+func (s *FileServer) request(ctx context.Context, peer p2p.Peer, respCh chan peerResponse, payload any) (any, error){
+	if err := s.send(peer, &Message{Payload: payload}); err != nil{
+		return nil, err
+	}
+
+	timeout := time.NewTimer(s.RequestTimeout)
+	defer timeout.Stop()
+
+	select{
+	case resp := <- respCh:
+		return resp.payload, nil
+	case <- timeout.C:
+		return nil, fmt.Errorf("timed out waiting for (%s) to answer", peer.RemoteAddr())
+	case <- ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchObject copies the peer's replica as it is, still encrypted with
+// its owner's key, and checks it against the hash the peer announced.
+func (s *FileServer) fetchObject(ctx context.Context, peer p2p.Peer, leaf MerkleLeaf) error{
+	if err := s.checkPeerObject(leaf.ID, leaf.Path); err != nil{
+		return err
+	}
+
+	request := func(streamID uint32) any{
+		return MessageFetchObject{
+			ID: leaf.ID,
+			Path: leaf.Path,
+			StreamID: streamID,
+		}
+	}
+
+	// the copy counts against the quota of the peer it came from
+	meta := leaf.Meta
+	meta.ChargedTo = peer.ID()
+	return s.fetchOverStream(ctx, peer.RemoteAddr().String(), request, func(r io.Reader) (int64, error){
+		return s.store.writePathContext(ctx, leaf.ID, leaf.Path, newHashCheckReader(r, leaf.Hash), meta)
+	})
+}
+
+func (s *FileServer) handleMessageSyncRoot(from string, msg MessageSyncRoot) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
+	}
+
+	tree, err := s.merkleTree(s.ID, peer.ID())
+	if err != nil{
+		return err
+	}
+
+	resp := MessageSyncRootResponse{
+		RequestID: msg.RequestID,
+	}
+	if !bytes.Equal(tree.Root(), msg.Root){
+		resp.Buckets = tree.Buckets()
+	}
+
+	return s.send(peer, &Message{Payload: resp})
+}
+
+func (s *FileServer) handleMessageSyncLeaves(from string, msg MessageSyncLeaves) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
+	}
+
+	tree, err := s.merkleTree(s.ID, peer.ID())
+	if err != nil{
+		return err
+	}
+
+	resp := MessageSyncLeavesResponse{
+		RequestID: msg.RequestID,
+	}
+	for _, b := range msg.Buckets{
+		for _, leaf := range tree.Leaves(b){
+			leaf.Meta, _ = s.store.readMeta(fmt.Sprintf("%s/%s", leaf.ID, leaf.Path))
+			resp.Leaves = append(resp.Leaves, leaf)
+		}
+	}
+
+	return s.send(peer, &Message{Payload: resp})
+}
+
+func (s *FileServer) handleMessageSyncRootResponse(from string, msg MessageSyncRootResponse) error{
+	s.deliverResponse(msg.RequestID, from, msg)
+	return nil
+}
+
+func (s *FileServer) handleMessageSyncLeavesResponse(from string, msg MessageSyncLeavesResponse) error{
+	s.deliverResponse(msg.RequestID, from, msg)
+	return nil
+}
+
+func (s *FileServer) handleMessageFetchObject(from string, msg MessageFetchObject) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
+	}
+
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil{
+		return err
+	}
+
+	// never hand out our own unencrypted files, nor anything that is
+	// not one of the objects trees are built from
+	if err := s.checkPeerObject(msg.ID, msg.Path); err != nil{
+		stream.Reset()
+		return fmt.Errorf("[%s] peer (%s) asked for (%s/%s): %w", s.Transport.Addr(), from, msg.ID, msg.Path, err)
+	}
+	if _, ok := s.store.leaves.Get(msg.ID, msg.Path); !ok{
+		stream.Reset()
+		return fmt.Errorf("[%s] peer (%s) asked for (%s/%s), which is not an object we hold", s.Transport.Addr(), from, msg.ID, msg.Path)
+	}
+
+	fileSize, r, err := s.store.readPath(msg.ID, msg.Path)
+	if err != nil{
+		stream.Reset()
+		return err
+	}
+
+	s.serveOverStream(stream, from, msg.ID, msg.Path, fileSize, r)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Chunk sizes the Chunker aims for. Boundaries are cut where the rolling
+// hash of the last bytes matches chunkMask, so an edit only moves the
+// boundaries next to it and the chunks around it stay the same.
+const (
+	minChunkSize = 2 << 10
+	maxChunkSize = 64 << 10
+	// chunkMask has 13 bits set, for chunks of 8KB on average
+	chunkMask = 1 << 13 - 1
+)
+
+// gearTable maps every byte to a random looking value for the rolling
+// hash. It is derived rather than random so that every node cuts the same
+// content into the same chunks.
+var gearTable [256]uint64
+
+func init(){
+	for i := range gearTable{
+		sum := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// Chunker cuts what it reads into content defined chunks using a gear
+// rolling hash.
+type Chunker struct{
+	r io.Reader
+	buf []byte
+	err error
+}
+
+func NewChunker(r io.Reader) *Chunker{
+	return &Chunker{
+		r: r,
+		buf: make([]byte, 0, maxChunkSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF once all of them were returned.
+func (c *Chunker) Next() ([]byte, error){
+	for len(c.buf) < maxChunkSize && c.err == nil{
+		n, err := c.r.Read(c.buf[len(c.buf):maxChunkSize])
+		c.buf = c.buf[:len(c.buf) + n]
+		c.err = err
+	}
+	if c.err != nil && !errors.Is(c.err, io.EOF){
+		return nil, c.err
+	}
+	if len(c.buf) == 0{
+		return nil, io.EOF
+	}
+
+	cut := len(c.buf)
+	var hash uint64
+	for i := minChunkSize; i < len(c.buf); i++{
+		hash = hash << 1 + gearTable[c.buf[i]]
+		if hash & chunkMask == 0{
+			cut = i + 1
+			break
+		}
+	}
+
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.buf = c.buf[:copy(c.buf, c.buf[cut:])]
+	return chunk, nil
+}
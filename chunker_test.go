@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte) [][]byte{
+	t.Helper()
+
+	chunks := [][]byte{}
+	chunker := NewChunker(bytes.NewReader(data))
+	for{
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF){
+			return chunks
+		}
+		if err != nil{
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunker(t *testing.T){
+	data := make([]byte, 1 << 20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data){
+		t.Fatal("chunks do not add up to the data")
+	}
+	for i, chunk := range chunks{
+		if len(chunk) > maxChunkSize || (len(chunk) < minChunkSize && i < len(chunks) - 1){
+			t.Errorf("chunk %d has size %d", i, len(chunk))
+		}
+	}
+
+	// inserting bytes only changes the chunks around them
+	edited := append(bytes.Clone(data[:len(data) / 2]), append([]byte("inserted"), data[len(data) / 2:]...)...)
+	seen := map[string]bool{}
+	for _, chunk := range chunks{
+		seen[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range chunkAll(t, edited){
+		if !seen[string(chunk)]{
+			changed++
+		}
+	}
+	if changed > 2{
+		t.Errorf("want at most 2 changed chunks have %d of %d", changed, len(chunks))
+	}
+
+	if chunks := chunkAll(t, nil); len(chunks) != 0{
+		t.Errorf("want no chunks for empty data have %d", len(chunks))
+	}
+}
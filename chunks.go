@@ -0,0 +1,686 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+const (
+	// chunkNamespace is where the chunks of every owner's files are
+	// stored, so a chunk that is part of several files is stored once.
+	chunkNamespace = "chunks"
+	chunkRefsFileName = "chunkrefs.log"
+	// maxChunksPerMessage is how many chunk IDs a message carries at
+	// most, so it stays well below the largest frame peers accept.
+	maxChunksPerMessage = 16 << 10
+)
+
+// ChunkRef is an entry of a file's manifest. Every chunk is encrypted with
+// the hash of its own content, so equal chunks encrypt the same no matter
+// whose file they are part of, and stored under the hash of the result.
+type ChunkRef struct{
+	ID string
+	Key []byte
+	Size int64
+}
+
+// chunkedFile is a file cut into encrypted chunks, ready to be sent to
+// peers along with its encrypted manifest.
+type chunkedFile struct{
+	manifest []byte
+	// chunks holds the IDs of the distinct chunks in the order they
+	// first appear in the file
+	chunks []string
+	data map[string][]byte
+}
+
+// chunkedReplica is a replica we hold that is the manifest of a chunked
+// file, with the chunks it refers to.
+type chunkedReplica struct{
+	ID string
+	Key string
+	Chunks []string
+}
+
+// chunkRefSet keeps track of the chunks every replica we hold refers to
+// in a journal, so chunks can be dropped once nothing refers to them.
+type chunkRefSet struct{
+	lock sync.Mutex
+	refs *journal[chunkedReplica]
+	// pinned holds the chunks a peer was told we hold, and until when
+	// they are kept for the manifest it sends next even though nothing
+	// refers to them
+	pinned map[string]time.Time
+	// version counts the changes to the set
+	version uint64
+}
+
+// loadChunkRefs reads the references stored under the name. The returned set is
+// usable even on error, it then holds the ones that could be read.
+func loadChunkRefs(storage Storage, name string) (*chunkRefSet, error){
+	refs, err := loadJournal[chunkedReplica](storage, name)
+	return &chunkRefSet{refs: refs, pinned: make(map[string]time.Time)}, err
+}
+
+// Set records the chunks the replica refers to in place of the ones it
+// referred to before, and drops those no replica refers to any more and
+// that are not pinned. They are dropped with the lock held, so nobody can
+// be told we hold one of them while it goes.
+func (s *chunkRefSet) Set(id, key string, chunks []string, drop func(chunk string)) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the manifest the chunks were pinned for has arrived
+	for _, chunk := range chunks{
+		delete(s.pinned, chunk)
+	}
+
+	object := tombstoneID(id, key)
+	old := s.refs.items[object].Chunks
+	if slices.Equal(old, chunks){
+		return nil
+	}
+
+	var err error
+	if len(chunks) == 0{
+		err = s.refs.Delete(object)
+	} else {
+		err = s.refs.Put(object, chunkedReplica{ID: id, Key: key, Chunks: chunks})
+	}
+	s.version++
+
+	used := s.used()
+	for _, chunk := range old{
+		if !used[chunk] && !s.isPinned(chunk){
+			drop(chunk)
+			used[chunk] = true
+		}
+	}
+	return err
+}
+
+// Pin keeps the chunks from being dropped as orphans until the given
+// time, unless a replica refers to them before.
+func (s *chunkRefSet) Pin(chunks []string, until time.Time){
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, chunk := range chunks{
+		if until.After(s.pinned[chunk]){
+			s.pinned[chunk] = until
+		}
+	}
+}
+
+// isPinned reports whether the chunk is pinned, forgetting the pin once
+// it ran out. The lock must be held.
+func (s *chunkRefSet) isPinned(chunk string) bool{
+	until, ok := s.pinned[chunk]
+	if ok && time.Now().After(until){
+		delete(s.pinned, chunk)
+		return false
+	}
+	return ok
+}
+
+// Collect calls drop for those of the chunks no replica refers to and
+// that are not pinned, with the lock held like Set does.
+func (s *chunkRefSet) Collect(chunks []string, drop func(chunk string) error) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	used := s.used()
+	for _, chunk := range chunks{
+		if used[chunk] || s.isPinned(chunk){
+			continue
+		}
+		if err := drop(chunk); err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// used returns the chunks a replica refers to. The lock must be held.
+func (s *chunkRefSet) used() map[string]bool{
+	used := map[string]bool{}
+	for _, r := range s.refs.items{
+		for _, chunk := range r.Chunks{
+			used[chunk] = true
+		}
+	}
+	return used
+}
+
+// Has reports whether the replica is a manifest.
+func (s *chunkRefSet) Has(id, key string) bool{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.refs.items[tombstoneID(id, key)]
+	return ok
+}
+
+// Replicas returns the replicas that are manifests.
+func (s *chunkRefSet) Replicas() []chunkedReplica{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	replicas := make([]chunkedReplica, 0, len(s.refs.items))
+	for _, r := range s.refs.items{
+		replicas = append(replicas, r)
+	}
+	return replicas
+}
+
+func (s *chunkRefSet) Version() uint64{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.version
+}
+
+// chunkFile cuts the file into chunks, encrypts them and builds the
+// manifest listing them, encrypted with our key. Both are encrypted
+// deterministically, so storing the same file again produces the same
+// replica.
+func (s *FileServer) chunkFile(r io.Reader) (*chunkedFile, error){
+	file := &chunkedFile{
+		data: make(map[string][]byte),
+	}
+
+	refs := []ChunkRef{}
+	chunker := NewChunker(r)
+	for{
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF){
+			break
+		}
+		if err != nil{
+			return nil, err
+		}
+
+		key := sha256.Sum256(chunk)
+		encrypted, err := encryptDeterministic(key[:], chunk)
+		if err != nil{
+			return nil, err
+		}
+		sum := sha256.Sum256(encrypted)
+		id := hex.EncodeToString(sum[:])
+
+		refs = append(refs, ChunkRef{ID: id, Key: key[:], Size: int64(len(chunk))})
+		if _, ok := file.data[id]; !ok{
+			file.data[id] = encrypted
+			file.chunks = append(file.chunks, id)
+		}
+	}
+
+	manifest, err := json.Marshal(refs)
+	if err != nil{
+		return nil, err
+	}
+	file.manifest, err = encryptDeterministic(s.EncKey, manifest)
+	if err != nil{
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// chunking reports whether files are cut into chunks, which erasure
+// coding does not go along with.
+func (s *FileServer) chunking() bool{
+	return s.Chunking && s.erasure == nil
+}
+
+// storeOwnChunked stores our own copy of the file as its manifest along
+// with the chunks we do not hold yet, so a chunk it shares with other
+// files, ours or anybody else's, is stored once.
+func (s *FileServer) storeOwnChunked(ctx context.Context, key string, file *chunkedFile, meta ObjectMeta) error{
+	// the chunks we already hold must not be dropped before the manifest
+	// refers to them
+	s.chunkRefs.Pin(file.chunks, time.Now().Add(s.StagingTTL))
+
+	for _, id := range file.chunks{
+		if s.store.Has(chunkNamespace, id){
+			continue
+		}
+		if _, err := s.store.WriteWithMeta(ctx, chunkNamespace, id, bytes.NewReader(file.data[id]), ObjectMeta{ChargedTo: s.ID}); err != nil{
+			return err
+		}
+	}
+
+	if _, err := s.store.WriteWithMeta(ctx, s.ID, key, bytes.NewReader(file.manifest), meta); err != nil{
+		return err
+	}
+	return s.setChunkRefs(s.ID, key, file.chunks)
+}
+
+// readOwn reads our own copy of the file, putting it back together from
+// its chunks if it is stored as a manifest.
+func (s *FileServer) readOwn(key string) (int64, io.Reader, error){
+	n, r, err := s.store.readStream(s.ID, key)
+	if err != nil || !s.chunkRefs.Has(s.ID, key){
+		return n, r, err
+	}
+	defer r.Close()
+
+	refs, err := s.readManifest(r)
+	if err != nil{
+		return 0, nil, err
+	}
+
+	file := new(bytes.Buffer)
+	for _, ref := range refs{
+		want, err := hex.DecodeString(ref.ID)
+		if err != nil{
+			return 0, nil, err
+		}
+		_, chunk, err := s.store.Read(chunkNamespace, ref.ID)
+		if err != nil{
+			return 0, nil, fmt.Errorf("chunk (%s): %w", ref.ID, err)
+		}
+		data, err := readChunk(chunk, want)
+		if err != nil{
+			return 0, nil, fmt.Errorf("chunk (%s): %w", ref.ID, err)
+		}
+		if _, err := copyDecrypt(ref.Key, bytes.NewReader(data), file); err != nil{
+			return 0, nil, err
+		}
+	}
+
+	return int64(file.Len()), io.NopCloser(file), nil
+}
+
+// readManifest decrypts the manifest and returns the chunks it lists.
+func (s *FileServer) readManifest(r io.Reader) ([]ChunkRef, error){
+	manifest := new(bytes.Buffer)
+	if _, err := copyDecrypt(s.EncKey, r, manifest); err != nil{
+		return nil, err
+	}
+	refs := []ChunkRef{}
+	if err := json.Unmarshal(manifest.Bytes(), &refs); err != nil{
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	return refs, nil
+}
+
+// splitChunkPeers splits the peers into those we can send chunked replicas
+// to and the rest. Nobody gets chunked replicas unless Chunking is on.
+func (s *FileServer) splitChunkPeers(peers []p2p.Peer) ([]p2p.Peer, []p2p.Peer){
+	if !s.chunking(){
+		return nil, peers
+	}
+
+	chunked, others := []p2p.Peer{}, []p2p.Peer{}
+	for _, peer := range peers{
+		if peer.Supports(FeatureChunks){
+			chunked = append(chunked, peer)
+		} else {
+			others = append(others, peer)
+		}
+	}
+	return chunked, others
+}
+
+// replicateChunked sends every peer the chunks of the file it does not
+// hold yet, followed by the manifest. It returns how many of the peers
+// acknowledge the manifest and the ones the file could not be sent to.
+func (s *FileServer) replicateChunked(ctx context.Context, requestID string, key string, file *chunkedFile, peers []p2p.Peer) (int, []p2p.Peer){
+	acking := 0
+	failed := []p2p.Peer{}
+	meta := s.replicaMeta(key)
+	for _, peer := range peers{
+		if err := s.sendMissingChunks(ctx, key, file, peer); err != nil{
+			log.Printf("[%s] could not send the chunks of (%s) to (%s): %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			failed = append(failed, peer)
+			continue
+		}
+
+		msg := MessageStoreFile{
+			RequestID: requestID,
+			ID: s.ID,
+			Key: hashKey(key),
+			Size: int64(len(file.manifest)),
+			ChunkCount: len(file.chunks),
+			Meta: meta,
+		}
+		streams, n, unreachable := s.openStoreStreams(msg, []p2p.Peer{peer})
+		failed = append(failed, unreachable...)
+		if len(streams) == 0{
+			continue
+		}
+
+		_, _, err := s.sendReplicas(ctx, streams, func(w io.Writer) (int, error){
+			if err := writeChunkIDs(w, file.chunks); err != nil{
+				return 0, err
+			}
+			return w.Write(file.manifest)
+		})
+		if err != nil{
+			log.Printf("[%s] could not send the manifest of (%s) to (%s): %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			failed = append(failed, peer)
+			continue
+		}
+		acking += n
+	}
+
+	return acking, failed
+}
+
+// sendMissingChunks asks the peer which of the file's chunks it lacks and
+// sends it those, waiting until it stored them so the manifest never
+// arrives ahead of its chunks.
+func (s *FileServer) sendMissingChunks(ctx context.Context, key string, file *chunkedFile, peer p2p.Peer) error{
+	missing := []string{}
+	for start := 0; start < len(file.chunks); start += maxChunksPerMessage{
+		page := file.chunks[start:min(start + maxChunksPerMessage, len(file.chunks))]
+		requestID := generateId()
+		respCh, done := s.registerRequest(requestID, 1)
+		payload, err := s.request(ctx, peer, respCh, MessageHasChunks{RequestID: requestID, Chunks: page})
+		done()
+		if err != nil{
+			return err
+		}
+		resp, ok := payload.(MessageHasChunksResponse)
+		if !ok{
+			return fmt.Errorf("unexpected answer %T", payload)
+		}
+		missing = append(missing, resp.Missing...)
+	}
+	if len(missing) == 0{
+		return nil
+	}
+
+	ackID := generateId()
+	ackCh, ackDone := s.registerRequest(ackID, len(missing))
+	defer ackDone()
+
+	acking := 0
+	for _, id := range missing{
+		data, ok := file.data[id]
+		if !ok{
+			continue
+		}
+
+		msg := MessageStoreFile{
+			RequestID: ackID,
+			ID: chunkNamespace,
+			Key: id,
+			Size: int64(len(data)),
+		}
+		streams, n, _ := s.openStoreStreams(msg, []p2p.Peer{peer})
+		if len(streams) == 0{
+			return fmt.Errorf("could not open a stream for chunk (%s)", id)
+		}
+
+		_, _, err := s.sendReplicas(ctx, streams, func(w io.Writer) (int, error){
+			return w.Write(data)
+		})
+		if err != nil{
+			return err
+		}
+		acking += n
+	}
+
+	fmt.Printf("[%s] sent %d of %d chunks of (%s) to (%s)\n", s.Transport.Addr(), len(missing), len(file.chunks), key, peer.RemoteAddr())
+
+	return s.waitForAcks(ctx, key, ackCh, acking, acking)
+}
+
+// fetchChunkedFile fetches the manifest of the file from the peer, then
+// the chunks it lists, and writes the file they add up to to disk, or
+// the manifest and chunks themselves if we chunk files too. When it
+// breaks off, the chunks fetched so far are not fetched again.
+func (s *FileServer) fetchChunkedFile(ctx context.Context, from string, requestID string, key string, hash []byte, meta ObjectMeta) error{
+	request := func(streamID uint32) any{
+		return MessageFetchFile{
+			RequestID: requestID,
+			ID: s.ID,
+			Key: hashKey(key),
+			StreamID: streamID,
+		}
+	}
+
+	encrypted := new(bytes.Buffer)
+	err := s.fetchOverStream(ctx, from, request, func(r io.Reader) (int64, error){
+		if len(hash) > 0{
+			r = newHashCheckReader(r, hash)
+		}
+		return io.Copy(encrypted, r)
+	})
+	if err != nil{
+		return err
+	}
+
+	refs, err := s.readManifest(bytes.NewReader(encrypted.Bytes()))
+	if err != nil{
+		return err
+	}
+
+	chunked := &chunkedFile{
+		manifest: encrypted.Bytes(),
+		data: make(map[string][]byte),
+	}
+	file := new(bytes.Buffer)
+	for _, ref := range refs{
+		data, err := s.fetchChunk(ctx, from, ref.ID)
+		if err != nil{
+			return fmt.Errorf("chunk (%s): %w", ref.ID, err)
+		}
+		if _, ok := chunked.data[ref.ID]; !ok{
+			chunked.data[ref.ID] = data
+			chunked.chunks = append(chunked.chunks, ref.ID)
+		}
+
+		if _, err := copyDecrypt(ref.Key, bytes.NewReader(data), file); err != nil{
+			return err
+		}
+	}
+
+	if s.chunking(){
+		err = s.storeOwnChunked(ctx, key, chunked, meta)
+	} else if _, err = s.store.WriteWithMeta(ctx, s.ID, key, file, meta); err == nil{
+		err = s.setChunkRefs(s.ID, key, nil)
+	}
+	if err != nil{
+		return err
+	}
+
+	for _, ref := range refs{
+		s.store.DiscardStaged(chunkNamespace, ref.ID)
+	}
+	return nil
+}
+
+// fetchChunk reads the chunk from our own disk if we hold it for somebody
+// else or staged it on an earlier attempt to fetch the file, and
+// otherwise fetches it from the peer that sent the manifest, or any other
+// peer holding it. Fetched chunks are staged until the whole file is.
+func (s *FileServer) fetchChunk(ctx context.Context, from string, id string) ([]byte, error){
+	want, err := hex.DecodeString(id)
+	if err != nil{
+		return nil, err
+	}
+
+	if _, r, err := s.store.Read(chunkNamespace, id); err == nil{
+		if data, err := readChunk(r, want); err == nil{
+			return data, nil
+		}
+	}
+	if _, r, err := s.store.ReadStaged(chunkNamespace, id); err == nil{
+		if data, err := readChunk(r, want); err == nil{
+			return data, nil
+		}
+	}
+
+	request := func(streamID uint32) any{
+		return MessageFetchFile{
+			RequestID: generateId(),
+			ID: chunkNamespace,
+			Key: id,
+			StreamID: streamID,
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = s.fetchOverStream(ctx, from, request, func(r io.Reader) (int64, error){
+		return io.Copy(buf, newHashCheckReader(r, want))
+	})
+	data := buf.Bytes()
+	if err != nil{
+		if ctx.Err() != nil{
+			return nil, ctx.Err()
+		}
+		log.Printf("[%s] fetching chunk (%s) from (%s) failed: %s", s.Transport.Addr(), id, from, err)
+
+		data, err = s.findObject(ctx, chunkNamespace, id, s.peersSupporting(FeatureChunks))
+		if err != nil{
+			return nil, err
+		}
+	}
+
+	if _, err := s.store.WriteStaged(ctx, chunkNamespace, id, 0, bytes.NewReader(data)); err != nil{
+		log.Printf("[%s] could not stage chunk (%s): %s", s.Transport.Addr(), id, err)
+	}
+	return data, nil
+}
+
+// readChunk reads the chunk and checks it hashes to want.
+func readChunk(r io.Reader, want []byte) ([]byte, error){
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+	return io.ReadAll(newHashCheckReader(r, want))
+}
+
+// setChunkRefs records the chunks a replica refers to and drops the
+// chunks nothing refers to any more.
+func (s *FileServer) setChunkRefs(id, key string, chunks []string) error{
+	return s.chunkRefs.Set(id, key, chunks, func(chunk string){
+		if err := s.store.Delete(chunkNamespace, chunk); err != nil{
+			log.Printf("[%s] could not drop chunk (%s): %s", s.Transport.Addr(), chunk, err)
+		}
+	})
+}
+
+// writeChunkIDs writes the IDs of the chunks as the hashes they are the
+// hex encoding of.
+func writeChunkIDs(w io.Writer, chunks []string) error{
+	buf := make([]byte, 0, len(chunks) * sha256.Size)
+	for _, chunk := range chunks{
+		id, err := hex.DecodeString(chunk)
+		if err != nil || len(id) != sha256.Size{
+			return fmt.Errorf("invalid chunk ID (%s)", chunk)
+		}
+		buf = append(buf, id...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readChunkIDs reads the IDs of n chunks written by writeChunkIDs ahead
+// of a manifest of the given size. Every chunk takes up more than a byte
+// of the manifest, so no more than that many are read.
+func readChunkIDs(r io.Reader, n int, size int64) ([]string, error){
+	if n < 0 || int64(n) > size{
+		return nil, fmt.Errorf("a manifest of %d bytes cannot refer to %d chunks", size, n)
+	}
+
+	buf := make([]byte, n * sha256.Size)
+	if _, err := io.ReadFull(r, buf); err != nil{
+		return nil, fmt.Errorf("reading the chunks of the manifest: %w", err)
+	}
+	chunks := make([]string, 0, n)
+	for i := 0; i < n; i++{
+		chunks = append(chunks, hex.EncodeToString(buf[i * sha256.Size:(i + 1) * sha256.Size]))
+	}
+	return chunks, nil
+}
+
+// checkChunks fails unless we hold every chunk of the manifest.
+func (s *FileServer) checkChunks(chunks []string) error{
+	missing := 0
+	for _, chunk := range chunks{
+		if !s.store.Has(chunkNamespace, chunk){
+			missing++
+		}
+	}
+	if missing > 0{
+		return fmt.Errorf("%d of the %d chunks of the manifest are missing", missing, len(chunks))
+	}
+	return nil
+}
+
+// collectChunks drops the chunks nothing refers to that were written
+// longer than ttl ago, which were sent for a manifest that never arrived.
+// Pinned chunks are kept until their pin runs out.
+func (s *FileServer) collectChunks(ttl time.Duration) error{
+	chunks, err := s.store.List(chunkNamespace, "")
+	if err != nil{
+		return err
+	}
+
+	return s.chunkRefs.Collect(chunks, func(chunk string) error{
+		modTime, err := s.store.modTime(chunkNamespace, chunk)
+		if err != nil || time.Since(modTime) <= ttl{
+			return nil
+		}
+		if err := s.store.Delete(chunkNamespace, chunk); err != nil{
+			return err
+		}
+		log.Printf("[%s] dropped chunk (%s) nothing refers to", s.Transport.Addr(), chunk)
+		return nil
+	})
+}
+
+// MessageHasChunks asks a peer which of the chunks it does not hold. The
+// peer answers with a MessageHasChunksResponse carrying the same RequestID.
+type MessageHasChunks struct{
+	RequestID string
+	Chunks []string
+}
+
+type MessageHasChunksResponse struct{
+	RequestID string
+	Missing []string
+}
+
+func (s *FileServer) handleMessageHasChunks(from string, msg MessageHasChunks) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
+	}
+
+	resp := MessageHasChunksResponse{
+		RequestID: msg.RequestID,
+	}
+	// the peer will not send the chunks we say we hold, so they must
+	// still be there when its manifest arrives. They are pinned before
+	// we look, once pinned they are no longer dropped.
+	s.chunkRefs.Pin(msg.Chunks, time.Now().Add(s.StagingTTL))
+	for _, id := range msg.Chunks{
+		if !s.store.Has(chunkNamespace, id){
+			resp.Missing = append(resp.Missing, id)
+		}
+	}
+
+	return s.send(peer, &Message{Payload: resp})
+}
+
+func (s *FileServer) handleMessageHasChunksResponse(from string, msg MessageHasChunksResponse) error{
+	s.deliverResponse(msg.RequestID, from, msg)
+	return nil
+}
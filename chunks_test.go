@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dropped returns a drop func for chunkRefSet.Set recording the chunks
+// it is called for.
+func dropped(chunks *[]string) func(string){
+	return func(chunk string){
+		*chunks = append(*chunks, chunk)
+	}
+}
+
+// collected returns the chunks chunkRefSet.Collect drops.
+func collected(t *testing.T, set *chunkRefSet, chunks []string) []string{
+	t.Helper()
+	unused := []string{}
+	err := set.Collect(chunks, func(chunk string) error{
+		unused = append(unused, chunk)
+		return nil
+	})
+	if err != nil{
+		t.Fatal(err)
+	}
+	return unused
+}
+
+func TestChunkRefSet(t *testing.T){
+	storage := NewDiskStorage(t.TempDir(), false)
+	set, err := loadChunkRefs(storage, chunkRefsFileName)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	orphans := []string{}
+	if err := set.Set("owner", "a", []string{"x", "y"}, dropped(&orphans)); err != nil{
+		t.Fatal(err)
+	}
+	if err := set.Set("owner", "b", []string{"y", "z"}, dropped(&orphans)); err != nil{
+		t.Fatal(err)
+	}
+
+	// references survive a restart
+	set, err = loadChunkRefs(storage, chunkRefsFileName)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !set.Has("owner", "a"){
+		t.Fatal("replica a was forgotten")
+	}
+
+	if err := set.Set("owner", "a", nil, dropped(&orphans)); err != nil{
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0] != "x"{
+		t.Errorf("want orphans [x] have %v", orphans)
+	}
+}
+
+func TestChunkRefSetPins(t *testing.T){
+	set, err := loadChunkRefs(NewDiskStorage(t.TempDir(), false), chunkRefsFileName)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	orphans := []string{}
+	if err := set.Set("owner", "a", []string{"x", "y"}, dropped(&orphans)); err != nil{
+		t.Fatal(err)
+	}
+	// a peer was told we hold x and is about to send a manifest using it
+	set.Pin([]string{"x"}, time.Now().Add(time.Hour))
+
+	if err := set.Set("owner", "a", nil, dropped(&orphans)); err != nil{
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0] != "y"{
+		t.Errorf("want orphans [y] have %v", orphans)
+	}
+	if unused := collected(t, set, []string{"x", "y"}); len(unused) != 1 || unused[0] != "y"{
+		t.Errorf("want unused [y] have %v", unused)
+	}
+
+	// the pin is released once the manifest arrives, and runs out
+	// otherwise
+	if err := set.Set("other", "b", []string{"x"}, dropped(&orphans)); err != nil{
+		t.Fatal(err)
+	}
+	if err := set.Set("other", "b", nil, dropped(&orphans)); err != nil{
+		t.Fatal(err)
+	}
+	set.Pin([]string{"z"}, time.Now().Add(-time.Second))
+	if unused := collected(t, set, []string{"x", "z"}); len(unused) != 2{
+		t.Errorf("want unused [x z] have %v", unused)
+	}
+}
+
+func TestFileServerCollectChunks(t *testing.T){
+	s := newTestServer(t)
+
+	for _, chunk := range []string{"orphan", "referenced", "pinned"}{
+		if _, err := s.store.Write(chunkNamespace, chunk, strings.NewReader(chunk)); err != nil{
+			t.Fatal(err)
+		}
+	}
+	if err := s.setChunkRefs("owner", "key", []string{"referenced"}); err != nil{
+		t.Fatal(err)
+	}
+	s.chunkRefs.Pin([]string{"pinned"}, time.Now().Add(time.Hour))
+
+	if err := s.checkChunks([]string{"referenced", "missing"}); err == nil{
+		t.Error("manifest with a missing chunk was accepted")
+	}
+
+	// chunks are given time for their manifest to arrive
+	if err := s.collectChunks(time.Hour); err != nil{
+		t.Fatal(err)
+	}
+	if !s.store.Has(chunkNamespace, "orphan"){
+		t.Error("chunk dropped before its manifest could arrive")
+	}
+
+	if err := s.collectChunks(0); err != nil{
+		t.Fatal(err)
+	}
+	if s.store.Has(chunkNamespace, "orphan"){
+		t.Error("chunk nothing refers to was kept")
+	}
+	for _, chunk := range []string{"referenced", "pinned"}{
+		if !s.store.Has(chunkNamespace, chunk){
+			t.Errorf("chunk (%s) was dropped", chunk)
+		}
+	}
+}
+
+func TestChunkIDs(t *testing.T){
+	chunks := []string{}
+	for i := 0; i < maxChunksPerMessage + 1; i++{
+		id := sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		chunks = append(chunks, hex.EncodeToString(id[:]))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeChunkIDs(buf, chunks); err != nil{
+		t.Fatal(err)
+	}
+	buf.WriteString("manifest")
+	read, err := readChunkIDs(buf, len(chunks), 1 << 20)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !slices.Equal(read, chunks){
+		t.Error("chunk IDs changed on the way")
+	}
+	if buf.String() != "manifest"{
+		t.Errorf("read into the manifest, left %q", buf.String())
+	}
+
+	// the count is checked before anything is allocated for it
+	if _, err := readChunkIDs(buf, 1 << 40, 100); err == nil{
+		t.Error("manifest of 100 bytes was taken to refer to 1<<40 chunks")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Consistency is how many replicas have to take part in a read or write
+// before it counts as successful.
+type Consistency int
+
+const (
+	// ConsistencyAny does not wait on replicas at all: writes return once
+	// the file is sent and reads are served by whoever has the file.
+	ConsistencyAny Consistency = iota
+	ConsistencyOne
+	ConsistencyQuorum
+	ConsistencyAll
+)
+
+var ErrConsistencyNotMet = errors.New("consistency level not met")
+
+func (c Consistency) String() string{
+	switch c{
+	case ConsistencyAny:
+		return "ANY"
+	case ConsistencyOne:
+		return "ONE"
+	case ConsistencyQuorum:
+		return "QUORUM"
+	case ConsistencyAll:
+		return "ALL"
+	}
+	return fmt.Sprintf("Consistency(%d)", int(c))
+}
+
+// required returns how many of the n replicas of a file must take part.
+func (c Consistency) required(n int) int{
+	switch c{
+	case ConsistencyOne:
+		return 1
+	case ConsistencyQuorum:
+		return n / 2 + 1
+	case ConsistencyAll:
+		return n
+	}
+	return 0
+}
+
+type WriteOptions struct{
+	// Consistency is how many replicas must acknowledge they
+	// persisted the file before the write succeeds.
+	Consistency Consistency
+	// ContentType and Tags are recorded in the file's metadata and
+	// passed on to its replicas.
+	ContentType string
+	Tags map[string]string
+}
+
+type ReadOptions struct{
+	// Consistency is how many replicas must confirm they hold the same
+	// version of the file before it is returned, counted as for writes:
+	// our own copy is not one of them. Only ANY reads are served from our
+	// own copy without asking.
+	Consistency Consistency
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestConsistencyRequired(t *testing.T){
+	tests := []struct{
+		consistency Consistency
+		replicas int
+		want int
+	}{
+		{ConsistencyAny, 3, 0},
+		{ConsistencyOne, 3, 1},
+		{ConsistencyQuorum, 3, 2},
+		{ConsistencyQuorum, 4, 3},
+		{ConsistencyAll, 3, 3},
+	}
+
+	for _, tt := range tests{
+		if have := tt.consistency.required(tt.replicas); have != tt.want{
+			t.Errorf("%s of %d replicas: want %d have %d", tt.consistency, tt.replicas, tt.want, have)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"io"
 )
@@ -62,7 +64,7 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer)(int, error){
 	// Read the iv from the given io.Reader which should be 
 	// the block.BlockSize() bytes we read.
 	iv := make([]byte, aes.BlockSize)
-	if _, err := src.Read(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 
@@ -91,4 +93,42 @@ func copyEncrypt(key []byte, src io.Reader, dst io.Writer)(int, error){
 	stream := cipher.NewCTR(block, iv)
 	return copyStream(stream, block.BlockSize(), src, dst)
 	
-}
\ No newline at end of file
+}
+
+// deterministicIVLabel names the key the iv of deterministically
+// encrypted data is derived with.
+const deterministicIVLabel = "tunerstore deterministic iv"
+
+// deriveKey derives a 256 bit subkey of key for the purpose label names
+// with HKDF-SHA256, so no key is used for more than one thing.
+func deriveKey(key []byte, label string) []byte{
+	extract := hmac.New(sha256.New, nil)
+	extract.Write(key)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(label))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// encryptDeterministic encrypts like copyEncrypt, but derives the iv from
+// the plaintext so equal plaintexts encrypt to equal ciphertexts. It may
+// only be used where revealing that two plaintexts are equal is fine.
+// The iv is a MAC of the plaintext under a subkey of key, key itself only
+// keys the cipher, so copyDecrypt reads the result.
+func encryptDeterministic(key []byte, plain []byte) ([]byte, error){
+	block, err := aes.NewCipher(key)
+	if err != nil{
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, deriveKey(key, deterministicIVLabel))
+	mac.Write(plain)
+	iv := mac.Sum(nil)[:block.BlockSize()]
+
+	out := make([]byte, len(iv) + len(plain))
+	copy(out, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(out[len(iv):], plain)
+	return out, nil
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"testing"
 )
@@ -34,4 +37,36 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	}
 
 	fmt.Println(out.Bytes())
-}
\ No newline at end of file
+}
+
+func TestEncryptDeterministic(t *testing.T) {
+	payload := []byte("foo not barz")
+	key := newEncryptionKey()
+
+	a, err := encryptDeterministic(key, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encryptDeterministic(key, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("equal plaintexts encrypted differently")
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(key, bytes.NewReader(a), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("want %s have %s", payload, out.Bytes())
+	}
+
+	// the iv is not keyed with the cipher key
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if bytes.Equal(a[:aes.BlockSize], mac.Sum(nil)[:aes.BlockSize]) {
+		t.Error("iv is a MAC under the cipher key")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// diskFree cannot find out the free space on this platform, so no disk
+// reserve is kept.
+func diskFree(path string) (int64, error){
+	return 0, errors.ErrUnsupported
+}
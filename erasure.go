@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+// shardNamespaceSuffix marks the namespace a node's shards are stored
+// under on its peers. Shards are kept apart from replicas so anti-entropy
+// does not copy every shard to every node.
+const shardNamespaceSuffix = ".shards"
+
+// shardHeaderSize is the size of the header in front of every shard,
+// holding the size of the encrypted file the shards add up to followed
+// by its SHA-256. The hash tells the shards of one version of the file
+// from those of another, and checks the file they are joined into.
+const shardHeaderSize = 8 + sha256.Size
+
+func shardNamespace(id string) string{
+	return id + shardNamespaceSuffix
+}
+
+func isShardNamespace(id string) bool{
+	return strings.HasSuffix(id, shardNamespaceSuffix)
+}
+
+func shardKey(key string, shard int) string{
+	return fmt.Sprintf("%s#shard-%d", hashKey(key), shard)
+}
+
+// shardPeers orders the peers by their place on the ring, starting at the
+// key, so the shards of a file spread over as many nodes as possible.
+func (s *FileServer) shardPeers(key string, peers []p2p.Peer) []p2p.Peer{
+	byID := map[string]p2p.Peer{}
+	for _, peer := range peers{
+		if _, ok := byID[peer.ID()]; !ok{
+			byID[peer.ID()] = peer
+		}
+	}
+
+	ordered := []p2p.Peer{}
+	for _, id := range s.ring.Lookup(hashKey(key), s.ring.Len()){
+		if peer, ok := byID[id]; ok{
+			ordered = append(ordered, peer)
+		}
+	}
+	return ordered
+}
+
+// storeErasureCoded encrypts the file, splits it into data and parity
+// shards and sends every shard to a different peer. When there are fewer
+// peers than shards some of them hold several, and fewer failures can be
+// survived.
+//
+// Any consistency level above ConsistencyAny waits for at least as many
+// shards as are needed to read the file back.
+func (s *FileServer) storeErasureCoded(ctx context.Context, key string, r io.Reader, opts WriteOptions) error{
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(s.EncKey, contextReader{ctx: ctx, r: r}, encrypted); err != nil{
+		return err
+	}
+
+	shards := s.erasure.Split(encrypted.Bytes())
+	if err := s.erasure.Encode(shards); err != nil{
+		return err
+	}
+
+	required := 0
+	if opts.Consistency != ConsistencyAny{
+		required = max(opts.Consistency.required(len(shards)), s.erasure.DataShards())
+	}
+
+	peers := s.shardPeers(key, s.peersSupporting(FeatureGetFile))
+	if len(peers) == 0{
+		if required > 0{
+			return fmt.Errorf("%w: no peers to place the shards of (%s) on", ErrConsistencyNotMet, key)
+		}
+		return nil
+	}
+
+	requestID := generateId()
+	ackCh, done := s.registerRequest(requestID, len(shards))
+	defer done()
+
+	hash := sha256.Sum256(encrypted.Bytes())
+	header := append(binary.BigEndian.AppendUint64(nil, uint64(encrypted.Len())), hash[:]...)
+	// the shards carry when we wrote the file, to tell them from the
+	// deletes of it
+	own, _ := s.store.Stat(s.ID, key)
+	acking := 0
+	for i, shard := range shards{
+		peer := peers[i % len(peers)]
+		msg := MessageStoreFile{
+			RequestID: requestID,
+			ID: shardNamespace(s.ID),
+			Key: shardKey(key, i),
+			Size: int64(shardHeaderSize + len(shard)),
+			Meta: ObjectMeta{Modified: own.Modified},
+		}
+
+		streams, n, _ := s.openStoreStreams(msg, []p2p.Peer{peer})
+		if len(streams) == 0{
+			continue
+		}
+
+		_, _, err := s.sendReplicas(ctx, streams, func(w io.Writer) (int, error){
+			n, err := io.Copy(w, io.MultiReader(bytes.NewReader(header), bytes.NewReader(shard)))
+			return int(n), err
+		})
+		if err != nil{
+			if ctx.Err() != nil{
+				return ctx.Err()
+			}
+			log.Printf("[%s] could not send shard %d of (%s) to (%s): %s", s.Transport.Addr(), i, key, peer.RemoteAddr(), err)
+			continue
+		}
+		acking += n
+	}
+
+	fmt.Printf("[%s] sent %d shards of (%s) to %d peers\n", s.Transport.Addr(), len(shards), key, len(peers))
+
+	if acking < required{
+		return fmt.Errorf("%w: %s write of (%s) needs %d shards acknowledged but only %d can be",
+			ErrConsistencyNotMet, opts.Consistency, key, required, acking)
+	}
+	if required == 0{
+		return nil
+	}
+
+	return s.waitForAcks(ctx, key, ackCh, acking, required)
+}
+
+// getErasureCoded looks for every shard of the file at once and rebuilds
+// the file from the first ones that arrive of the same version of it.
+func (s *FileServer) getErasureCoded(ctx context.Context, key string) (io.Reader, error){
+	peers := s.peersSupporting(FeatureGetFile)
+	total := s.erasure.DataShards() + s.erasure.ParityShards()
+
+	type result struct{
+		shard int
+		data []byte
+		err error
+	}
+
+	findCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, total)
+	for i := 0; i < total; i++{
+		go func (i int)  {
+			data, err := s.findObject(findCtx, shardNamespace(s.ID), shardKey(key, i), peers)
+			results <- result{shard: i, data: data, err: err}
+		}(i)
+	}
+
+	// the shards are grouped by the version of the file their header
+	// names, only shards of the same version can be joined
+	type version struct{
+		shards [][]byte
+		found int
+	}
+	versions := map[string]*version{}
+	var header string
+	var errs []error
+	for i := 0; i < total; i++{
+		res := <- results
+		if res.err == nil && len(res.data) < shardHeaderSize{
+			res.err = errors.New("shard is too short")
+		}
+		if res.err != nil{
+			errs = append(errs, fmt.Errorf("shard %d: %w", res.shard, res.err))
+			continue
+		}
+
+		h := string(res.data[:shardHeaderSize])
+		v, ok := versions[h]
+		if !ok{
+			v = &version{shards: make([][]byte, total)}
+			versions[h] = v
+		}
+		v.shards[res.shard] = res.data[shardHeaderSize:]
+		v.found++
+		if v.found == s.erasure.DataShards(){
+			header = h
+			break
+		}
+	}
+	cancel()
+
+	if len(header) == 0{
+		found := 0
+		for _, v := range versions{
+			found = max(found, v.found)
+		}
+		return nil, fmt.Errorf("[%s] file (%s): %w: found %d of %d of the same version: %w",
+			s.Transport.Addr(), key, ErrTooFewShards, found, s.erasure.DataShards(), errors.Join(errs...))
+	}
+
+	shards := versions[header].shards
+	if err := s.erasure.Reconstruct(shards); err != nil{
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint64([]byte(header)))
+	encrypted, err := s.erasure.Join(shards, size)
+	if err != nil{
+		return nil, err
+	}
+	if hash := sha256.Sum256(encrypted); !bytes.Equal(hash[:], []byte(header[8:])){
+		return nil, fmt.Errorf("[%s] file (%s) rebuilt from its shards: %w", s.Transport.Addr(), key, ErrCorrupt)
+	}
+
+	if _, err := s.store.WriteDecryptContext(ctx, s.EncKey, s.ID, key, bytes.NewReader(encrypted)); err != nil{
+		return nil, err
+	}
+
+	_, r, err := s.store.Read(s.ID, key)
+	return r, err
+}
+
+// findObject asks the peers for the object stored under the key in the
+// namespace and fetches it from the first one that holds it.
+func (s *FileServer) findObject(ctx context.Context, id string, key string, peers []p2p.Peer) ([]byte, error){
+	requestID := generateId()
+	respCh, done := s.registerRequest(requestID, len(peers))
+	defer done()
+
+	msg := Message{
+		Payload: MessageGetFile{
+			RequestID: requestID,
+			ID: id,
+			Key: key,
+		},
+	}
+
+	asked := 0
+	for _, peer := range peers{
+		if err := s.send(peer, &msg); err != nil{
+			log.Printf("[%s] could not ask (%s) for object (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), key, err)
+			continue
+		}
+		asked++
+	}
+
+	timeout := time.NewTimer(s.RequestTimeout)
+	defer timeout.Stop()
+
+	for answered := 0; answered < asked; {
+		select{
+		case resp := <- respCh:
+			msg, ok := resp.payload.(MessageGetFileResponse)
+			if !ok{
+				continue
+			}
+			answered++
+			if !msg.Found{
+				continue
+			}
+
+			request := func(streamID uint32) any{
+				return MessageFetchFile{
+					RequestID: requestID,
+					ID: id,
+					Key: key,
+					StreamID: streamID,
+				}
+			}
+
+			buf := new(bytes.Buffer)
+			err := s.fetchOverStream(ctx, resp.from, request, func(r io.Reader) (int64, error){
+				if len(msg.Hash) > 0{
+					r = newHashCheckReader(r, msg.Hash)
+				}
+				return io.Copy(buf, r)
+			})
+			if err == nil{
+				return buf.Bytes(), nil
+			}
+			if ctx.Err() != nil{
+				return nil, ctx.Err()
+			}
+			log.Printf("[%s] fetching object (%s) from (%s) failed: %s", s.Transport.Addr(), key, resp.from, err)
+		case <- timeout.C:
+			return nil, fmt.Errorf("timed out waiting for peers to answer request for object (%s)", key)
+		case <- ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, fmt.Errorf("object (%s) could not be found on the network", key)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+func TestFileServerStoreAndGet(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s1.peerList()) == 1 && len(s2.peerList()) == 1 })
+
+	data := []byte("a file that lives on the network")
+	if err := s2.Store("network_file", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return s1.store.Has(s2.ID, hashKey("network_file")) })
+
+	// drop only our own copy so the file has to come from the network
+	if err := s2.store.Delete(s2.ID, "network_file"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s2.Get("network_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, data){
+		t.Errorf("want %s have %s", data, b)
+	}
+
+	if _, err := s2.Get("missing_file"); err == nil {
+		t.Error("expected an error for a file nobody holds")
+	}
+}
+
+func TestFileServerGetTimesOut(t *testing.T) {
+	// a peer that takes every message and never answers any
+	silent := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr: ":0",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Features: ServerFeatures,
+		NodeID: generateId(),
+	})
+	if err := silent.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { silent.Close() })
+
+	s := newTestServerWithOpts(t, FileServerOpts{RequestTimeout: 200 * time.Millisecond})
+	if err := s.Transport.Dial(silent.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(s.peerList()) == 1 })
+
+	start := time.Now()
+	_, err := s.Get("unanswered_file")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("want a timeout have %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2 * time.Second {
+		t.Errorf("Get gave up after %s instead of the request timeout", elapsed)
+	}
+}
+
+// countingStorage counts the reads of objects, leaving out the files
+// the store keeps its bookkeeping in.
+type countingStorage struct {
+	Storage
+	reads atomic.Int64
+}
+
+func (c *countingStorage) Read(name string) (int64, io.ReadCloser, error) {
+	if !strings.HasPrefix(name, ".") {
+		c.reads.Add(1)
+	}
+	return c.Storage.Read(name)
+}
+
+func TestFileServerGetAnswersRecordedHash(t *testing.T) {
+	storage := &countingStorage{Storage: NewMemoryStorage()}
+	s1 := newTestServerWithOpts(t, FileServerOpts{Storage: storage})
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	ctx := context.Background()
+	if err := s2.StoreWithOptions(ctx, "probed_file", bytes.NewReader([]byte("never read")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// confirming our own copy does not have the replica read
+	storage.reads.Store(0)
+	if _, err := s2.GetWithOptions(ctx, "probed_file", ReadOptions{Consistency: ConsistencyOne}); err != nil {
+		t.Fatal(err)
+	}
+	if n := storage.reads.Load(); n > 0 {
+		t.Errorf("replica was read %d times to answer a probe", n)
+	}
+}
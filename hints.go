@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+const (
+	defaultHintTTL = 3 * time.Hour
+	defaultMaxHintBytes = 256 << 20
+	hintFileName = "hints.log"
+)
+
+var ErrHintsFull = errors.New("hint storage is full")
+
+// Hint records that a file could not be replicated to the target node
+// because it was down. The file is sent from our own copy once the node
+// reconnects, so the hint only needs to remember which file it was.
+type Hint struct{
+	Target string
+	Key string
+	Size int64
+	Created time.Time
+}
+
+// hintSet keeps the hints younger than ttl in a journal, so they survive
+// restarts, and refuses new ones once the files they refer to add up to
+// more than maxBytes.
+type hintSet struct{
+	lock sync.Mutex
+	ttl time.Duration
+	maxBytes int64
+	hints *journal[Hint]
+}
+
+func hintID(target, key string) string{
+	return target + "/" + key
+}
+
+// loadHints reads the hints stored under the name. The returned set is usable
+// even on error, it then holds the ones that could be read.
+func loadHints(storage Storage, name string, ttl time.Duration, maxBytes int64) (*hintSet, error){
+	hints, err := loadJournal[Hint](storage, name)
+	return &hintSet{ttl: ttl, maxBytes: maxBytes, hints: hints}, err
+}
+
+// Add records the hint, replacing an older one for the same file and
+// target.
+func (s *hintSet) Add(h Hint) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.expire(time.Now()); err != nil{
+		return err
+	}
+
+	var total int64
+	for id, old := range s.hints.items{
+		if id != hintID(h.Target, h.Key){
+			total += old.Size
+		}
+	}
+	if total + h.Size > s.maxBytes{
+		return fmt.Errorf("%w: hints already cover %d of %d bytes", ErrHintsFull, total, s.maxBytes)
+	}
+
+	return s.hints.Put(hintID(h.Target, h.Key), h)
+}
+
+// Remove drops the hint unless a newer one replaced it in the meantime.
+func (s *hintSet) Remove(h Hint) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old, ok := s.hints.items[hintID(h.Target, h.Key)]; !ok || old.Created.After(h.Created){
+		return nil
+	}
+
+	return s.hints.Delete(hintID(h.Target, h.Key))
+}
+
+// For returns the hints waiting for the target node.
+func (s *hintSet) For(target string) ([]Hint, error){
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.expire(time.Now())
+
+	hints := []Hint{}
+	for _, h := range s.hints.items{
+		if h.Target == target{
+			hints = append(hints, h)
+		}
+	}
+	return hints, err
+}
+
+// expire drops the hints older than ttl. The lock must be held.
+func (s *hintSet) expire(now time.Time) error{
+	expired := []string{}
+	for id, h := range s.hints.items{
+		if now.Sub(h.Created) > s.ttl{
+			expired = append(expired, id)
+		}
+	}
+	return s.hints.Delete(expired...)
+}
+
+// addHints records a hint for every target that missed the file.
+func (s *FileServer) addHints(key string, size int64, targets []string){
+	for _, target := range targets{
+		hint := Hint{
+			Target: target,
+			Key: key,
+			Size: size,
+			Created: time.Now(),
+		}
+		if err := s.hints.Add(hint); err != nil{
+			log.Printf("[%s] could not keep hint of file (%s) for (%s): %s", s.Transport.Addr(), key, target, err)
+			continue
+		}
+		log.Printf("[%s] keeping hint of file (%s) for (%s)", s.Transport.Addr(), key, target)
+	}
+}
+
+// replayHints sends the files the peer missed while it was down. Hints
+// are only dropped once the peer acknowledged the file, or once the file
+// is gone because we deleted it since.
+func (s *FileServer) replayHints(peer p2p.Peer){
+	hints, err := s.hints.For(peer.ID())
+	if err != nil{
+		log.Printf("[%s] could not expire hints: %s", s.Transport.Addr(), err)
+	}
+
+	for _, hint := range hints{
+		err := s.replayHint(peer, hint)
+		if err != nil && !errors.Is(err, fs.ErrNotExist){
+			log.Printf("[%s] replaying hint of file (%s) to (%s) failed: %s", s.Transport.Addr(), hint.Key, peer.RemoteAddr(), err)
+			continue
+		}
+
+		if err := s.hints.Remove(hint); err != nil{
+			log.Printf("[%s] could not drop hint of file (%s): %s", s.Transport.Addr(), hint.Key, err)
+		}
+	}
+}
+
+func (s *FileServer) replayHint(peer p2p.Peer, hint Hint) error{
+	_, r, err := s.readOwn(hint.Key)
+	if err != nil{
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+
+	ctx, cancel := s.quitContext()
+	defer cancel()
+
+	requestID := generateId()
+	ackCh, done := s.registerRequest(requestID, 1)
+	defer done()
+
+	if chunked, _ := s.splitChunkPeers([]p2p.Peer{peer}); len(chunked) > 0{
+		file, err := s.chunkFile(contextReader{ctx: ctx, r: r})
+		if err != nil{
+			return err
+		}
+
+		acking, failed := s.replicateChunked(ctx, requestID, hint.Key, file, chunked)
+		if len(failed) > 0{
+			return fmt.Errorf("could not send file (%s) to (%s)", hint.Key, peer.RemoteAddr())
+		}
+
+		log.Printf("[%s] replayed hint of file (%s) to (%s)", s.Transport.Addr(), hint.Key, peer.RemoteAddr())
+		return s.waitForAcks(ctx, hint.Key, ackCh, acking, acking)
+	}
+
+	data, err := io.ReadAll(contextReader{ctx: ctx, r: r})
+	if err != nil{
+		return err
+	}
+	replica, err := encryptDeterministic(s.EncKey, data)
+	if err != nil{
+		return err
+	}
+	hash := sha256.Sum256(replica)
+
+	// carry on where a transfer that broke off stopped
+	offset := s.stagedOffset(ctx, peer, s.ID, hashKey(hint.Key), hash[:])
+	if offset > int64(len(replica)){
+		offset = 0
+	}
+
+	msg := MessageStoreFile{
+		RequestID: requestID,
+		ID: s.ID,
+		Key: hashKey(hint.Key),
+		Size: int64(len(replica)) - offset,
+		Hash: hash[:],
+		Offset: offset,
+		Meta: s.replicaMeta(hint.Key),
+	}
+	streams, acking, _ := s.openStoreStreams(msg, []p2p.Peer{peer})
+	if len(streams) == 0{
+		return fmt.Errorf("could not send file (%s) to (%s)", hint.Key, peer.RemoteAddr())
+	}
+
+	_, _, err = s.sendReplicas(ctx, streams, func(w io.Writer) (int, error){
+		return w.Write(replica[offset:])
+	})
+	if err != nil{
+		return err
+	}
+
+	log.Printf("[%s] replayed hint of file (%s) to (%s)", s.Transport.Addr(), hint.Key, peer.RemoteAddr())
+
+	if acking == 0{
+		return nil
+	}
+	return s.waitForAcks(ctx, hint.Key, ackCh, acking, acking)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHintSetLimits(t *testing.T){
+	storage := NewDiskStorage(t.TempDir(), false)
+	set, err := loadHints(storage, hintFileName, time.Hour, 100)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if err := set.Add(Hint{Target: "node", Key: "a", Size: 60, Created: now}); err != nil{
+		t.Fatal(err)
+	}
+	if err := set.Add(Hint{Target: "node", Key: "b", Size: 60, Created: now}); !errors.Is(err, ErrHintsFull){
+		t.Errorf("want %v have %v", ErrHintsFull, err)
+	}
+	// a newer hint for the same file replaces the old one
+	if err := set.Add(Hint{Target: "node", Key: "a", Size: 90, Created: now}); err != nil{
+		t.Fatal(err)
+	}
+	if err := set.Add(Hint{Target: "other", Key: "c", Size: 10, Created: now.Add(-2 * time.Hour)}); err != nil{
+		t.Fatal(err)
+	}
+
+	// hints survive a restart and expire after the TTL
+	set, err = loadHints(storage, hintFileName, time.Hour, 100)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if hints, _ := set.For("node"); len(hints) != 1 || hints[0].Size != 90{
+		t.Errorf("want the replaced hint have %v", hints)
+	}
+	if hints, _ := set.For("other"); len(hints) != 0{
+		t.Errorf("want expired hints dropped have %v", hints)
+	}
+}
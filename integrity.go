@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// metaDirName is the folder below the root the metadata of every object
+// is kept in, at the same path as the object below the root.
+const metaDirName = ".meta"
+
+var ErrCorrupt = errors.New("content does not match its hash")
+
+// ObjectMeta is what the store records about an object when writing it,
+// kept next to it in the metadata folder.
+type ObjectMeta struct{
+	// Key is the key the object is stored under. Replicas are stored
+	// under the hash of their owner's key, OwnerKey holds the original
+	// encrypted with the owner's key so only the owner can read it, and
+	// OwnerHash the hash of the owner's copy, encrypted the same way.
+	Key string
+	OwnerKey []byte
+	OwnerHash []byte
+	// Size and Hash are the length and SHA-256 of the object's content.
+	Size int64
+	Hash []byte
+	Created time.Time
+	Modified time.Time
+	ContentType string
+	// Tags are arbitrary key/value pairs set by whoever wrote the object.
+	Tags map[string]string
+	// ChargedTo is the namespace the object counts against the quota of,
+	// when that is not the one it is stored in: a replica counts against
+	// the node that sent it.
+	ChargedTo string `json:",omitempty"`
+}
+
+// userMeta returns the part of the metadata the writer chose, as opposed
+// to what the store records on its own.
+func (m ObjectMeta) userMeta() ObjectMeta{
+	return ObjectMeta{
+		OwnerKey: m.OwnerKey,
+		OwnerHash: m.OwnerHash,
+		Created: m.Created,
+		Modified: m.Modified,
+		ContentType: m.ContentType,
+		Tags: m.Tags,
+	}
+}
+
+// metaName returns the name the metadata of the object by the name is
+// kept under.
+func metaName(name string) string{
+	return fmt.Sprintf("%s/%s", metaDirName, name)
+}
+
+// writeMetaFile writes meta to the file by the name, which only becomes
+// the metadata of an object once it is renamed to the metaName of it.
+func (s *Store) writeMetaFile(name string, meta ObjectMeta) error{
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeStorageFile(s.Storage, name, b)
+}
+
+func (s *Store) readMeta(name string) (ObjectMeta, error){
+	meta := ObjectMeta{}
+	b, err := readStorageFile(s.Storage, metaName(name))
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(b, &meta)
+}
+
+// Stat returns the metadata of the object stored under key. Objects
+// written before metadata was recorded only report their key, size and
+// modification time.
+func (s *Store) Stat(id, key string) (ObjectMeta, error){
+	name := s.objectName(id, key)
+	info, err := s.Storage.Stat(name)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+
+	meta, err := s.readMeta(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectMeta{Key: key, Size: info.Size, Modified: info.ModTime}, nil
+	}
+	return meta, err
+}
+
+// Hash returns the SHA-256 recorded for the object when it was written.
+// Objects written before hashes were recorded have none, reported as
+// fs.ErrNotExist.
+func (s *Store) Hash(id, key string) ([]byte, error){
+	meta, err := s.readMeta(s.objectName(id, key))
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Hash) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return meta.Hash, nil
+}
+
+// openVerified opens the object by the name for reading, failing the
+// read with ErrCorrupt at EOF unless the content matches its recorded
+// hash. The file and the hash are taken from the same write of it.
+func (s *Store) openVerified(name string) (int64, io.ReadCloser, error){
+	unlock := s.locks.acquire(name)
+	defer unlock()
+
+	size, file, err := s.Storage.Read(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	meta, err := s.readMeta(name)
+	if err != nil || len(meta.Hash) == 0 {
+		// nothing to verify against
+		return size, file, nil
+	}
+
+	return size, &verifiedFile{hashCheckReader: newHashCheckReader(file, meta.Hash), file: file}, nil
+}
+
+// verifiedFile is an open object whose content is checked against its
+// recorded hash while it is read.
+type verifiedFile struct{
+	*hashCheckReader
+	file io.Closer
+}
+
+func (v *verifiedFile) Close() error{
+	return v.file.Close()
+}
+
+// hashCheckReader fails at EOF if the content read does not match want,
+// so the store removes the file instead of keeping a bad copy.
+type hashCheckReader struct{
+	r io.Reader
+	h hash.Hash
+	want []byte
+}
+
+func newHashCheckReader(r io.Reader, want []byte) *hashCheckReader{
+	h := sha256.New()
+	return &hashCheckReader{
+		r: io.TeeReader(r, h),
+		h: h,
+		want: want,
+	}
+}
+
+func (h *hashCheckReader) Read(b []byte) (int, error){
+	n, err := h.r.Read(b)
+	if err == io.EOF && !bytes.Equal(h.h.Sum(nil), h.want){
+		return n, ErrCorrupt
+	}
+	return n, err
+}
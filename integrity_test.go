@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreVerifiesContent(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root: t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	id := generateId()
+	data := []byte("bytes worth keeping")
+
+	if _, err := s.Write(id, "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(data)
+	if hash, err := s.Hash(id, "key"); err != nil || !bytes.Equal(hash, want[:]) {
+		t.Fatalf("want hash %x have %x (%v)", want, hash, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s", s.Root, id, s.pathOf("key"))
+	if err := os.WriteFile(path, []byte("bytes worth keeping!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	r.(io.Closer).Close()
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("want %v have %v", ErrCorrupt, err)
+	}
+
+	if err := s.Delete(id, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Hash(id, "key"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want the hash removed along with the file have %v", err)
+	}
+}
+
+func TestStoreMetaFollowsContent(t *testing.T) {
+	memory := NewMemoryStorage()
+	s := NewStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Storage: memory})
+	id := generateId()
+	read := func() error {
+		_, r, err := s.Read(id, "key")
+		if err != nil {
+			return err
+		}
+		defer r.(io.Closer).Close()
+		_, err = io.ReadAll(r)
+		return err
+	}
+
+	// writers racing each other never leave one's hash on another's file
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				data := []byte(fmt.Sprintf("write %d of writer %d", j, i))
+				if _, err := s.Write(id, "key", bytes.NewReader(data)); err != nil {
+					t.Error(err)
+				}
+				if err := read(); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// and a write that could not be put in place keeps the old hash
+	s.Storage = failingStorage{memory}
+	if _, err := s.Write(id, "key", bytes.NewReader([]byte("never in place"))); err == nil {
+		t.Fatal("write succeeded")
+	}
+	s.Storage = memory
+	if err := read(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreStat(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root: t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	id := generateId()
+	ctx := context.Background()
+	data := []byte("some described bytes")
+
+	tags := map[string]string{"album": "holidays"}
+	if _, err := s.WriteWithMeta(ctx, id, "photo.jpg", bytes.NewReader(data), ObjectMeta{ContentType: "image/jpeg", Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s.Stat(id, "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	if meta.Key != "photo.jpg" || meta.Size != int64(len(data)) || !bytes.Equal(meta.Hash, hash[:]) {
+		t.Errorf("unexpected key, size or hash in %+v", meta)
+	}
+	if meta.ContentType != "image/jpeg" || !reflect.DeepEqual(meta.Tags, tags) {
+		t.Errorf("unexpected content type or tags in %+v", meta)
+	}
+	if meta.Created.IsZero() || !meta.Created.Equal(meta.Modified) {
+		t.Errorf("want equal creation and modification times have %s and %s", meta.Created, meta.Modified)
+	}
+
+	// replacing the file keeps when it was created
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s.Write(id, "photo.jpg", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := s.Stat(id, "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replaced.Created.Equal(meta.Created) || !replaced.Modified.After(meta.Modified) {
+		t.Errorf("want created %s and modified after %s have %+v", meta.Created, meta.Modified, replaced)
+	}
+	if replaced.ContentType != "" || replaced.Tags != nil {
+		t.Errorf("want the old content type and tags replaced have %+v", replaced)
+	}
+
+	// files written before metadata was recorded still report their size
+	if err := s.Storage.Delete(metaName(s.objectName(id, "photo.jpg"))); err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.Stat(id, "photo.jpg")
+	if err != nil || old.Key != "photo.jpg" || old.Size != int64(len(data)) || len(old.Hash) > 0 {
+		t.Errorf("unexpected %+v (%v)", old, err)
+	}
+
+	if _, err := s.Stat(id, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want %v have %v", fs.ErrNotExist, err)
+	}
+}
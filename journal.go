@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// the journal is compacted when it holds more than this many records on
+// top of twice the live ones
+const journalSlack = 1024
+
+// journalRecord is a record of a journal, setting the value stored under
+// the ID, or removing it when there is no value.
+type journalRecord[T any] struct{
+	ID string
+	Value *T `json:",omitempty"`
+}
+
+// journal is a map persisted like the key index: every change is
+// appended to a journal, which is replayed when it is loaded and
+// rewritten once it is mostly made up of stale records. The set keeping
+// the journal does the locking.
+type journal[T any] struct{
+	storage Storage
+	name string
+	items map[string]T
+	// records is the number of records in the journal, size its length
+	records int
+	size int64
+}
+
+// loadJournal replays the journal stored under the name. The returned
+// journal is usable even on error, it then holds what could be read.
+func loadJournal[T any](storage Storage, name string) (*journal[T], error){
+	j := &journal[T]{
+		storage: storage,
+		name: name,
+		items: make(map[string]T),
+	}
+
+	size, f, err := storage.Read(name)
+	if errors.Is(err, fs.ErrNotExist){
+		return j, nil
+	}
+	if err != nil{
+		return j, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for{
+		record := journalRecord[T]{}
+		err := dec.Decode(&record)
+		if err == io.EOF{
+			break
+		}
+		if err != nil{
+			// the record a crash cut off is dropped by compacting
+			return j, j.compact()
+		}
+		j.set(record)
+		j.records++
+	}
+	j.size = size
+
+	if j.stale(){
+		return j, j.compact()
+	}
+	return j, nil
+}
+
+func (j *journal[T]) set(record journalRecord[T]){
+	if record.Value == nil{
+		delete(j.items, record.ID)
+	} else {
+		j.items[record.ID] = *record.Value
+	}
+}
+
+func (j *journal[T]) stale() bool{
+	return j.records > 2 * len(j.items) + journalSlack
+}
+
+// Put stores the value under the ID.
+func (j *journal[T]) Put(id string, value T) error{
+	return j.apply([]journalRecord[T]{{ID: id, Value: &value}})
+}
+
+// Delete removes the IDs, with one write for all of them.
+func (j *journal[T]) Delete(ids ...string) error{
+	records := []journalRecord[T]{}
+	for _, id := range ids{
+		if _, ok := j.items[id]; ok{
+			records = append(records, journalRecord[T]{ID: id})
+		}
+	}
+	return j.apply(records)
+}
+
+func (j *journal[T]) apply(records []journalRecord[T]) error{
+	if len(records) == 0{
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, record := range records{
+		if err := enc.Encode(record); err != nil{
+			return err
+		}
+		j.set(record)
+	}
+
+	n, err := j.storage.Append(j.name, j.size, buf)
+	if err != nil{
+		return err
+	}
+
+	j.size += n
+	j.records += len(records)
+	if j.stale(){
+		return j.compact()
+	}
+	return nil
+}
+
+// compact rewrites the journal with a record for every live item only.
+func (j *journal[T]) compact() error{
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for id, value := range j.items{
+		if err := enc.Encode(journalRecord[T]{ID: id, Value: &value}); err != nil{
+			return err
+		}
+	}
+
+	if err := writeStorageFile(j.storage, j.name, buf.Bytes()); err != nil{
+		return err
+	}
+	j.records = len(j.items)
+	j.size = int64(buf.Len())
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJournal(t *testing.T){
+	dir := t.TempDir()
+	storage := NewDiskStorage(dir, false)
+	j, err := loadJournal[Hint](storage, "journal.log")
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	if err := j.Put("a", Hint{Key: "a", Size: 1}); err != nil{
+		t.Fatal(err)
+	}
+	if err := j.Put("b", Hint{Key: "b", Size: 2}); err != nil{
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(filepath.Join(dir, "journal.log"))
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	// changes are appended, what is there is left as it is
+	if err := j.Delete("a", "b", "missing"); err != nil{
+		t.Fatal(err)
+	}
+	if err := j.Put("c", Hint{Key: "c", Size: 3}); err != nil{
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(filepath.Join(dir, "journal.log"))
+	if err != nil{
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(after), string(before)){
+		t.Error("journal was rewritten")
+	}
+	if j.records != 5{
+		t.Errorf("want 5 records have %d", j.records)
+	}
+
+	// a record cut off by a crash is dropped
+	f, err := os.OpenFile(filepath.Join(dir, "journal.log"), os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil{
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ID":"d","Val`)
+	f.Close()
+
+	loaded, err := loadJournal[Hint](storage, "journal.log")
+	if err != nil{
+		t.Fatal(err)
+	}
+	if want := map[string]Hint{"c": {Key: "c", Size: 3}}; !reflect.DeepEqual(loaded.items, want){
+		t.Errorf("want %v have %v", want, loaded.items)
+	}
+	if err := loaded.Put("d", Hint{Key: "d"}); err != nil{
+		t.Fatal(err)
+	}
+	if loaded, _ := loadJournal[Hint](storage, "journal.log"); len(loaded.items) != 2{
+		t.Errorf("want c and d have %v", loaded.items)
+	}
+}
+
+func TestJournalCompacts(t *testing.T){
+	j, err := loadJournal[Hint](NewDiskStorage(t.TempDir(), false), "journal.log")
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	for i := 0; i < journalSlack; i++{
+		if err := j.Put("a", Hint{Key: "a"}); err != nil{
+			t.Fatal(err)
+		}
+		if err := j.Delete("a"); err != nil{
+			t.Fatal(err)
+		}
+	}
+	if err := j.Put("kept", Hint{Key: "kept"}); err != nil{
+		t.Fatal(err)
+	}
+	if j.records > journalSlack + 2{
+		t.Errorf("journal of %d records was not compacted", j.records)
+	}
+}
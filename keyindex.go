@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	keyIndexFileName = "keyindex.log"
+	defaultListLimit = 1000
+	// the journal is compacted when it holds more than this many records
+	// on top of twice the live keys
+	keyIndexSlack = 1024
+)
+
+// indexEntry is a record of the key index journal, adding a key to a
+// namespace or removing it from it.
+type indexEntry struct{
+	ID string
+	Key string
+	Deleted bool `json:",omitempty"`
+}
+
+// keyIndex holds the sorted keys of every namespace in the store. Every
+// change is appended to a journal, which is replayed when the store is
+// opened and rewritten once it is mostly made up of stale records.
+type keyIndex struct{
+	lock sync.Mutex
+	storage Storage
+	name string
+	keys map[string][]string
+	// records is the number of records in the journal, size its length
+	records int
+	size int64
+}
+
+// loadKeyIndex replays the journal stored under the name. Without a
+// journal the index is rebuilt from the entries rebuild returns. The
+// returned index is usable even on error, it then holds what could be
+// read.
+func loadKeyIndex(storage Storage, name string, rebuild func() ([]indexEntry, error)) (*keyIndex, error){
+	index := &keyIndex{
+		storage: storage,
+		name: name,
+		keys: make(map[string][]string),
+	}
+
+	size, f, err := storage.Read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		entries, err := rebuild()
+		for _, e := range entries {
+			index.set(e)
+		}
+		if err != nil {
+			return index, err
+		}
+		return index, index.compact()
+	}
+	if err != nil {
+		return index, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		e := indexEntry{}
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the record a crash cut off is dropped by compacting
+			return index, index.compact()
+		}
+		index.set(e)
+		index.records++
+	}
+	index.size = size
+
+	if index.records > 2 * index.live() + keyIndexSlack {
+		return index, index.compact()
+	}
+	return index, nil
+}
+
+// set applies the entry to the keys in memory, reporting whether it
+// changed them.
+func (i *keyIndex) set(e indexEntry) bool{
+	keys := i.keys[e.ID]
+	n, found := slices.BinarySearch(keys, e.Key)
+	switch{
+	case !e.Deleted && !found:
+		i.keys[e.ID] = slices.Insert(keys, n, e.Key)
+	case e.Deleted && found:
+		keys = slices.Delete(keys, n, n + 1)
+		if len(keys) == 0 {
+			delete(i.keys, e.ID)
+		} else {
+			i.keys[e.ID] = keys
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (i *keyIndex) live() int{
+	n := 0
+	for _, keys := range i.keys {
+		n += len(keys)
+	}
+	return n
+}
+
+// Add records that the key is stored in the namespace id.
+func (i *keyIndex) Add(id, key string) error{
+	return i.apply(indexEntry{ID: id, Key: key})
+}
+
+// Remove records that the key is gone from the namespace id.
+func (i *keyIndex) Remove(id, key string) error{
+	return i.apply(indexEntry{ID: id, Key: key, Deleted: true})
+}
+
+func (i *keyIndex) apply(e indexEntry) error{
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if !i.set(e) {
+		return nil
+	}
+	return i.append(e)
+}
+
+func (i *keyIndex) append(e indexEntry) error{
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	n, err := i.storage.Append(i.name, i.size, bytes.NewReader(append(b, '\n')))
+	if err != nil {
+		return err
+	}
+
+	i.size += n
+	i.records++
+	if i.records > 2 * i.live() + keyIndexSlack {
+		return i.compact()
+	}
+	return nil
+}
+
+// compact rewrites the journal with a record for every live key only.
+func (i *keyIndex) compact() error{
+	buf := new(strings.Builder)
+	enc := json.NewEncoder(buf)
+	records := 0
+	for id, keys := range i.keys {
+		for _, key := range keys {
+			if err := enc.Encode(indexEntry{ID: id, Key: key}); err != nil {
+				return err
+			}
+			records++
+		}
+	}
+
+	if err := writeStorageFile(i.storage, i.name, []byte(buf.String())); err != nil {
+		return err
+	}
+	i.records = records
+	i.size = int64(buf.Len())
+	return nil
+}
+
+// Reset forgets every key.
+func (i *keyIndex) Reset(){
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.keys = make(map[string][]string)
+	i.records = 0
+	i.size = 0
+}
+
+// after returns up to n keys of the namespace id that start with prefix
+// and sort after the key after, in order.
+func (i *keyIndex) after(id, prefix, after string, n int) []string{
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	keys := i.keys[id]
+	from := max(sort.SearchStrings(keys, prefix), sort.Search(len(keys), func(j int) bool {
+		return keys[j] > after
+	}))
+
+	found := []string{}
+	for _, key := range keys[from:] {
+		if len(found) == n || !strings.HasPrefix(key, prefix) {
+			break
+		}
+		found = append(found, key)
+	}
+	return found
+}
+
+// rebuildKeyIndex reads the keys of every object back from the metadata
+// recorded along with it. Objects written before metadata was recorded
+// are left out.
+func (s *Store) rebuildKeyIndex() ([]indexEntry, error){
+	entries := []indexEntry{}
+	err := s.Storage.List(metaDirName + "/", func(info StorageInfo) error {
+		if isTempFile(path.Base(info.Name)) {
+			return nil
+		}
+		id, _, ok := strings.Cut(strings.TrimPrefix(info.Name, metaDirName + "/"), "/")
+		if !ok {
+			return nil
+		}
+
+		b, err := readStorageFile(s.Storage, info.Name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		meta := ObjectMeta{}
+		if err := json.Unmarshal(b, &meta); err != nil || len(meta.Key) == 0 {
+			return nil
+		}
+
+		entries = append(entries, indexEntry{ID: id, Key: meta.Key})
+		return nil
+	})
+	return entries, err
+}
+
+// ListOptions select a page of the keys of a namespace.
+type ListOptions struct{
+	// Prefix only lists the keys that start with it.
+	Prefix string
+	// Token continues a listing where the page it was returned with
+	// ended. It stays valid while keys are added and removed.
+	Token string
+	// Limit caps the number of keys in a page, 1000 if it is zero.
+	Limit int
+}
+
+// ListPage is a page of keys in order. Token is empty on the last page.
+type ListPage struct{
+	Keys []string
+	Token string
+}
+
+var ErrInvalidToken = errors.New("invalid list token")
+
+// ListPage returns the keys of the namespace id opts selects. Only
+// objects written since metadata is recorded are listed.
+func (s *Store) ListPage(id string, opts ListOptions) (ListPage, error){
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	after := ""
+	if len(opts.Token) > 0 {
+		b, err := base64.RawURLEncoding.DecodeString(opts.Token)
+		if err != nil {
+			return ListPage{}, ErrInvalidToken
+		}
+		after = string(b)
+	}
+
+	page := ListPage{Keys: []string{}}
+	for len(page.Keys) < limit {
+		keys := s.index.after(id, opts.Prefix, after, limit - len(page.Keys))
+		if len(keys) == 0 {
+			return page, nil
+		}
+
+		// a crash can leave a key in the index its object never made it
+		// to disk under, or was already removed from
+		for _, key := range keys {
+			if s.Has(id, key) {
+				page.Keys = append(page.Keys, key)
+			}
+			after = key
+		}
+	}
+
+	if len(s.index.after(id, opts.Prefix, after, 1)) > 0 {
+		page.Token = base64.RawURLEncoding.EncodeToString([]byte(after))
+	}
+	return page, nil
+}
+
+// List returns every key of the namespace id that starts with prefix, in
+// order.
+func (s *Store) List(id, prefix string) ([]string, error){
+	keys := []string{}
+	it := s.Iterate(id, ListOptions{Prefix: prefix})
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys, it.Err()
+}
+
+// KeyIterator walks the keys of a namespace a page at a time.
+//
+//	it := store.Iterate(id, ListOptions{Prefix: "photos/"})
+//	for it.Next() {
+//		fmt.Println(it.Key())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type KeyIterator struct{
+	store *Store
+	id string
+	opts ListOptions
+	page []string
+	key string
+	last bool
+	err error
+}
+
+// Iterate returns an iterator over the keys of the namespace id that
+// opts selects, fetching opts.Limit keys at a time.
+func (s *Store) Iterate(id string, opts ListOptions) *KeyIterator{
+	return &KeyIterator{store: s, id: id, opts: opts}
+}
+
+// Next moves to the next key, reporting whether there is one.
+func (it *KeyIterator) Next() bool{
+	for len(it.page) == 0 {
+		if it.last || it.err != nil {
+			return false
+		}
+
+		page, err := it.store.ListPage(it.id, it.opts)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page = page.Keys
+		it.opts.Token = page.Token
+		it.last = len(page.Token) == 0
+	}
+
+	it.key, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+func (it *KeyIterator) Key() string{
+	return it.key
+}
+
+// Token returns a token that continues the listing after the current
+// key, for ListPage or Iterate.
+func (it *KeyIterator) Token() string{
+	return base64.RawURLEncoding.EncodeToString([]byte(it.key))
+}
+
+func (it *KeyIterator) Err() error{
+	return it.err
+}
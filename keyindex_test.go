@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoreList(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{
+		Root: root,
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	id := generateId()
+
+	keys := []string{"photos/b.jpg", "docs/a.txt", "photos/a.jpg", "photos/c.jpg", "photos/d.jpg"}
+	for _, key := range keys {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// other namespaces are listed separately
+	if _, err := s.Write(generateId(), "photos/e.jpg", bytes.NewReader([]byte("e"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(id, "photos/c.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	photos := []string{"photos/a.jpg", "photos/b.jpg", "photos/d.jpg"}
+	if have, err := s.List(id, "photos/"); err != nil || !reflect.DeepEqual(have, photos) {
+		t.Errorf("want %v have %v (%v)", photos, have, err)
+	}
+
+	page, err := s.ListPage(id, ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"docs/a.txt", "photos/a.jpg"}; !reflect.DeepEqual(page.Keys, want) || len(page.Token) == 0 {
+		t.Fatalf("want %v and a token have %+v", want, page)
+	}
+	// keys added before the token are not listed, the ones after are
+	if _, err := s.Write(id, "a.txt", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "photos/c.jpg", bytes.NewReader([]byte("c"))); err != nil {
+		t.Fatal(err)
+	}
+	page, err = s.ListPage(id, ListOptions{Token: page.Token, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"photos/b.jpg", "photos/c.jpg"}; !reflect.DeepEqual(page.Keys, want) || len(page.Token) == 0 {
+		t.Fatalf("want %v and a token have %+v", want, page)
+	}
+	page, err = s.ListPage(id, ListOptions{Token: page.Token, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"photos/d.jpg"}; !reflect.DeepEqual(page.Keys, want) || len(page.Token) > 0 {
+		t.Fatalf("want %v and no token have %+v", want, page)
+	}
+
+	if _, err := s.ListPage(id, ListOptions{Token: "not a token!"}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("want %v have %v", ErrInvalidToken, err)
+	}
+
+	// the iterator can be resumed from any key
+	it := s.Iterate(id, ListOptions{Prefix: "photos/", Limit: 1})
+	if !it.Next() || it.Key() != "photos/a.jpg" {
+		t.Fatalf("want photos/a.jpg have %s (%v)", it.Key(), it.Err())
+	}
+	rest := []string{}
+	for it = s.Iterate(id, ListOptions{Prefix: "photos/", Token: it.Token()}); it.Next(); {
+		rest = append(rest, it.Key())
+	}
+	if want := []string{"photos/b.jpg", "photos/c.jpg", "photos/d.jpg"}; it.Err() != nil || !reflect.DeepEqual(rest, want) {
+		t.Errorf("want %v have %v (%v)", want, rest, it.Err())
+	}
+
+	// the index is replayed when the store is opened again, and rebuilt
+	// from the metadata when it is lost
+	all, err := s.List(id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	if have, err := reopened.List(id, ""); err != nil || !reflect.DeepEqual(have, all) {
+		t.Errorf("want %v have %v (%v)", all, have, err)
+	}
+	if err := os.Remove(filepath.Join(root, keyIndexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	if have, err := rebuilt.List(id, ""); err != nil || !reflect.DeepEqual(have, all) {
+		t.Errorf("want %v have %v (%v)", all, have, err)
+	}
+}
+
+func TestKeyIndexCompacts(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewDiskStorage(dir, false)
+	index, err := loadKeyIndex(storage, keyIndexFileName, func() ([]indexEntry, error) { return nil, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < keyIndexSlack; i++ {
+		if err := index.Add("id", "key"); err != nil {
+			t.Fatal(err)
+		}
+		if err := index.Remove("id", "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Add("id", "kept"); err != nil {
+		t.Fatal(err)
+	}
+	if index.records > keyIndexSlack + 2 {
+		t.Errorf("journal of %d records was not compacted", index.records)
+	}
+
+	// a record cut off by a crash is dropped
+	f, err := os.OpenFile(filepath.Join(dir, keyIndexFileName), os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ID":"id","Ke`)
+	f.Close()
+
+	loaded, err := loadKeyIndex(storage, keyIndexFileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := loaded.after("id", "", "", 10); !reflect.DeepEqual(have, []string{"kept"}) {
+		t.Errorf("want [kept] have %v", have)
+	}
+	if err := loaded.Add("id", "more"); err != nil {
+		t.Fatal(err)
+	}
+	if have := loaded.after("id", "", "", 10); !reflect.DeepEqual(have, []string{"kept", "more"}) {
+		t.Errorf("want [kept more] have %v", have)
+	}
+}
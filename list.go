@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+// listPageSize is how many files a peer lists at a time, which keeps the
+// metadata of a page well below the largest message a peer accepts.
+const listPageSize = 256
+
+// MessageListFiles asks a peer for a page of the replicas it holds for
+// us. The peer answers with a MessageListFilesResponse carrying the same
+// RequestID.
+type MessageListFiles struct{
+	RequestID string
+	Token string
+	Limit int
+}
+
+// MessageListFilesResponse carries the metadata of a page of replicas,
+// and the token of the next page unless it is the last one. Err is set
+// when the peer could not list them.
+type MessageListFilesResponse struct{
+	RequestID string
+	Files []ObjectMeta
+	Token string
+	Err string
+}
+
+// ListedFile is a version of a file held somewhere on the network.
+type ListedFile struct{
+	Key string
+	// Hash is the SHA-256 of the file's content. It is empty for the
+	// replicas that were sent without it, which are then all counted
+	// as one version.
+	Hash []byte
+	Modified time.Time
+	// Nodes are the IDs of the nodes holding this version, ours first if
+	// we hold it. Replicas counts the peers among them.
+	Nodes []string
+	Replicas int
+}
+
+// List returns the files we stored whose keys start with prefix, merging
+// our own copies with the replicas our peers hold. Every version of a
+// file is listed once, with the nodes that hold it. Peers that do not
+// answer are left out. Erasure coded files are only listed while we
+// hold our own copy.
+func (s *FileServer) List(ctx context.Context, prefix string) ([]ListedFile, error){
+	versions := map[string]*ListedFile{}
+	add := func(node string, key string, hash []byte, modified time.Time){
+		id := key + "\x00" + string(hash)
+		file, ok := versions[id]
+		if !ok{
+			file = &ListedFile{Key: key, Hash: hash, Modified: modified}
+			versions[id] = file
+		}
+		file.Nodes = append(file.Nodes, node)
+		if node != s.ID{
+			file.Replicas++
+		}
+	}
+
+	it := s.store.Iterate(s.ID, ListOptions{Prefix: prefix})
+	for it.Next(){
+		meta, err := s.store.Stat(s.ID, it.Key())
+		if err != nil{
+			continue
+		}
+		add(s.ID, it.Key(), meta.Hash, meta.Modified)
+	}
+	if err := it.Err(); err != nil{
+		return nil, err
+	}
+
+	for _, peer := range s.peersSupporting(FeatureList){
+		err := s.listPeer(ctx, peer, func(meta ObjectMeta){
+			// replicas stored before the owner's key was passed on
+			// cannot be told apart
+			key, err := s.decryptMeta(meta.OwnerKey)
+			if err != nil || len(key) == 0 || !strings.HasPrefix(string(key), prefix){
+				return
+			}
+			hash, _ := s.decryptMeta(meta.OwnerHash)
+			add(peer.ID(), string(key), hash, meta.Modified)
+		})
+		if ctx.Err() != nil{
+			return nil, ctx.Err()
+		}
+		if err != nil{
+			log.Printf("[%s] could not list the files on (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+		}
+	}
+
+	files := make([]ListedFile, 0, len(versions))
+	for _, file := range versions{
+		files = append(files, *file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Key != files[j].Key{
+			return files[i].Key < files[j].Key
+		}
+		return bytes.Compare(files[i].Hash, files[j].Hash) < 0
+	})
+	return files, nil
+}
+
+// listPeer hands the metadata of every replica the peer holds for us to
+// fn, a page at a time.
+func (s *FileServer) listPeer(ctx context.Context, peer p2p.Peer, fn func(ObjectMeta)) error{
+	requestID := generateId()
+	respCh, done := s.registerRequest(requestID, 1)
+	defer done()
+
+	token := ""
+	for{
+		resp, err := s.request(ctx, peer, respCh, MessageListFiles{RequestID: requestID, Token: token, Limit: listPageSize})
+		if err != nil{
+			return err
+		}
+		page, ok := resp.(MessageListFilesResponse)
+		if !ok{
+			return fmt.Errorf("unexpected response %T to list files", resp)
+		}
+		if len(page.Err) > 0{
+			return fmt.Errorf("%s", page.Err)
+		}
+
+		for _, meta := range page.Files{
+			fn(meta)
+		}
+		if len(page.Token) == 0{
+			return nil
+		}
+		token = page.Token
+	}
+}
+
+// decryptMeta decrypts what replicaMeta encrypted. Nothing decrypts to
+// nothing.
+func (s *FileServer) decryptMeta(b []byte) ([]byte, error){
+	if len(b) == 0{
+		return nil, nil
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(s.EncKey, bytes.NewReader(b), out); err != nil{
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// handleMessageListFiles answers with a page of the replicas we hold for
+// the peer. A peer only gets to list its own files.
+func (s *FileServer) handleMessageListFiles(from string, msg MessageListFiles) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
+	}
+
+	resp := MessageListFilesResponse{
+		RequestID: msg.RequestID,
+	}
+
+	limit := msg.Limit
+	if limit <= 0 || limit > listPageSize{
+		limit = listPageSize
+	}
+
+	page, err := s.store.ListPage(peer.ID(), ListOptions{Token: msg.Token, Limit: limit})
+	if err != nil{
+		resp.Err = err.Error()
+		return s.send(peer, &Message{Payload: resp})
+	}
+
+	resp.Token = page.Token
+	for _, key := range page.Keys{
+		if !s.hasLiveFile(peer.ID(), key){
+			continue
+		}
+		meta, err := s.store.Stat(peer.ID(), key)
+		if err != nil{
+			continue
+		}
+		resp.Files = append(resp.Files, meta)
+	}
+
+	return s.send(peer, &Message{Payload: resp})
+}
+
+func (s *FileServer) handleMessageListFilesResponse(from string, msg MessageListFilesResponse) error{
+	s.deliverResponse(msg.RequestID, from, msg)
+	return nil
+}
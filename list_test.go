@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestFileServerList(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	s3 := newTestServer(t, s1, s2)
+	waitFor(t, func() bool { return len(s1.peerList()) == 2 && len(s2.peerList()) == 2 })
+
+	ctx := context.Background()
+	for _, key := range []string{"docs/a", "docs/b", "pictures/c"} {
+		if err := s1.StoreWithOptions(ctx, key, bytes.NewReader([]byte(key)), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a newer version of docs/b that only we hold
+	if _, err := s1.store.Write(s1.ID, "docs/b", bytes.NewReader([]byte("docs/b, edited"))); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := s1.List(ctx, "docs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return string(sum[:])
+	}
+	// the nodes holding every version
+	want := map[string][]string{
+		"docs/a" + hash("docs/a"): {s1.ID, s2.ID, s3.ID},
+		"docs/b" + hash("docs/b"): {s2.ID, s3.ID},
+		"docs/b" + hash("docs/b, edited"): {s1.ID},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("want %d files have %+v", len(want), files)
+	}
+	for i, file := range files {
+		if i > 0 && file.Key < files[i - 1].Key {
+			t.Errorf("%s is listed after %s", file.Key, files[i - 1].Key)
+		}
+
+		nodes, ok := want[file.Key + string(file.Hash)]
+		if !ok {
+			t.Errorf("unexpected version %x of %s", file.Hash, file.Key)
+			continue
+		}
+		if slices.Contains(nodes, s1.ID) && file.Nodes[0] != s1.ID {
+			t.Errorf("want our own copy of %s first have %v", file.Key, file.Nodes)
+		}
+		have := slices.Clone(file.Nodes)
+		slices.Sort(have)
+		slices.Sort(nodes)
+		if !reflect.DeepEqual(have, nodes) {
+			t.Errorf("want %s held by %v have %v", file.Key, nodes, have)
+		}
+
+		replicas := len(nodes)
+		if slices.Contains(nodes, s1.ID) {
+			replicas--
+		}
+		if file.Replicas != replicas {
+			t.Errorf("want %d replicas of %s have %d", replicas, file.Key, file.Replicas)
+		}
+	}
+
+	// peers only list the files they stored themselves
+	files, err = s2.List(ctx, "")
+	if err != nil || len(files) > 0 {
+		t.Errorf("want no files have %+v (%v)", files, err)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,16 +12,26 @@ import (
 	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
 )
 
-func makeServer(listenAddr string, nodes ...string) *FileServer {
+func makeServer(identity ed25519.PrivateKey, allowed []ed25519.PublicKey, listenAddr string, nodes ...string) *FileServer {
+	// peers know the node by the ID its identity maps to
+	id := p2p.NodeIDFromKey(identity.Public().(ed25519.PublicKey))
+
 	tcpTransportOpts := p2p.TCPTransportOpts{
 		ListenAddr: listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder: p2p.DefaultDecoder{},
+		HandshakeFunc: p2p.NewSecureHandshakeFunc(p2p.SecureHandshakeOpts{
+			Identity: identity,
+			AllowedKeys: allowed,
+		}),
+		Decoder: p2p.LengthPrefixedDecoder{},
+		Encoder: p2p.LengthPrefixedEncoder{},
+		Features: ServerFeatures,
+		NodeID: id,
 	}
 
 	tcpTransport := p2p.NewTCPTransport(tcpTransportOpts)
 
 	fileServerOpts := FileServerOpts{
+		ID: id,
 		EncKey: newEncryptionKey(),
 		StorageRoot: listenAddr + "_network",
 		PathTransformFunc: CASPathTransformFunc,
@@ -29,14 +41,27 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 
 	s :=  NewFileServer(fileServerOpts)
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
 
 	return s
 }
 
 func main(){
-	s1 := makeServer(":8888", "")
-	s2 := makeServer(":80", ":8888")
-	s3 := makeServer(":3000", ":8888", ":80")
+	// every node of the demo network accepts the other two
+	identities := make([]ed25519.PrivateKey, 3)
+	allowed := make([]ed25519.PublicKey, 3)
+	for i := range identities{
+		identity, err := p2p.GenerateIdentity()
+		if err != nil{
+			log.Fatal(err)
+		}
+		identities[i] = identity
+		allowed[i] = identity.Public().(ed25519.PublicKey)
+	}
+
+	s1 := makeServer(identities[0], allowed, ":8888", "")
+	s2 := makeServer(identities[1], allowed, ":80", ":8888")
+	s3 := makeServer(identities[2], allowed, ":3000", ":8888", ":80")
 	go func ()  {log.Fatal(s1.Start())}()
 	time.Sleep(time.Millisecond * 500)
 	go func ()  {log.Fatal(s2.Start())}()
@@ -50,9 +75,13 @@ func main(){
 	for i:=0;i<20;i++{
 		key := fmt.Sprintf("Picture_%d.jpg", i)
 		data := bytes.NewReader([]byte("a thick data file"))
-		s3.Store(key, data)	
-		
-		if err := s3.store.Delete(s3.ID,key); err != nil{
+		// wait for every replica so the file can be fetched back right away
+		if err := s3.StoreWithOptions(context.Background(), key, data, WriteOptions{Consistency: ConsistencyAll}); err != nil{
+			log.Fatal(err)
+		}
+
+		// drop only the local copy so the file is fetched back from the network
+		if err := s3.store.Delete(s3.ID, key); err != nil{
 			log.Fatal(err)
 		}
 
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"time"
+)
+
+// merkleBuckets is the number of leaf buckets below the root. Two trees
+// that differ are compared bucket by bucket, so only the leaves of the
+// buckets that differ have to be exchanged.
+const merkleBuckets = 256
+
+// MerkleLeaf describes one object in the store by its namespace, its path
+// below the namespace and the SHA-256 of its content.
+type MerkleLeaf struct{
+	ID string
+	Path string
+	Hash []byte
+	ModTime time.Time
+	// Meta is what the store recorded about the object, stored along
+	// with it when it is copied. It is not part of the tree's hashes.
+	Meta ObjectMeta
+}
+
+func (l MerkleLeaf) bucket() int{
+	hash := sha256.Sum256([]byte(l.ID + "/" + l.Path))
+	return int(hash[0])
+}
+
+// MerkleTree is a two level hash tree over a set of leaves: every bucket
+// hashes the leaves that fall into it, and the root hashes the buckets.
+type MerkleTree struct{
+	leaves [merkleBuckets][]MerkleLeaf
+	buckets [][]byte
+	root []byte
+}
+
+func NewMerkleTree(leaves []MerkleLeaf) *MerkleTree{
+	t := &MerkleTree{
+		buckets: make([][]byte, merkleBuckets),
+	}
+
+	for _, leaf := range leaves{
+		b := leaf.bucket()
+		t.leaves[b] = append(t.leaves[b], leaf)
+	}
+
+	root := sha256.New()
+	for b := range t.leaves{
+		leaves := t.leaves[b]
+		sort.Slice(leaves, func(i, j int) bool {
+			if leaves[i].ID != leaves[j].ID{
+				return leaves[i].ID < leaves[j].ID
+			}
+			return leaves[i].Path < leaves[j].Path
+		})
+
+		// the modification time is left out on purpose, copies with the
+		// same content are in sync no matter when they were written
+		bucket := sha256.New()
+		for _, leaf := range leaves{
+			bucket.Write([]byte(leaf.ID))
+			bucket.Write([]byte{0})
+			bucket.Write([]byte(leaf.Path))
+			bucket.Write([]byte{0})
+			bucket.Write(leaf.Hash)
+		}
+		t.buckets[b] = bucket.Sum(nil)
+		root.Write(t.buckets[b])
+	}
+	t.root = root.Sum(nil)
+
+	return t
+}
+
+func (t *MerkleTree) Root() []byte{
+	return t.root
+}
+
+func (t *MerkleTree) Buckets() [][]byte{
+	return t.buckets
+}
+
+// Leaves returns the leaves that fall into the bucket.
+func (t *MerkleTree) Leaves(bucket int) []MerkleLeaf{
+	if bucket < 0 || bucket >= merkleBuckets{
+		return nil
+	}
+	return t.leaves[bucket]
+}
+
+// Diff returns the buckets whose hashes differ from the other tree's.
+func (t *MerkleTree) Diff(buckets [][]byte) []int{
+	diff := []int{}
+	for b := range t.buckets{
+		if b >= len(buckets) || !bytes.Equal(t.buckets[b], buckets[b]){
+			diff = append(diff, b)
+		}
+	}
+	return diff
+}
+
+// leafSet keeps a leaf for every object in the store, with the hash
+// recorded in its metadata, so trees are built without reading the
+// objects. Version changes whenever the set does.
+type leafSet struct{
+	lock sync.Mutex
+	leaves map[string]MerkleLeaf
+	version uint64
+}
+
+func newLeafSet() *leafSet{
+	return &leafSet{leaves: make(map[string]MerkleLeaf)}
+}
+
+func (l *leafSet) Set(leaf MerkleLeaf){
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.leaves[leaf.ID + "/" + leaf.Path] = leaf
+	l.version++
+}
+
+func (l *leafSet) Remove(id, path string){
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.leaves, id + "/" + path)
+	l.version++
+}
+
+func (l *leafSet) Get(id, path string) (MerkleLeaf, bool){
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	leaf, ok := l.leaves[id + "/" + path]
+	return leaf, ok
+}
+
+func (l *leafSet) Reset(){
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.leaves = make(map[string]MerkleLeaf)
+	l.version++
+}
+
+func (l *leafSet) Version() uint64{
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.version
+}
+
+// List returns every leaf along with the version of the set they were
+// taken from.
+func (l *leafSet) List() ([]MerkleLeaf, uint64){
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	leaves := make([]MerkleLeaf, 0, len(l.leaves))
+	for _, leaf := range l.leaves{
+		leaves = append(leaves, leaf)
+	}
+	return leaves, l.version
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTreeDiff(t *testing.T){
+	leaves := []MerkleLeaf{}
+	for i := 0; i < 100; i++{
+		leaves = append(leaves, MerkleLeaf{ID: "owner", Path: fmt.Sprintf("path_%d", i), Hash: []byte{byte(i)}})
+	}
+
+	a := NewMerkleTree(leaves)
+	// the order leaves come in does not matter
+	reversed := make([]MerkleLeaf, len(leaves))
+	for i, leaf := range leaves{
+		reversed[len(leaves) - 1 - i] = leaf
+	}
+	if b := NewMerkleTree(reversed); !bytes.Equal(a.Root(), b.Root()){
+		t.Fatal("same leaves gave different roots")
+	}
+
+	changed := append([]MerkleLeaf{}, leaves...)
+	changed[42] = MerkleLeaf{ID: "owner", Path: "path_42", Hash: []byte("changed")}
+	b := NewMerkleTree(changed)
+	if bytes.Equal(a.Root(), b.Root()){
+		t.Fatal("different leaves gave the same root")
+	}
+
+	diff := a.Diff(b.Buckets())
+	if len(diff) != 1 || diff[0] != changed[42].bucket(){
+		t.Errorf("want only bucket %d to differ have %v", changed[42].bucket(), diff)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	packedOpWrite byte = iota + 1
+	packedOpAppend
+	packedOpRename
+	packedOpDelete
+)
+
+// packedHeaderSize is the length of the header in front of every record
+// of a pack: its checksum, op, append offset, modification time, and the
+// lengths of the name and data that follow it.
+const packedHeaderSize = 4 + 1 + 8 + 8 + 4 + 8
+
+// PackedStorage keeps every file in a single pack file, as a log of the
+// writes, appends, renames and deletes made to them. Each record is
+// checksummed, so a record a crash cut off is found and dropped when the
+// pack is opened again. Where the content of every file lies in the pack
+// is kept in memory.
+//
+// Writes and appends are buffered in memory before they are added to the
+// pack, and the space of replaced and deleted files is not reclaimed,
+// which makes it suited to small stores that are rarely rewritten.
+type PackedStorage struct{
+	lock sync.RWMutex
+	file *os.File
+	// durable syncs the pack after every record.
+	durable bool
+	size int64
+	files map[string]*packedFile
+}
+
+// packedFile is where the content of a file lies in the pack. A file
+// that was appended to lies in several extents.
+type packedFile struct{
+	extents []packedExtent
+	size int64
+	modTime time.Time
+}
+
+type packedExtent struct{
+	offset int64
+	length int64
+}
+
+// packedRecord is a record of the pack. Data is the content written or
+// appended, or the new name of a renamed file.
+type packedRecord struct{
+	op byte
+	at int64
+	modTime time.Time
+	name string
+	data []byte
+}
+
+// OpenPackedStorage opens the pack at path, creating it if there is none,
+// and reads back where every file lies in it.
+func OpenPackedStorage(path string, durable bool) (*PackedStorage, error){
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PackedStorage{
+		file: file,
+		durable: durable,
+		files: make(map[string]*packedFile),
+	}
+	if err := p.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// load replays the records of the pack, cutting it off at the first
+// record that is incomplete or does not match its checksum.
+func (p *PackedStorage) load() error{
+	fi, err := p.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	for offset < fi.Size() {
+		r := io.NewSectionReader(p.file, offset, fi.Size() - offset)
+		record, err := readPackedRecord(r, fi.Size() - offset)
+		if err != nil {
+			break
+		}
+		p.apply(record, offset + packedHeaderSize + int64(len(record.name)))
+		offset += packedHeaderSize + int64(len(record.name)) + int64(len(record.data))
+	}
+
+	if offset < fi.Size() {
+		if err := p.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	p.size = offset
+	return nil
+}
+
+// readPackedRecord reads the record at the start of r, which holds no
+// more than size bytes. The lengths in the header are not covered by the
+// checksum until the record was read, so a record they say is longer than
+// what is left is rejected before anything is allocated for it.
+func readPackedRecord(r io.Reader, size int64) (packedRecord, error){
+	header := make([]byte, packedHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return packedRecord{}, err
+	}
+
+	nameLen := binary.BigEndian.Uint32(header[21:25])
+	dataLen := binary.BigEndian.Uint64(header[25:33])
+	left := uint64(size - packedHeaderSize)
+	if size < packedHeaderSize || dataLen > left || uint64(nameLen) > left - dataLen {
+		return packedRecord{}, io.ErrUnexpectedEOF
+	}
+	rest := make([]byte, uint64(nameLen) + dataLen)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return packedRecord{}, err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(rest)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[:4]) {
+		return packedRecord{}, fmt.Errorf("record does not match its checksum")
+	}
+
+	return packedRecord{
+		op: header[4],
+		at: int64(binary.BigEndian.Uint64(header[5:13])),
+		modTime: time.Unix(0, int64(binary.BigEndian.Uint64(header[13:21]))),
+		name: string(rest[:nameLen]),
+		data: rest[nameLen:],
+	}, nil
+}
+
+func (r packedRecord) encode() []byte{
+	b := make([]byte, packedHeaderSize, packedHeaderSize + len(r.name) + len(r.data))
+	b[4] = r.op
+	binary.BigEndian.PutUint64(b[5:13], uint64(r.at))
+	binary.BigEndian.PutUint64(b[13:21], uint64(r.modTime.UnixNano()))
+	binary.BigEndian.PutUint32(b[21:25], uint32(len(r.name)))
+	binary.BigEndian.PutUint64(b[25:33], uint64(len(r.data)))
+	b = append(append(b, r.name...), r.data...)
+	binary.BigEndian.PutUint32(b[:4], crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+// apply changes the files as the record says, with the content the
+// record holds at offset in the pack.
+func (p *PackedStorage) apply(record packedRecord, offset int64){
+	extent := packedExtent{offset: offset, length: int64(len(record.data))}
+	switch record.op {
+	case packedOpWrite:
+		p.files[record.name] = &packedFile{extents: []packedExtent{extent}, size: extent.length, modTime: record.modTime}
+	case packedOpAppend:
+		file := &packedFile{}
+		if old, ok := p.files[record.name]; ok {
+			file.extents = old.truncated(record.at)
+		}
+		file.extents = append(file.extents, extent)
+		file.size = record.at + extent.length
+		file.modTime = record.modTime
+		p.files[record.name] = file
+	case packedOpRename:
+		if file, ok := p.files[record.name]; ok {
+			delete(p.files, record.name)
+			p.files[string(record.data)] = file
+		}
+	case packedOpDelete:
+		delete(p.files, record.name)
+	}
+}
+
+// truncated returns the extents of the first size bytes of the file.
+func (f *packedFile) truncated(size int64) []packedExtent{
+	extents := []packedExtent{}
+	for _, extent := range f.extents {
+		if size <= 0 {
+			break
+		}
+		extent.length = min(extent.length, size)
+		extents = append(extents, extent)
+		size -= extent.length
+	}
+	return extents
+}
+
+// add appends the record to the pack and applies it. It is called with
+// the lock held.
+func (p *PackedStorage) add(record packedRecord) error{
+	b := record.encode()
+	if _, err := p.file.WriteAt(b, p.size); err != nil {
+		// what made it into the pack is cut off again
+		p.file.Truncate(p.size)
+		return err
+	}
+	if p.durable {
+		if err := p.file.Sync(); err != nil {
+			p.file.Truncate(p.size)
+			return err
+		}
+	}
+
+	p.apply(record, p.size + packedHeaderSize + int64(len(record.name)))
+	p.size += int64(len(b))
+	return nil
+}
+
+func (p *PackedStorage) Has(name string) bool{
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	_, ok := p.files[name]
+	return ok
+}
+
+func (p *PackedStorage) Stat(name string) (StorageInfo, error){
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	file, ok := p.files[name]
+	if !ok {
+		return StorageInfo{}, fmt.Errorf("stat %s: %w", name, fs.ErrNotExist)
+	}
+	return StorageInfo{Name: name, Size: file.size, ModTime: file.modTime}, nil
+}
+
+func (p *PackedStorage) Read(name string) (int64, io.ReadCloser, error){
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	file, ok := p.files[name]
+	if !ok {
+		return 0, nil, fmt.Errorf("open %s: %w", name, fs.ErrNotExist)
+	}
+
+	readers := make([]io.Reader, len(file.extents))
+	for i, extent := range file.extents {
+		readers[i] = io.NewSectionReader(p.file, extent.offset, extent.length)
+	}
+	return file.size, io.NopCloser(io.MultiReader(readers...)), nil
+}
+
+func (p *PackedStorage) Write(name string, r io.Reader) (int64, error){
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return int64(len(data)), p.add(packedRecord{op: packedOpWrite, modTime: time.Now(), name: name, data: data})
+}
+
+func (p *PackedStorage) Append(name string, offset int64, r io.Reader) (int64, error){
+	if size := p.fileSize(name); size < offset {
+		return 0, errShortFile(offset, size)
+	}
+
+	data, err := io.ReadAll(r)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	size := int64(0)
+	if file, ok := p.files[name]; ok {
+		size = file.size
+	}
+	if size < offset {
+		return 0, errShortFile(offset, size)
+	}
+	if addErr := p.add(packedRecord{op: packedOpAppend, at: offset, modTime: time.Now(), name: name, data: data}); addErr != nil {
+		return 0, addErr
+	}
+	return int64(len(data)), err
+}
+
+func (p *PackedStorage) fileSize(name string) int64{
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if file, ok := p.files[name]; ok {
+		return file.size
+	}
+	return 0
+}
+
+func (p *PackedStorage) Rename(from, to string) error{
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.files[from]; !ok {
+		return fmt.Errorf("rename %s: %w", from, fs.ErrNotExist)
+	}
+	return p.add(packedRecord{op: packedOpRename, modTime: time.Now(), name: from, data: []byte(to)})
+}
+
+func (p *PackedStorage) Delete(name string) error{
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.files[name]; !ok {
+		return nil
+	}
+	return p.add(packedRecord{op: packedOpDelete, modTime: time.Now(), name: name})
+}
+
+// List calls fn without holding on to the storage, fn may change it.
+func (p *PackedStorage) List(prefix string, fn func(StorageInfo) error) error{
+	p.lock.RLock()
+	infos := []StorageInfo{}
+	for name, file := range p.files {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, StorageInfo{Name: name, Size: file.size, ModTime: file.modTime})
+		}
+	}
+	p.lock.RUnlock()
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear empties the pack.
+func (p *PackedStorage) Clear() error{
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.file.Truncate(0); err != nil {
+		return err
+	}
+	p.size = 0
+	p.files = make(map[string]*packedFile)
+	return nil
+}
+
+// Close closes the pack, the storage cannot be used afterwards.
+func (p *PackedStorage) Close() error{
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.file.Close()
+}
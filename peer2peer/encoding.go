@@ -1,7 +1,10 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -15,6 +18,9 @@ func (dec GOBDecoder) Decode(r io.Reader, msg *RPC)error{
 	return gob.NewDecoder(r).Decode(msg)
 }
 
+// DefaultDecoder reads a type byte followed by a single read of up to
+// 1028 bytes. It only understands messages, so it cannot be used with
+// streams; prefer LengthPrefixedDecoder.
 type DefaultDecoder struct{}
 
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC)error{
@@ -24,14 +30,10 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC)error{
 		return err
 	}
 
-	// In case of a stream, we are not decoding what is being sent 
-	// over a network. We are just  setting stream true so we can
-	// handle that in our logic
-	stream := peerBuf[0] == IncomingStream
-	if stream{
-		msg.Stream = true
-		return nil
+	if peerBuf[0] != IncomingMessage{
+		return fmt.Errorf("DefaultDecoder cannot decode frame type (%d)", peerBuf[0])
 	}
+	msg.Type = IncomingMessage
 
 	buf := make([]byte, 1028)
 	n, err := r.Read(buf)
@@ -42,4 +44,96 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC)error{
 
 	msg.Payload = buf[:n]
 	return nil
-}
\ No newline at end of file
+}
+
+// DefaultMaxPayloadSize is the largest frame payload the length-prefixed
+// encoder and decoder accept when no maximum is configured.
+const DefaultMaxPayloadSize = 4 << 20
+
+// frameHeaderSize is the size of a frame header: one type byte followed
+// by the payload length as a big endian uint32.
+const frameHeaderSize = 5
+
+// ErrFrameTooLarge is returned for frames whose payload exceeds the
+// configured maximum.
+var ErrFrameTooLarge = errors.New("frame payload exceeds maximum size")
+
+type Encoder interface{
+	Encode(w io.Writer, msgType byte, payload []byte) error
+}
+
+// DefaultEncoder writes the type byte followed by the raw payload, which
+// is what DefaultDecoder expects on the other end. Like DefaultDecoder it
+// only supports messages.
+type DefaultEncoder struct{}
+
+func (enc DefaultEncoder) Encode(w io.Writer, msgType byte, payload []byte) error{
+	if msgType != IncomingMessage{
+		return fmt.Errorf("DefaultEncoder cannot encode frame type (%d)", msgType)
+	}
+
+	buf := make([]byte, 0, len(payload) + 1)
+	buf = append(buf, msgType)
+	buf = append(buf, payload...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// LengthPrefixedEncoder frames every message with its type and the
+// length of its payload, so the receiving LengthPrefixedDecoder can read
+// it back whole regardless of how it was split on the wire.
+type LengthPrefixedEncoder struct{
+	// MaxPayloadSize defaults to DefaultMaxPayloadSize.
+	MaxPayloadSize uint32
+}
+
+func (enc LengthPrefixedEncoder) Encode(w io.Writer, msgType byte, payload []byte) error{
+	if uint64(len(payload)) > uint64(maxPayloadSize(enc.MaxPayloadSize)){
+		return fmt.Errorf("encoding %d byte payload: %w", len(payload), ErrFrameTooLarge)
+	}
+
+	// header and payload go out in a single write so frames written by
+	// concurrent senders are never interleaved.
+	buf := make([]byte, frameHeaderSize, frameHeaderSize + len(payload))
+	buf[0] = msgType
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+type LengthPrefixedDecoder struct{
+	// MaxPayloadSize defaults to DefaultMaxPayloadSize. Larger frames are
+	// rejected before their payload is read.
+	MaxPayloadSize uint32
+}
+
+func (dec LengthPrefixedDecoder) Decode(r io.Reader, msg *RPC) error{
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil{
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxPayloadSize(dec.MaxPayloadSize){
+		return fmt.Errorf("decoding %d byte payload: %w", size, ErrFrameTooLarge)
+	}
+
+	if header[0] < IncomingMessage || header[0] > StreamWindowUpdate{
+		return fmt.Errorf("unknown frame type (%d)", header[0])
+	}
+	msg.Type = header[0]
+
+	msg.Payload = make([]byte, size)
+	_, err := io.ReadFull(r, msg.Payload)
+	return err
+}
+
+func maxPayloadSize(size uint32) uint32{
+	if size == 0{
+		return DefaultMaxPayloadSize
+	}
+	return size
+}
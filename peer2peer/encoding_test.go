@@ -0,0 +1,45 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLengthPrefixedEncoding(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := LengthPrefixedEncoder{}
+	payload := bytes.Repeat([]byte("tuner"), 1000)
+
+	assert.Nil(t, enc.Encode(buf, IncomingMessage, payload))
+	assert.Nil(t, enc.Encode(buf, StreamClose, []byte{0, 0, 0, 1}))
+
+	// reading one byte at a time mimics a message split across segments
+	r := iotest.OneByteReader(buf)
+	dec := LengthPrefixedDecoder{}
+
+	msg := RPC{}
+	assert.Nil(t, dec.Decode(r, &msg))
+	assert.Equal(t, byte(IncomingMessage), msg.Type)
+	assert.Equal(t, payload, msg.Payload)
+
+	msg = RPC{}
+	assert.Nil(t, dec.Decode(r, &msg))
+	assert.Equal(t, byte(StreamClose), msg.Type)
+	assert.Equal(t, []byte{0, 0, 0, 1}, msg.Payload)
+}
+
+func TestLengthPrefixedDecoderRejectsOversizedFrames(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, LengthPrefixedEncoder{}.Encode(buf, IncomingMessage, make([]byte, 64)))
+
+	dec := LengthPrefixedDecoder{MaxPayloadSize: 32}
+	err := dec.Decode(buf, &RPC{})
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+
+	err = LengthPrefixedEncoder{MaxPayloadSize: 32}.Encode(new(bytes.Buffer), IncomingMessage, make([]byte, 64))
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+}
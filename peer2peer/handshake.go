@@ -1,6 +1,220 @@
 package p2p
 
-// HandshakeFunc
-type HandshakeFunc func(any)error
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
 
-func NOPHandshakeFunc(any) error {return nil}
\ No newline at end of file
+// HandshakeFunc is run on every new connection before the peer is handed
+// to OnPeer. It may replace the peer's connection, e.g. to encrypt it.
+type HandshakeFunc func(*TCPPeer) error
+
+func NOPHandshakeFunc(*TCPPeer) error {return nil}
+
+const (
+	handshakeMagic = "TSH1"
+	handshakeTimeout = 10 * time.Second
+	helloSize = len(handshakeMagic) + ed25519.PublicKeySize + 32
+)
+
+var ErrPeerNotAllowed = errors.New("peer identity is not in the allow-list")
+
+// GenerateIdentity creates a new long-term ed25519 key a node is known by.
+func GenerateIdentity() (ed25519.PrivateKey, error){
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	return priv, err
+}
+
+// LoadOrCreateIdentity reads the hex encoded key seed stored at path,
+// generating and storing a new one if the file does not exist yet.
+func LoadOrCreateIdentity(path string) (ed25519.PrivateKey, error){
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist){
+		priv, err := GenerateIdentity()
+		if err != nil{
+			return nil, err
+		}
+		return priv, os.WriteFile(path, []byte(hex.EncodeToString(priv.Seed())), 0600)
+	}
+	if err != nil{
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize{
+		return nil, fmt.Errorf("identity file (%s) does not hold a valid key seed", path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// NodeIDFromKey returns the node ID a node with the identity key is
+// known by. Peers that authenticate with the key cannot announce any
+// other.
+func NodeIDFromKey(key ed25519.PublicKey) string{
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+type SecureHandshakeOpts struct{
+	// Identity is the key this node proves it owns during the handshake.
+	Identity ed25519.PrivateKey
+	// AllowedKeys lists the identities we accept connections from.
+	// An empty list rejects every peer.
+	AllowedKeys []ed25519.PublicKey
+}
+
+// NewSecureHandshakeFunc returns a handshake in which both sides prove
+// ownership of their identity key by signing the exchanged ephemeral
+// X25519 keys, check each other against the allow-list, and switch the
+// connection over to AES-GCM with keys derived from the X25519 secret.
+func NewSecureHandshakeFunc(opts SecureHandshakeOpts) HandshakeFunc{
+	return func(peer *TCPPeer) error{
+		if err := peer.Conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil{
+			return err
+		}
+
+		if err := secureHandshake(peer, opts); err != nil{
+			return fmt.Errorf("secure handshake with (%s): %w", peer.RemoteAddr(), err)
+		}
+
+		return peer.Conn.SetDeadline(time.Time{})
+	}
+}
+
+func secureHandshake(peer *TCPPeer, opts SecureHandshakeOpts) error{
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil{
+		return err
+	}
+
+	hello := make([]byte, 0, helloSize)
+	hello = append(hello, handshakeMagic...)
+	hello = append(hello, opts.Identity.Public().(ed25519.PublicKey)...)
+	hello = append(hello, ephemeral.PublicKey().Bytes()...)
+
+	remoteHello, err := exchange(peer.Conn, hello, helloSize)
+	if err != nil{
+		return err
+	}
+
+	if string(remoteHello[:len(handshakeMagic)]) != handshakeMagic{
+		return errors.New("peer does not speak the handshake protocol")
+	}
+
+	remoteKey := ed25519.PublicKey(remoteHello[len(handshakeMagic):len(handshakeMagic) + ed25519.PublicKeySize])
+	if !allowed(opts.AllowedKeys, remoteKey){
+		return fmt.Errorf("%w: %s", ErrPeerNotAllowed, hex.EncodeToString(remoteKey))
+	}
+
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(remoteHello[len(handshakeMagic) + ed25519.PublicKeySize:])
+	if err != nil{
+		return err
+	}
+
+	// the transcript binds both hellos in a fixed order, so each side
+	// signs over exactly what the other one saw
+	initiatorHello, responderHello := hello, remoteHello
+	role, remoteRole := byte('i'), byte('r')
+	if !peer.outbound{
+		initiatorHello, responderHello = remoteHello, hello
+		role, remoteRole = remoteRole, role
+	}
+	transcript := sha256.New()
+	transcript.Write(initiatorHello)
+	transcript.Write(responderHello)
+	transcriptHash := transcript.Sum(nil)
+
+	signature := ed25519.Sign(opts.Identity, append([]byte{role}, transcriptHash...))
+	remoteSignature, err := exchange(peer.Conn, signature, ed25519.SignatureSize)
+	if err != nil{
+		return err
+	}
+
+	if !ed25519.Verify(remoteKey, append([]byte{remoteRole}, transcriptHash...), remoteSignature){
+		return errors.New("peer failed to prove ownership of its identity")
+	}
+
+	secret, err := ephemeral.ECDH(remoteEphemeral)
+	if err != nil{
+		return err
+	}
+
+	initiatorAEAD, err := newSessionAEAD(secret, transcriptHash, "initiator")
+	if err != nil{
+		return err
+	}
+	responderAEAD, err := newSessionAEAD(secret, transcriptHash, "responder")
+	if err != nil{
+		return err
+	}
+
+	send, recv := initiatorAEAD, responderAEAD
+	if !peer.outbound{
+		send, recv = recv, send
+	}
+
+	peer.Conn = newSecureConn(peer.Conn, send, recv)
+	peer.remoteKey = remoteKey
+
+	return nil
+}
+
+// exchange writes ours while reading theirs, so it cannot deadlock on
+// connections that do not buffer writes.
+func exchange(rw io.ReadWriter, ours []byte, theirsSize int) ([]byte, error){
+	errCh := make(chan error, 1)
+	go func ()  {
+		_, err := rw.Write(ours)
+		errCh <- err
+	}()
+
+	theirs := make([]byte, theirsSize)
+	if _, err := io.ReadFull(rw, theirs); err != nil{
+		return nil, err
+	}
+
+	return theirs, <-errCh
+}
+
+func allowed(keys []ed25519.PublicKey, key ed25519.PublicKey) bool{
+	for _, k := range keys{
+		if bytes.Equal(k, key){
+			return true
+		}
+	}
+	return false
+}
+
+// newSessionAEAD derives a 256 bit key for one direction of the
+// connection with HKDF-SHA256 and wraps it in AES-GCM.
+func newSessionAEAD(secret, salt []byte, info string) (cipher.AEAD, error){
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	key := expand.Sum(nil)
+
+	block, err := aes.NewCipher(key)
+	if err != nil{
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// handshakePeers runs the handshakes of both ends of a loopback TCP
+// connection and returns the peers along with each side's error.
+func handshakePeers(t *testing.T, dialer, listener HandshakeFunc) (*TCPPeer, *TCPPeer, error, error){
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	acceptCh := make(chan net.Conn)
+	go func ()  {
+		conn, _ := ln.Accept()
+		acceptCh <- conn
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+
+	local, remote := NewTCPPeer(conn, true), NewTCPPeer(<-acceptCh, false)
+	t.Cleanup(func ()  {
+		local.Close()
+		remote.Close()
+	})
+
+	errCh := make(chan error)
+	go func ()  {
+		err := listener(remote)
+		if err != nil{
+			remote.Close()
+		}
+		errCh <- err
+	}()
+
+	localErr := dialer(local)
+	if localErr != nil{
+		local.Close()
+	}
+
+	return local, remote, localErr, <-errCh
+}
+
+func TestSecureHandshake(t *testing.T) {
+	a, _ := GenerateIdentity()
+	b, _ := GenerateIdentity()
+	allowed := []ed25519.PublicKey{a.Public().(ed25519.PublicKey), b.Public().(ed25519.PublicKey)}
+
+	local, remote, localErr, remoteErr := handshakePeers(t,
+		NewSecureHandshakeFunc(SecureHandshakeOpts{Identity: a, AllowedKeys: allowed}),
+		NewSecureHandshakeFunc(SecureHandshakeOpts{Identity: b, AllowedKeys: allowed}),
+	)
+	assert.Nil(t, localErr)
+	assert.Nil(t, remoteErr)
+
+	assert.Equal(t, b.Public(), local.RemoteKey())
+	assert.Equal(t, a.Public(), remote.RemoteKey())
+
+	payload := make([]byte, 3 * maxRecordSize + 5)
+	for i := range payload{
+		payload[i] = byte(i)
+	}
+
+	go local.Write(payload)
+
+	b2 := make([]byte, len(payload))
+	_, err := io.ReadFull(remote, b2)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, b2)
+}
+
+func TestSecureHandshakeRejectsUnknownPeers(t *testing.T) {
+	a, _ := GenerateIdentity()
+	b, _ := GenerateIdentity()
+
+	_, _, localErr, remoteErr := handshakePeers(t,
+		NewSecureHandshakeFunc(SecureHandshakeOpts{Identity: a, AllowedKeys: []ed25519.PublicKey{b.Public().(ed25519.PublicKey)}}),
+		NewSecureHandshakeFunc(SecureHandshakeOpts{Identity: b}),
+	)
+
+	assert.True(t, errors.Is(remoteErr, ErrPeerNotAllowed))
+	assert.NotNil(t, localErr)
+}
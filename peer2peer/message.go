@@ -2,12 +2,19 @@ package p2p
 
 const (
 	IncomingMessage = 0x1
-	IncomingStream = 0x2
+
+	// Stream frames carry the ID of their stream as a big endian uint32
+	// at the start of their payload.
+	StreamOpen = 0x2
+	StreamData = 0x3
+	StreamClose = 0x4
+	StreamReset = 0x5
+	StreamWindowUpdate = 0x6
 )
 // Message represents any artbitrary data that is being sent over each
 // transport between two nodes in the network
 type RPC struct{
 	From string
+	Type byte
 	Payload []byte
-	Stream bool
 }
\ No newline at end of file
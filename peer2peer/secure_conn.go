@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxRecordSize is the largest plaintext sealed into a single record.
+const maxRecordSize = 16 << 10
+
+// secureConn encrypts everything written to the connection in length
+// prefixed AES-GCM records. Each direction has its own key, and the
+// nonce is a counter of the records sent in that direction, so records
+// that are replayed, reordered or dropped fail to open.
+type secureConn struct{
+	net.Conn
+
+	writeLock sync.Mutex
+	send cipher.AEAD
+	sendCount uint64
+
+	recv cipher.AEAD
+	recvCount uint64
+	readBuf []byte
+}
+
+func newSecureConn(conn net.Conn, send, recv cipher.AEAD) *secureConn{
+	return &secureConn{
+		Conn: conn,
+		send: send,
+		recv: recv,
+	}
+}
+
+func (c *secureConn) Write(b []byte) (int, error){
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	written := 0
+	for len(b) > 0{
+		n := min(len(b), maxRecordSize)
+
+		record := make([]byte, 4, 4 + n + c.send.Overhead())
+		record = c.send.Seal(record, c.nonce(c.sendCount), b[:n], nil)
+		binary.BigEndian.PutUint32(record, uint32(len(record) - 4))
+		c.sendCount++
+
+		if _, err := c.Conn.Write(record); err != nil{
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func (c *secureConn) Read(b []byte) (int, error){
+	if len(c.readBuf) == 0{
+		if err := c.readRecord(); err != nil{
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	return n, nil
+}
+
+func (c *secureConn) readRecord() error{
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, header); err != nil{
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > uint32(maxRecordSize + c.recv.Overhead()){
+		return fmt.Errorf("encrypted record of %d bytes is too large", size)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, record); err != nil{
+		return err
+	}
+
+	plain, err := c.recv.Open(record[:0], c.nonce(c.recvCount), record, nil)
+	if err != nil{
+		return fmt.Errorf("encrypted record failed to open: %w", err)
+	}
+	c.recvCount++
+	c.readBuf = plain
+
+	return nil
+}
+
+func (c *secureConn) nonce(count uint64) []byte{
+	nonce := make([]byte, c.send.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce) - 8:], count)
+	return nonce
+}
@@ -0,0 +1,246 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultStreamWindow is how many bytes a sender may have in flight on
+	// a single stream before the receiver grants it more.
+	defaultStreamWindow = 256 << 10
+
+	// maxStreamFrameData is the largest chunk of stream data sent in a
+	// single frame, so streams sharing a connection take turns.
+	maxStreamFrameData = 32 << 10
+)
+
+var (
+	ErrStreamReset = errors.New("stream reset")
+	ErrStreamClosed = errors.New("stream closed for writing")
+)
+
+// Stream is one of many independent byte streams multiplexed over a
+// single peer connection. Each side may write until it calls Close, and
+// reads return io.EOF once the remote side has closed and every byte
+// it sent has been read.
+type Stream struct{
+	id uint32
+	peer *TCPPeer
+
+	lock sync.Mutex
+	cond *sync.Cond
+	buf bytes.Buffer
+	// sendWindow is how many more bytes we may send before the remote
+	// grants us more, consumed how many bytes we read since we last
+	// granted the remote more.
+	sendWindow uint32
+	consumed uint32
+
+	localClosed bool
+	remoteClosed bool
+	reset bool
+	// remoteReset is set when the reset came from the remote side
+	remoteReset bool
+
+	// acceptTimer resets a stream the peer opened unless it is accepted
+	// first, guarded by the peer's stream lock like accepted
+	acceptTimer *time.Timer
+	accepted bool
+}
+
+func newStream(id uint32, peer *TCPPeer) *Stream{
+	s := &Stream{
+		id: id,
+		peer: peer,
+		sendWindow: defaultStreamWindow,
+	}
+	s.cond = sync.NewCond(&s.lock)
+
+	return s
+}
+
+func (s *Stream) ID() uint32{
+	return s.id
+}
+
+func (s *Stream) Read(b []byte) (int, error){
+	s.lock.Lock()
+	for s.buf.Len() == 0 && !s.remoteClosed && !s.reset{
+		s.cond.Wait()
+	}
+
+	if s.reset{
+		s.lock.Unlock()
+		return 0, ErrStreamReset
+	}
+
+	if s.buf.Len() == 0{
+		s.lock.Unlock()
+		return 0, io.EOF
+	}
+
+	n, _ := s.buf.Read(b)
+	s.consumed += uint32(n)
+
+	// grant the window back in batches instead of after every read
+	var delta uint32
+	if s.consumed >= defaultStreamWindow / 2{
+		delta = s.consumed
+		s.consumed = 0
+	}
+	s.lock.Unlock()
+
+	if delta > 0{
+		if err := s.peer.writeStreamFrame(StreamWindowUpdate, s.id, binary.BigEndian.AppendUint32(nil, delta)); err != nil{
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (s *Stream) Write(b []byte) (int, error){
+	written := 0
+
+	for len(b) > 0{
+		s.lock.Lock()
+		for s.sendWindow == 0 && !s.reset && !s.localClosed{
+			s.cond.Wait()
+		}
+
+		if s.reset{
+			s.lock.Unlock()
+			return written, ErrStreamReset
+		}
+
+		if s.localClosed{
+			s.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := min(len(b), int(s.sendWindow), maxStreamFrameData)
+		s.sendWindow -= uint32(n)
+		s.lock.Unlock()
+
+		if err := s.peer.writeStreamFrame(StreamData, s.id, b[:n]); err != nil{
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// Close tells the remote side we are done writing. The stream can still
+// be read until the remote closes it as well.
+func (s *Stream) Close() error{
+	s.lock.Lock()
+	if s.localClosed || s.reset{
+		s.lock.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	done := s.remoteClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if done{
+		s.peer.removeStream(s.id)
+	}
+
+	return s.peer.writeStreamFrame(StreamClose, s.id, nil)
+}
+
+// Reset aborts the stream in both directions, failing pending reads and
+// writes on both sides.
+func (s *Stream) Reset() error{
+	if !s.abort(){
+		return nil
+	}
+
+	return s.peer.writeStreamFrame(StreamReset, s.id, nil)
+}
+
+// ResetByPeer reports whether the peer reset the stream, as opposed to us
+// or the connection breaking. A peer resets a stream when it gives up on
+// it.
+func (s *Stream) ResetByPeer() bool{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.remoteReset
+}
+
+// receiveReset aborts the stream at the remote's request.
+func (s *Stream) receiveReset(){
+	s.lock.Lock()
+	s.remoteReset = !s.reset
+	s.lock.Unlock()
+
+	s.abort()
+}
+
+// abort marks the stream as reset and wakes everyone waiting on it,
+// reporting whether it was still open.
+func (s *Stream) abort() bool{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.reset{
+		return false
+	}
+	s.reset = true
+	s.cond.Broadcast()
+	s.peer.removeStream(s.id)
+
+	return true
+}
+
+func (s *Stream) receiveData(b []byte) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.reset{
+		return nil
+	}
+
+	if s.remoteClosed{
+		return fmt.Errorf("stream (%d) received data after being closed", s.id)
+	}
+
+	if s.buf.Len() + len(b) > defaultStreamWindow{
+		return fmt.Errorf("stream (%d) received more data than its window allows", s.id)
+	}
+
+	s.buf.Write(b)
+	s.cond.Broadcast()
+
+	return nil
+}
+
+func (s *Stream) receiveClose(){
+	s.lock.Lock()
+	s.remoteClosed = true
+	done := s.localClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if done{
+		s.peer.removeStream(s.id)
+	}
+}
+
+func (s *Stream) receiveWindowUpdate(delta uint32){
+	s.lock.Lock()
+	s.sendWindow += delta
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
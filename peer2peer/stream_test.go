@@ -0,0 +1,139 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pipePeers connects two peers over an in-memory connection and runs a
+// read loop for each that only handles stream frames.
+func pipePeers() (*TCPPeer, *TCPPeer){
+	a, b := net.Pipe()
+	local, remote := NewTCPPeer(a, true), NewTCPPeer(b, false)
+
+	for _, peer := range []*TCPPeer{local, remote}{
+		go func (peer *TCPPeer)  {
+			defer peer.resetStreams()
+			for {
+				rpc := RPC{}
+				if err := (LengthPrefixedDecoder{}).Decode(peer.Conn, &rpc); err != nil{
+					return
+				}
+				if err := peer.handleStreamFrame(rpc.Type, rpc.Payload); err != nil{
+					return
+				}
+			}
+		}(peer)
+	}
+
+	return local, remote
+}
+
+func TestStreamsInterleave(t *testing.T) {
+	local, remote := pipePeers()
+	defer local.Close()
+
+	// each payload is larger than the stream window, so the writers
+	// depend on the readers granting them more
+	payloads := [][]byte{
+		bytes.Repeat([]byte("a"), 3 * defaultStreamWindow),
+		bytes.Repeat([]byte("b"), 2 * defaultStreamWindow + 7),
+	}
+
+	var wg sync.WaitGroup
+	for _, payload := range payloads{
+		stream, err := local.OpenStream()
+		assert.Nil(t, err)
+
+		wg.Add(2)
+		go func (payload []byte)  {
+			defer wg.Done()
+			_, err := stream.Write(payload)
+			assert.Nil(t, err)
+			assert.Nil(t, stream.Close())
+		}(payload)
+
+		go func (id uint32, payload []byte)  {
+			defer wg.Done()
+			var accepted *Stream
+			for accepted == nil{
+				accepted, _ = remote.AcceptStream(id)
+			}
+			b, err := io.ReadAll(accepted)
+			assert.Nil(t, err)
+			assert.Equal(t, payload, b)
+			assert.Nil(t, accepted.Close())
+		}(stream.ID(), payload)
+	}
+
+	wg.Wait()
+}
+
+func TestStreamReset(t *testing.T) {
+	local, remote := pipePeers()
+	defer local.Close()
+
+	stream, err := local.OpenStream()
+	assert.Nil(t, err)
+
+	var accepted *Stream
+	for accepted == nil{
+		accepted, _ = remote.AcceptStream(stream.ID())
+	}
+
+	assert.Nil(t, accepted.Reset())
+
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+
+	_, err = stream.Write([]byte("late"))
+	assert.Equal(t, ErrStreamReset, err)
+
+	// only the side that did not reset the stream was reset by its peer
+	assert.True(t, stream.ResetByPeer())
+	assert.False(t, accepted.ResetByPeer())
+}
+
+func TestStreamAcceptTimeout(t *testing.T) {
+	local, remote := pipePeers()
+	defer local.Close()
+	remote.acceptTimeout = 50 * time.Millisecond
+
+	stream, err := local.OpenStream()
+	assert.Nil(t, err)
+	_, err = stream.Write([]byte("never read"))
+	assert.Nil(t, err)
+
+	// nobody accepts the stream, so it is reset on both sides and what
+	// was sent on it is dropped
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+
+	_, err = remote.AcceptStream(stream.ID())
+	assert.NotNil(t, err)
+	remote.streamLock.Lock()
+	assert.Empty(t, remote.streams)
+	remote.streamLock.Unlock()
+
+	// accepted streams are left alone
+	stream, err = local.OpenStream()
+	assert.Nil(t, err)
+	var accepted *Stream
+	for accepted == nil{
+		accepted, _ = remote.AcceptStream(stream.ID())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = stream.Write([]byte("read"))
+	assert.Nil(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(accepted, b)
+	assert.Nil(t, err)
+	assert.Equal(t, "read", string(b))
+}
@@ -1,11 +1,24 @@
 package p2p
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
+)
+
+const (
+	// defaultStreamAcceptTimeout is how long a stream the peer opened is
+	// kept around for us to accept before it is reset.
+	defaultStreamAcceptTimeout = time.Minute
+	// maxQueuedMessages is how many messages of a peer may wait to be
+	// consumed before the peer is dropped.
+	maxQueuedMessages = 4096
 )
 
 // TCPPeer represents the remote node over a TCP established connection
@@ -17,31 +30,241 @@ type TCPPeer struct{
 	// if we accept and retrieve a conn => outbound = false 
 	outbound 	bool
 
-	waitGroup *sync.WaitGroup
+	// dialAddr is the address we dialed to reach the peer,
+	// empty if the peer dialed us.
+	dialAddr string
+
+	// remoteKey is the identity the peer proved during a secure
+	// handshake, nil if the handshake did not authenticate it.
+	remoteKey ed25519.PublicKey
+
+	// id the peer announced itself with, and the version
+	// and features negotiated with it
+	id string
+	version uint16
+	features Feature
+
+	encoder Encoder
+	sendLock sync.Mutex
+
+	// streams multiplexed over the connection. Streams we open get odd
+	// IDs when we dialed the connection and even IDs when we accepted
+	// it, so both sides can open streams without coordinating.
+	streamLock sync.Mutex
+	streams map[uint32]*Stream
+	nextStreamID uint32
+	// acceptTimeout is how long a stream the peer opened waits to be
+	// accepted
+	acceptTimeout time.Duration
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer{
+	nextStreamID := uint32(2)
+	if outbound {
+		nextStreamID = 1
+	}
+
 	return &TCPPeer{
 		Conn:		conn,
 		outbound: 	outbound,
-		waitGroup: &sync.WaitGroup{},
+		encoder: LengthPrefixedEncoder{},
+		streams: make(map[uint32]*Stream),
+		nextStreamID: nextStreamID,
+		acceptTimeout: defaultStreamAcceptTimeout,
 	}
 }
 
-func (p *TCPPeer) CloseStream(){
-	p.waitGroup.Done()
+// DialAddr returns the address the peer was dialed at, or an empty
+// string if the connection was accepted from the peer.
+func (p *TCPPeer) DialAddr() string{
+	return p.dialAddr
+}
+
+// RemoteKey returns the identity key the peer authenticated with,
+// or nil if the handshake did not authenticate it.
+func (p *TCPPeer) RemoteKey() ed25519.PublicKey{
+	return p.remoteKey
+}
+
+// ID returns the node ID the peer announced, falling back to its
+// address if it did not announce one.
+func (p *TCPPeer) ID() string{
+	if len(p.id) == 0{
+		return p.RemoteAddr().String()
+	}
+	return p.id
+}
+
+// Version returns the protocol version negotiated with the peer.
+func (p *TCPPeer) Version() uint16{
+	return p.version
+}
+
+// Supports reports whether both we and the peer support the feature.
+func (p *TCPPeer) Supports(feature Feature) bool{
+	return p.features & feature == feature
 }
 
+// Send encodes b as a message and writes it to the peer.
 func (p *TCPPeer) Send(b []byte) error{
-	_, err := p.Conn.Write(b)
-	return err
+	return p.writeFrame(IncomingMessage, b)
+}
+
+// OpenStream opens a new stream to the peer. The peer can pick it up
+// with AcceptStream once it learns the stream's ID, which is usually
+// sent along in a message after opening the stream.
+func (p *TCPPeer) OpenStream() (*Stream, error){
+	p.streamLock.Lock()
+	id := p.nextStreamID
+	p.nextStreamID += 2
+	stream := newStream(id, p)
+	p.streams[id] = stream
+	p.streamLock.Unlock()
+
+	if err := p.writeStreamFrame(StreamOpen, id, nil); err != nil{
+		p.removeStream(id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// AcceptStream returns the stream the peer opened with the given ID.
+// Streams that are not accepted within the accept timeout are reset.
+func (p *TCPPeer) AcceptStream(id uint32) (*Stream, error){
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	stream, ok := p.streams[id]
+	if !ok{
+		return nil, fmt.Errorf("stream (%d) is not open", id)
+	}
+
+	if stream.acceptTimer != nil && !stream.accepted{
+		// the timer already fired, the stream is being reset
+		if !stream.acceptTimer.Stop(){
+			return nil, fmt.Errorf("stream (%d) was not accepted in time", id)
+		}
+		stream.accepted = true
+	}
+
+	return stream, nil
+}
+
+func (p *TCPPeer) writeFrame(msgType byte, payload []byte) error{
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	return p.encoder.Encode(p.Conn, msgType, payload)
+}
+
+func (p *TCPPeer) writeStreamFrame(msgType byte, id uint32, data []byte) error{
+	payload := make([]byte, 4, 4 + len(data))
+	binary.BigEndian.PutUint32(payload, id)
+	payload = append(payload, data...)
+
+	return p.writeFrame(msgType, payload)
+}
+
+// handleStreamFrame routes a stream frame read from the connection to its
+// stream. Frames for streams that were already reset are dropped. Streams
+// the peer opens are reset unless accepted within the accept timeout, so
+// nothing the peer sends on them is held on to forever.
+func (p *TCPPeer) handleStreamFrame(msgType byte, payload []byte) error{
+	if len(payload) < 4{
+		return fmt.Errorf("stream frame (%d) is missing its stream ID", msgType)
+	}
+	id := binary.BigEndian.Uint32(payload)
+	data := payload[4:]
+
+	p.streamLock.Lock()
+	stream, ok := p.streams[id]
+	if msgType == StreamOpen{
+		if ok{
+			p.streamLock.Unlock()
+			return fmt.Errorf("stream (%d) opened twice", id)
+		}
+		opened := newStream(id, p)
+		opened.acceptTimer = time.AfterFunc(p.acceptTimeout, func ()  {
+			opened.Reset()
+		})
+		p.streams[id] = opened
+	}
+	p.streamLock.Unlock()
+
+	if !ok{
+		return nil
+	}
+
+	switch msgType{
+	case StreamData:
+		if err := stream.receiveData(data); err != nil{
+			stream.Reset()
+			log.Println(err)
+		}
+	case StreamClose:
+		stream.receiveClose()
+	case StreamReset:
+		stream.receiveReset()
+	case StreamWindowUpdate:
+		if len(data) != 4{
+			return fmt.Errorf("stream (%d) window update is malformed", id)
+		}
+		stream.receiveWindowUpdate(binary.BigEndian.Uint32(data))
+	}
+
+	return nil
+}
+
+func (p *TCPPeer) removeStream(id uint32){
+	p.streamLock.Lock()
+	delete(p.streams, id)
+	p.streamLock.Unlock()
+}
+
+// resetStreams fails every open stream once the connection is gone.
+func (p *TCPPeer) resetStreams(){
+	p.streamLock.Lock()
+	streams := make([]*Stream, 0, len(p.streams))
+	for _, stream := range p.streams{
+		streams = append(streams, stream)
+	}
+	p.streamLock.Unlock()
+
+	for _, stream := range streams{
+		stream.abort()
+	}
 }
 
 type TCPTransportOpts struct{
+	// ListenAddr is the address we listen on. A port of 0 picks a free
+	// one, which Addr reports once we listen.
 	ListenAddr string
 	HandshakeFunc HandshakeFunc
+	// Decoder defaults to LengthPrefixedDecoder. Encoder defaults to the
+	// encoder matching the Decoder.
 	Decoder Decoder
+	Encoder Encoder
+	// ProtocolVersion and MinProtocolVersion bound the protocol versions
+	// we accept peers on, defaulting to the package's ProtocolVersion and
+	// MinProtocolVersion. Raising the minimum once every node has been
+	// upgraded retires the old versions.
+	ProtocolVersion uint16
+	MinProtocolVersion uint16
+	// Features are the optional protocol features this node supports.
+	Features Feature
+	// NodeID is the ID this node announces to its peers. Behind a secure
+	// handshake it has to be NodeIDFromKey of the node's identity, which
+	// peers hold it to.
+	NodeID string
+	// StreamAcceptTimeout is how long a stream a peer opened waits for us
+	// to accept it before it is reset, a minute by default.
+	StreamAcceptTimeout time.Duration
 	OnPeer func(Peer) error
+	// OnPeerDisconnect is called once the connection to a peer is gone,
+	// including connections that failed the handshake or were refused
+	// by OnPeer.
+	OnPeerDisconnect func(Peer)
 }
 
 type TCPTransport struct{
@@ -53,6 +276,30 @@ type TCPTransport struct{
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport{
+	if opts.Decoder == nil {
+		opts.Decoder = LengthPrefixedDecoder{}
+	}
+
+	if opts.Encoder == nil {
+		if _, ok := opts.Decoder.(DefaultDecoder); ok {
+			opts.Encoder = DefaultEncoder{}
+		} else {
+			opts.Encoder = LengthPrefixedEncoder{}
+		}
+	}
+
+	if opts.ProtocolVersion == 0 {
+		opts.ProtocolVersion = ProtocolVersion
+	}
+
+	if opts.MinProtocolVersion == 0 {
+		opts.MinProtocolVersion = MinProtocolVersion
+	}
+
+	if opts.StreamAcceptTimeout == 0 {
+		opts.StreamAcceptTimeout = defaultStreamAcceptTimeout
+	}
+
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcCh: make(chan RPC, 1024),
@@ -79,12 +326,19 @@ func (t *TCPTransport) Close() error{
 
 // Dial implements the transport interface.
 func (t *TCPTransport) Dial(addr string) error{
-	conn, err := net.Dial("tcp", addr)
+	return t.DialContext(context.Background(), addr)
+}
+
+// DialContext implements the transport interface, giving up on
+// the connection attempt once ctx is done.
+func (t *TCPTransport) DialContext(ctx context.Context, addr string) error{
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	go t.handleConn(conn, true)
+	go t.handleConn(conn, addr)
 
 	return nil
 }
@@ -92,10 +346,13 @@ func (t *TCPTransport) Dial(addr string) error{
 func (t *TCPTransport) ListenAndAccept() error{
 	var err error
 
-	t.listener, err = net.Listen("tcp", t.ListenAddress)
+	t.listener, err = net.Listen("tcp", t.ListenAddr)
 	if err != nil {
 		return err
 	}
+	if _, port, _ := net.SplitHostPort(t.ListenAddr); port == "0" {
+		t.ListenAddr = t.listener.Addr().String()
+	}
 
 	go t.startAcceptLoop()
 
@@ -113,50 +370,139 @@ func (t *TCPTransport) startAcceptLoop(){
 		}
 		if err != nil{
 			fmt.Printf("TCP accept error: %s\n", err)
+			continue
 		}
 
 		fmt.Printf("New incoming connection : %v\n", conn)
-		go t.handleConn(conn, false)
+		go t.handleConn(conn, "")
 	}	
 }
 
-func (t *TCPTransport) handleConn(conn net.Conn, outbound bool){
+// handleConn runs the connection until it fails. dialAddr is the address
+// we dialed, empty for accepted connections.
+func (t *TCPTransport) handleConn(conn net.Conn, dialAddr string){
 	var err error
+
+	peer := NewTCPPeer(conn, len(dialAddr) > 0)
+	peer.dialAddr = dialAddr
+	peer.encoder = t.Encoder
+	peer.acceptTimeout = t.StreamAcceptTimeout
+
 	defer func ()  {
-		fmt.Printf("dropping peer connection: %s", err)
-		conn.Close()
-		}()
+		fmt.Printf("dropping peer connection: %s\n", err)
+		peer.Conn.Close()
+		peer.resetStreams()
 
-	peer := NewTCPPeer(conn, outbound)
+		if t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer)
+		}
+		}()
 
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
 	}
 
+	hello := versionHello{
+		Version: t.ProtocolVersion,
+		MinVersion: t.MinProtocolVersion,
+		Features: t.Features,
+		NodeID: t.NodeID,
+	}
+	if err = negotiateVersion(peer, hello); err != nil {
+		return
+	}
+
 	if t.OnPeer != nil {
 		if err = t.OnPeer(peer); err != nil {
 			return
 		}
 	}
 
+	// messages are handed on from a queue of their own, so stream
+	// frames keep being read while whoever consumes rpcCh is busy
+	queue := newMessageQueue(maxQueuedMessages)
+	go queue.deliver(t.rpcCh)
+	defer queue.close()
+
 	// Read loop
 	for{
 		rpc := RPC{}
-		err := t.Decoder.Decode(conn, &rpc)
+		err = t.Decoder.Decode(peer.Conn, &rpc)
 		if err != nil{
 			return
 		}
 
+		// stream frames are handled right here so a slow consumer of
+		// one stream never holds up the others
+		if rpc.Type != IncomingMessage{
+			if err = peer.handleStreamFrame(rpc.Type, rpc.Payload); err != nil{
+				return
+			}
+			continue
+		}
+
 		rpc.From = conn.RemoteAddr().String()
 
-		if rpc.Stream{
-			peer.waitGroup.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting ...\n", conn.RemoteAddr())
-			peer.waitGroup.Wait()
-			fmt.Printf("[%s] stream closed, resumiong read loop", conn.RemoteAddr())
-			continue
+		if !queue.push(rpc){
+			err = fmt.Errorf("peer (%s) sent more than %d messages that were not consumed yet", rpc.From, maxQueuedMessages)
+			return
+		}
+	}
+}
+
+// messageQueue holds the messages read from a peer until they are
+// consumed, in the order they arrived.
+type messageQueue struct{
+	lock sync.Mutex
+	cond *sync.Cond
+	rpcs []RPC
+	size int
+	closed bool
+}
+
+func newMessageQueue(size int) *messageQueue{
+	q := &messageQueue{size: size}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// push queues the message, reporting false if the queue is full.
+func (q *messageQueue) push(rpc RPC) bool{
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.rpcs) >= q.size{
+		return false
+	}
+	q.rpcs = append(q.rpcs, rpc)
+	q.cond.Signal()
+	return true
+}
+
+// close stops the queue once the messages in it are delivered.
+func (q *messageQueue) close(){
+	q.lock.Lock()
+	q.closed = true
+	q.cond.Signal()
+	q.lock.Unlock()
+}
+
+// deliver sends the queued messages on ch until the queue is closed and
+// empty.
+func (q *messageQueue) deliver(ch chan RPC){
+	for{
+		q.lock.Lock()
+		for len(q.rpcs) == 0 && !q.closed{
+			q.cond.Wait()
 		}
+		if len(q.rpcs) == 0{
+			q.lock.Unlock()
+			return
+		}
+		rpc := q.rpcs[0]
+		q.rpcs = q.rpcs[1:]
+		q.lock.Unlock()
 
-		t.rpcCh <- rpc
+		ch <- rpc
 	}
-}
\ No newline at end of file
+}
@@ -1,7 +1,10 @@
 package p2p
 
 import (
+	"fmt"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,4 +19,90 @@ func TestTCPTransport(t *testing.T) {
 	
 	assert.Equal(t, tr.ListenAddr, ":3000")
 	assert.Nil(t, tr.ListenAndAccept())
-}
\ No newline at end of file
+	tr.Close()
+}
+
+func TestTCPTransportStreamsWhileMessagesWait(t *testing.T) {
+	peerCh := make(chan Peer, 2)
+	onPeer := func (p Peer) error{
+		peerCh <- p
+		return nil
+	}
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr: ":0",
+		HandshakeFunc: NOPHandshakeFunc,
+		OnPeer: onPeer,
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+
+	dialer := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: NOPHandshakeFunc,
+		OnPeer: onPeer,
+	})
+	assert.Nil(t, dialer.Dial(tr.Addr()))
+	// both ends report the connection, tell them apart by who dialed
+	var local, remote Peer
+	for i := 0; i < 2; i++{
+		p := <-peerCh
+		if len(p.DialAddr()) > 0{
+			local = p
+		} else {
+			remote = p
+		}
+	}
+	defer local.Close()
+
+	// nobody consumes the messages yet, more of them than rpcCh holds
+	const messages = 2000
+	for i := 0; i < messages; i++{
+		assert.Nil(t, local.Send([]byte(fmt.Sprintf("message %d", i))))
+	}
+
+	stream, err := local.OpenStream()
+	assert.Nil(t, err)
+	_, err = stream.Write([]byte("streamed"))
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Close())
+
+	accepted := acceptStream(t, remote, stream.ID())
+	done := make(chan []byte)
+	go func ()  {
+		b, _ := io.ReadAll(accepted)
+		done <- b
+	}()
+	select{
+	case b := <-done:
+		assert.Equal(t, "streamed", string(b))
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream data is held up behind the messages")
+	}
+
+	// and the messages that waited are all delivered, in order
+	for i := 0; i < messages; i++{
+		select{
+		case rpc := <-tr.Consume():
+			assert.Equal(t, fmt.Sprintf("message %d", i), string(rpc.Payload))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d was not delivered", i)
+		}
+	}
+}
+
+// acceptStream accepts the stream the peer opened, waiting for it to
+// arrive for up to five seconds.
+func acceptStream(t *testing.T, p Peer, id uint32) *Stream{
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for{
+		stream, err := p.AcceptStream(id)
+		if err == nil{
+			return stream
+		}
+		if time.Now().After(deadline){
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,18 +1,32 @@
 package p2p
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 // Peer is an interface that represents the remote node
 type Peer interface{
 	net.Conn
+	// DialAddr is the address the peer was dialed at,
+	// empty if the peer dialed us.
+	DialAddr() string
+	// ID is the node ID the peer announced when connecting.
+	ID() string
+	// Version is the protocol version negotiated with the peer, and
+	// Supports reports whether both sides support an optional feature.
+	Version() uint16
+	Supports(Feature) bool
 	Send([]byte) error
-	CloseStream()
+	OpenStream() (*Stream, error)
+	AcceptStream(uint32) (*Stream, error)
 }
 
 // Transport is anything that handles the communication betweeen the nodes in the network. This can be of the form TCP, UDP, websockets
 type Transport interface{
 	Addr() string
 	Dial(string) error
+	DialContext(context.Context, string) error
 	ListenAndAccept() error
 	Consume() <- chan RPC
 	Close() error
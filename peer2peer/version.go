@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ProtocolVersion is the newest wire protocol version this package speaks,
+// MinProtocolVersion the oldest one it still accepts peers on.
+//
+// Version 2 has both sides announce their node ID after settling on a
+// version.
+const (
+	ProtocolVersion uint16 = 2
+	MinProtocolVersion uint16 = 1
+)
+
+const (
+	versionMagic = "TSV1"
+	versionHelloSize = len(versionMagic) + 2 + 2 + 8
+	// nodeIDVersion is the first version node IDs are exchanged on,
+	// prefixed with their length and padded to maxNodeIDSize.
+	nodeIDVersion uint16 = 2
+	maxNodeIDSize = 255
+)
+
+var (
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+	// ErrNodeIDMismatch is returned when a peer announces a node ID other
+	// than the one its authenticated identity key maps to.
+	ErrNodeIDMismatch = errors.New("node ID does not match the peer's identity")
+)
+
+// Feature is a bit flag for an optional part of the protocol. The
+// application decides what each bit means; the transport only tells it
+// which features both ends of a connection have in common.
+type Feature uint64
+
+// versionHello is what each side announces after the handshake. The
+// node ID is only sent once both sides settled on a version that has it.
+type versionHello struct{
+	Version uint16
+	MinVersion uint16
+	Features Feature
+	NodeID string
+}
+
+func (h versionHello) encode() []byte{
+	b := make([]byte, 0, versionHelloSize)
+	b = append(b, versionMagic...)
+	b = binary.BigEndian.AppendUint16(b, h.Version)
+	b = binary.BigEndian.AppendUint16(b, h.MinVersion)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.Features))
+	return b
+}
+
+func decodeVersionHello(b []byte) (versionHello, error){
+	if string(b[:len(versionMagic)]) != versionMagic{
+		return versionHello{}, errors.New("peer did not announce a protocol version")
+	}
+	b = b[len(versionMagic):]
+
+	return versionHello{
+		Version: binary.BigEndian.Uint16(b),
+		MinVersion: binary.BigEndian.Uint16(b[2:]),
+		Features: Feature(binary.BigEndian.Uint64(b[4:])),
+	}, nil
+}
+
+// negotiateVersion exchanges versions and features with the peer. Both
+// sides settle on the newest version they have in common and on the
+// features they both support, or refuse the connection if the version
+// ranges do not overlap. On versions that have them, the node IDs are
+// exchanged next.
+func negotiateVersion(peer *TCPPeer, local versionHello) error{
+	if err := peer.Conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil{
+		return err
+	}
+
+	if len(local.NodeID) > maxNodeIDSize{
+		return fmt.Errorf("node ID (%s) is longer than %d bytes", local.NodeID, maxNodeIDSize)
+	}
+
+	b, err := exchange(peer.Conn, local.encode(), versionHelloSize)
+	if err != nil{
+		return err
+	}
+
+	remote, err := decodeVersionHello(b)
+	if err != nil{
+		return err
+	}
+
+	version := min(local.Version, remote.Version)
+	if version < max(local.MinVersion, remote.MinVersion){
+		return fmt.Errorf("%w: peer (%s) speaks versions %d to %d, we speak %d to %d",
+			ErrIncompatibleVersion, peer.RemoteAddr(), remote.MinVersion, remote.Version, local.MinVersion, local.Version)
+	}
+
+	if version >= nodeIDVersion{
+		remote.NodeID, err = exchangeNodeID(peer.Conn, local.NodeID)
+		if err != nil{
+			return err
+		}
+	}
+
+	// a peer that proved its identity is known by the ID that identity
+	// maps to, whatever it announced
+	if len(peer.remoteKey) > 0{
+		id := NodeIDFromKey(peer.remoteKey)
+		if len(remote.NodeID) > 0 && remote.NodeID != id{
+			return fmt.Errorf("%w: peer (%s) announced (%s), its identity maps to (%s)",
+				ErrNodeIDMismatch, peer.RemoteAddr(), remote.NodeID, id)
+		}
+		remote.NodeID = id
+	}
+
+	peer.version = version
+	peer.features = local.Features & remote.Features
+	peer.id = remote.NodeID
+
+	return peer.Conn.SetDeadline(time.Time{})
+}
+
+// exchangeNodeID sends our node ID and reads the peer's. Both are sent
+// at the same fixed size, so neither side waits on the other to read
+// before it reads.
+func exchangeNodeID(conn io.ReadWriter, local string) (string, error){
+	ours := make([]byte, 1 + maxNodeIDSize)
+	ours[0] = byte(len(local))
+	copy(ours[1:], local)
+
+	theirs, err := exchange(conn, ours, len(ours))
+	if err != nil{
+		return "", err
+	}
+	return string(theirs[1:1 + theirs[0]]), nil
+}
@@ -0,0 +1,146 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	negotiate := func (hello versionHello) HandshakeFunc{
+		return func (peer *TCPPeer) error{
+			return negotiateVersion(peer, hello)
+		}
+	}
+
+	local, remote, localErr, remoteErr := handshakePeers(t,
+		negotiate(versionHello{Version: 3, MinVersion: 1, Features: 0b011, NodeID: "local"}),
+		negotiate(versionHello{Version: 2, MinVersion: 2, Features: 0b110, NodeID: "remote"}),
+	)
+	assert.Nil(t, localErr)
+	assert.Nil(t, remoteErr)
+
+	assert.Equal(t, "remote", local.ID())
+	assert.Equal(t, "local", remote.ID())
+
+	for _, peer := range []*TCPPeer{local, remote}{
+		assert.Equal(t, uint16(2), peer.Version())
+		assert.True(t, peer.Supports(0b010))
+		assert.False(t, peer.Supports(0b001))
+		assert.False(t, peer.Supports(0b100))
+	}
+
+	_, _, localErr, remoteErr = handshakePeers(t,
+		negotiate(versionHello{Version: 1, MinVersion: 1}),
+		negotiate(versionHello{Version: 3, MinVersion: 2}),
+	)
+	assert.True(t, errors.Is(localErr, ErrIncompatibleVersion))
+	assert.True(t, errors.Is(remoteErr, ErrIncompatibleVersion))
+}
+
+func TestNegotiateVersionWithoutNodeIDs(t *testing.T) {
+	negotiate := func (hello versionHello) HandshakeFunc{
+		return func (peer *TCPPeer) error{
+			return negotiateVersion(peer, hello)
+		}
+	}
+
+	// version 1 peers send no node ID, they are known by their address
+	local, remote, localErr, remoteErr := handshakePeers(t,
+		negotiate(versionHello{Version: 1, MinVersion: 1, NodeID: "local"}),
+		negotiate(versionHello{Version: 2, MinVersion: 1, NodeID: "remote"}),
+	)
+	assert.Nil(t, localErr)
+	assert.Nil(t, remoteErr)
+
+	assert.Equal(t, uint16(1), local.Version())
+	assert.Equal(t, remote.Conn.LocalAddr().String(), local.ID())
+	assert.Equal(t, local.Conn.LocalAddr().String(), remote.ID())
+}
+
+func TestNegotiateVersionBindsNodeID(t *testing.T) {
+	localIdentity, err := GenerateIdentity()
+	assert.Nil(t, err)
+	remoteIdentity, err := GenerateIdentity()
+	assert.Nil(t, err)
+	localID := NodeIDFromKey(localIdentity.Public().(ed25519.PublicKey))
+	remoteID := NodeIDFromKey(remoteIdentity.Public().(ed25519.PublicKey))
+
+	handshake := func (identity, allowed ed25519.PrivateKey, hello versionHello) HandshakeFunc{
+		secure := NewSecureHandshakeFunc(SecureHandshakeOpts{
+			Identity: identity,
+			AllowedKeys: []ed25519.PublicKey{allowed.Public().(ed25519.PublicKey)},
+		})
+		return func (peer *TCPPeer) error{
+			if err := secure(peer); err != nil{
+				return err
+			}
+			return negotiateVersion(peer, hello)
+		}
+	}
+
+	local, remote, localErr, remoteErr := handshakePeers(t,
+		handshake(localIdentity, remoteIdentity, versionHello{Version: 2, MinVersion: 1, NodeID: localID}),
+		handshake(remoteIdentity, localIdentity, versionHello{Version: 2, MinVersion: 1, NodeID: remoteID}),
+	)
+	assert.Nil(t, localErr)
+	assert.Nil(t, remoteErr)
+	assert.Equal(t, remoteID, local.ID())
+	assert.Equal(t, localID, remote.ID())
+
+	// the ID of a version 1 peer follows from its identity
+	local, _, localErr, remoteErr = handshakePeers(t,
+		handshake(localIdentity, remoteIdentity, versionHello{Version: 2, MinVersion: 1, NodeID: localID}),
+		handshake(remoteIdentity, localIdentity, versionHello{Version: 1, MinVersion: 1}),
+	)
+	assert.Nil(t, localErr)
+	assert.Nil(t, remoteErr)
+	assert.Equal(t, remoteID, local.ID())
+
+	// nobody can pass itself off as another node
+	_, _, localErr, _ = handshakePeers(t,
+		handshake(localIdentity, remoteIdentity, versionHello{Version: 2, MinVersion: 1, NodeID: localID}),
+		handshake(remoteIdentity, localIdentity, versionHello{Version: 2, MinVersion: 1, NodeID: localID}),
+	)
+	assert.True(t, errors.Is(localErr, ErrNodeIDMismatch))
+}
+
+func TestExchangeNodeIDUnbuffered(t *testing.T) {
+	// a pipe holds nothing, every write waits for the other side to read
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	type result struct{
+		id string
+		err error
+	}
+	remoteCh := make(chan result, 1)
+	go func ()  {
+		id, err := exchangeNodeID(remote, "remote")
+		remoteCh <- result{id, err}
+	}()
+
+	localCh := make(chan result, 1)
+	go func ()  {
+		id, err := exchangeNodeID(local, "local")
+		localCh <- result{id, err}
+	}()
+
+	for _, want := range []struct{
+		ch chan result
+		id string
+	}{{localCh, "remote"}, {remoteCh, "local"}}{
+		select{
+		case res := <-want.ch:
+			assert.Nil(t, res.err)
+			assert.Equal(t, want.id, res.id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("node IDs were never exchanged")
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrDiskReserve = errors.New("not enough disk space")
+)
+
+// Quota caps what a namespace may hold. Zero leaves either unlimited.
+type Quota struct{
+	MaxBytes int64
+	MaxObjects int64
+}
+
+// Usage is what a namespace holds, not counting metadata. Staged is how
+// many bytes its transfers still being staged take up, which count
+// against MaxBytes as well.
+type Usage struct{
+	Bytes int64
+	Objects int64
+	Staged int64
+}
+
+// usageTracker keeps the usage of every namespace in the store.
+type usageTracker struct{
+	lock sync.Mutex
+	usage map[string]Usage
+}
+
+// loadStaged counts the transfers every namespace has staged into the
+// usage.
+func (s *Store) loadStaged(tracker *usageTracker) error{
+	return s.Storage.List(stagingDirName + "/", func(info StorageInfo) error {
+		id, _, _ := strings.Cut(strings.TrimPrefix(info.Name, stagingDirName + "/"), "/")
+		tracker.add(id, Usage{Staged: info.Size})
+		return nil
+	})
+}
+
+// chargedTo returns the namespace the object by the name counts against.
+func (s *Store) chargedTo(name string) string{
+	if meta, err := s.readMeta(name); err == nil && len(meta.ChargedTo) > 0 {
+		return meta.ChargedTo
+	}
+	id, _, _ := strings.Cut(name, "/")
+	return id
+}
+
+func (s *Store) quotaFor(id string) Quota{
+	if quota, ok := s.Quotas[id]; ok {
+		return quota
+	}
+	return s.DefaultQuota
+}
+
+// Usage returns what the namespace id holds.
+func (s *Store) Usage(id string) Usage{
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+
+	return s.usage.usage[id]
+}
+
+// Usages returns what every namespace in the store holds.
+func (s *Store) Usages() map[string]Usage{
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+
+	usages := make(map[string]Usage, len(s.usage.usage))
+	for id, u := range s.usage.usage {
+		usages[id] = u
+	}
+	return usages
+}
+
+// CheckQuota fails with ErrQuotaExceeded if storing size bytes under key
+// in the namespace id would take it over its quota.
+func (s *Store) CheckQuota(id, key string, size int64) error{
+	return s.checkQuota(id, s.objectName(id, key), size, 0)
+}
+
+// checkQuota is like CheckQuota but for an object by the name that counts
+// against the namespace account, of which staged bytes are already
+// counted as staged.
+func (s *Store) checkQuota(account, name string, size, staged int64) error{
+	old, existed := s.sizeOf(name)
+	if existed && s.chargedTo(name) != account {
+		old, existed = 0, false
+	}
+
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+
+	_, err := s.usage.check(account, s.quotaFor(account), old, existed, size - staged)
+	return err
+}
+
+// sizeOf returns the size of the object by the name, and whether there
+// is one.
+func (s *Store) sizeOf(name string) (int64, bool){
+	info, err := s.Storage.Stat(name)
+	if err != nil {
+		return 0, false
+	}
+	return info.Size, true
+}
+
+// check returns how the usage of the namespace id changes when an object
+// of size bytes takes the place of one of old bytes, if there was one,
+// failing if that takes it over quota. It is called with the lock held.
+func (t *usageTracker) check(id string, quota Quota, old int64, existed bool, size int64) (Usage, error){
+	delta := Usage{Bytes: size - old}
+	if !existed {
+		delta.Objects = 1
+	}
+
+	u := t.usage[id]
+	if quota.MaxBytes > 0 && delta.Bytes > 0 && u.Bytes + u.Staged + delta.Bytes > quota.MaxBytes {
+		return delta, fmt.Errorf("%w: namespace (%s) would hold %d bytes, %d are allowed",
+			ErrQuotaExceeded, id, u.Bytes + u.Staged + delta.Bytes, quota.MaxBytes)
+	}
+	if quota.MaxObjects > 0 && delta.Objects > 0 && u.Objects + delta.Objects > quota.MaxObjects {
+		return delta, fmt.Errorf("%w: namespace (%s) already holds %d objects, %d are allowed",
+			ErrQuotaExceeded, id, u.Objects, quota.MaxObjects)
+	}
+	return delta, nil
+}
+
+// charge counts an object of size bytes taking the place of whatever was
+// stored by the name against the namespace id, failing if that takes it
+// over its quota. An object replacing one another namespace was charged
+// for is counted in full, and the other namespace no longer charged. The
+// returned func takes it back again.
+func (s *Store) charge(id, name string, size int64) (func(), error){
+	old, existed := s.sizeOf(name)
+	previous := id
+	if existed {
+		previous = s.chargedTo(name)
+	}
+	replaced := old
+	if previous != id {
+		old, existed = 0, false
+	}
+
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+
+	delta, err := s.usage.check(id, s.quotaFor(id), old, existed, size)
+	if err != nil {
+		return nil, err
+	}
+	s.usage.add(id, delta)
+	if previous != id {
+		s.usage.add(previous, Usage{Bytes: -replaced, Objects: -1})
+	}
+
+	return func() {
+		s.usage.lock.Lock()
+		defer s.usage.lock.Unlock()
+
+		s.usage.add(id, Usage{Bytes: -delta.Bytes, Objects: -delta.Objects})
+		if previous != id {
+			s.usage.add(previous, Usage{Bytes: replaced, Objects: 1})
+		}
+	}, nil
+}
+
+// stage counts n more bytes staged by the namespace id, fewer if n is
+// negative.
+func (s *Store) stage(id string, n int64){
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+
+	s.usage.add(id, Usage{Staged: n})
+}
+
+// release stops counting an object of size bytes against the namespace
+// id, once it was removed.
+func (s *Store) release(id string, size int64){
+	s.usage.lock.Lock()
+	defer s.usage.lock.Unlock()
+
+	s.usage.add(id, Usage{Bytes: -size, Objects: -1})
+}
+
+// add changes the usage of the namespace id by delta. It is called with
+// the lock held.
+func (t *usageTracker) add(id string, delta Usage){
+	u := t.usage[id]
+	u.Bytes += delta.Bytes
+	u.Objects += delta.Objects
+	u.Staged += delta.Staged
+	if u.Objects <= 0 && u.Staged <= 0 {
+		delete(t.usage, id)
+		return
+	}
+	t.usage[id] = u
+}
+
+func (t *usageTracker) reset(){
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.usage = make(map[string]Usage)
+}
+
+// quotaReader fails with ErrQuotaExceeded once more than the bytes left
+// in the quota of the namespace are read, so an object that is too large
+// is given up on before all of it was written.
+func (s *Store) quotaReader(id, name string, r io.Reader) io.Reader{
+	quota := s.quotaFor(id)
+	if quota.MaxBytes <= 0 {
+		return r
+	}
+
+	old, existed := s.sizeOf(name)
+	if existed && s.chargedTo(name) != id {
+		old = 0
+	}
+	u := s.Usage(id)
+	left := quota.MaxBytes - u.Bytes - u.Staged + old
+	return &limitReader{r: r, left: left, err: fmt.Errorf("%w: namespace (%s) may hold no more than %d bytes", ErrQuotaExceeded, id, quota.MaxBytes)}
+}
+
+// limitReader fails with err once more than left bytes were read.
+type limitReader struct{
+	r io.Reader
+	left int64
+	err error
+}
+
+func (l *limitReader) Read(b []byte) (int, error){
+	n, err := l.r.Read(b)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, l.err
+	}
+	return n, err
+}
+
+// diskBacked is implemented by the storages that keep their files on
+// disk, which is where the free space is found out for.
+type diskBacked interface{
+	diskPath() string
+}
+
+func (d *DiskStorage) diskPath() string{
+	return d.root
+}
+
+func (p *PackedStorage) diskPath() string{
+	return p.file.Name()
+}
+
+func (s *SegmentStorage) diskPath() string{
+	return s.Dir
+}
+
+// FreeSpace returns how many bytes are free on the disk the store keeps
+// its files on. It fails with errors.ErrUnsupported when the storage is
+// not on disk or the free space cannot be found out on this platform.
+func (s *Store) FreeSpace() (int64, error){
+	disk, ok := s.Storage.(diskBacked)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+
+	// the root is only created with the first file
+	path := disk.diskPath()
+	for {
+		free, err := diskFree(path)
+		if !errors.Is(err, fs.ErrNotExist) || filepath.Dir(path) == path {
+			return free, err
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// admitReplica fails when storing the replica would take the peer that
+// sent it over quota, or leave less than DiskReserve bytes free on disk.
+// What the peer already staged of it counts towards the quota already.
+// The error is meant to be passed back to the peer.
+func (s *FileServer) admitReplica(peer p2p.Peer, msg MessageStoreFile) error{
+	staged := int64(0)
+	if len(msg.Hash) > 0 {
+		staged = min(msg.Offset, s.store.StagedSize(peer.ID(), replicaStagingKey(msg)))
+	}
+	if err := s.store.checkQuota(peer.ID(), s.store.objectName(msg.ID, msg.Key), msg.Offset + msg.Size, staged); err != nil {
+		return err
+	}
+
+	if s.DiskReserve <= 0 {
+		return nil
+	}
+	free, err := s.store.FreeSpace()
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: could not find out the free space: %s", ErrDiskReserve, err)
+	}
+	if free - msg.Size < s.DiskReserve {
+		return fmt.Errorf("%w: %d bytes free of which %d are reserved, %d more do not fit",
+			ErrDiskReserve, free, s.DiskReserve, msg.Size)
+	}
+	return nil
+}
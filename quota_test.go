@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStoreQuota(t *testing.T) {
+	root := t.TempDir()
+	id := generateId()
+	opts := StoreOpts{
+		Root: root,
+		PathTransformFunc: CASPathTransformFunc,
+		Quotas: map[string]Quota{id: {MaxBytes: 10, MaxObjects: 2}},
+	}
+	s := NewStore(opts)
+
+	if _, err := s.Write(id, "a", bytes.NewReader(make([]byte, 6))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "b", bytes.NewReader(make([]byte, 6))); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("want %v have %v", ErrQuotaExceeded, err)
+	}
+	if s.Has(id, "b") {
+		t.Error("file over quota was stored")
+	}
+	// replacing a file only counts the difference
+	if _, err := s.Write(id, "a", bytes.NewReader(make([]byte, 8))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "b", bytes.NewReader(make([]byte, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "c", bytes.NewReader(nil)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("want %v have %v", ErrQuotaExceeded, err)
+	}
+	if have := s.Usage(id); have != (Usage{Bytes: 10, Objects: 2}) {
+		t.Errorf("want 10 bytes in 2 objects have %+v", have)
+	}
+
+	// other namespaces are not capped
+	if _, err := s.Write(generateId(), "c", bytes.NewReader(make([]byte, 100))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.Usage(id); have != (Usage{Bytes: 2, Objects: 1}) {
+		t.Errorf("want 2 bytes in 1 object have %+v", have)
+	}
+
+	// usage is counted again when the store is opened
+	reopened := NewStore(opts)
+	if have, want := reopened.Usages(), s.Usages(); len(have) != 2 || have[id] != want[id] {
+		t.Errorf("want %+v have %+v", want, have)
+	}
+}
+
+// failingStorage fails every delete and rename.
+type failingStorage struct {
+	Storage
+}
+
+func (f failingStorage) Delete(name string) error {
+	return errors.New("delete failed")
+}
+
+func (f failingStorage) Rename(from, to string) error {
+	return errors.New("rename failed")
+}
+
+func TestStoreQuotaKeptOnFailedDelete(t *testing.T) {
+	memory := NewMemoryStorage()
+	s := NewStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Storage: memory})
+	id := generateId()
+	if _, err := s.Write(id, "a", bytes.NewReader(make([]byte, 6))); err != nil {
+		t.Fatal(err)
+	}
+
+	// what could not be removed is still counted
+	s.Storage = failingStorage{memory}
+	if err := s.Delete(id, "a"); err == nil {
+		t.Fatal("delete succeeded")
+	}
+	path := s.objectName(id, "a")[len(id) + 1:]
+	if err := s.Quarantine(id, path); err == nil {
+		t.Fatal("quarantine succeeded")
+	}
+	if have := s.Usage(id); have != (Usage{Bytes: 6, Objects: 1}) {
+		t.Errorf("want 6 bytes in 1 object have %+v", have)
+	}
+
+	s.Storage = memory
+	if err := s.Quarantine(id, path); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.Usage(id); have != (Usage{}) {
+		t.Errorf("want nothing have %+v", have)
+	}
+}
+
+func TestFileServerRefusesReplicas(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServerWithOpts(t, FileServerOpts{DefaultQuota: Quota{MaxBytes: 64}}, s1)
+	s3 := newTestServerWithOpts(t, FileServerOpts{DiskReserve: 1 << 62}, s1, s2)
+	waitFor(t, func() bool { return len(s1.peerList()) == 2 })
+
+	ctx := context.Background()
+	small := bytes.NewReader([]byte("fits"))
+	if err := s1.StoreWithOptions(ctx, "small", small, WriteOptions{Consistency: ConsistencyOne}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s2.store.Has(s1.ID, hashKey("small")) })
+	if s3.store.Has(s1.ID, hashKey("small")) {
+		t.Error("replica was stored on the disk reserve")
+	}
+
+	err := s1.StoreWithOptions(ctx, "large", bytes.NewReader(make([]byte, 100)), WriteOptions{Consistency: ConsistencyOne})
+	if !errors.Is(err, ErrConsistencyNotMet) {
+		t.Fatalf("want %v have %v", ErrConsistencyNotMet, err)
+	}
+	// the peers tell why they refused
+	for _, reason := range []string{ErrQuotaExceeded.Error(), ErrDiskReserve.Error()} {
+		if !strings.Contains(err.Error(), reason) {
+			t.Errorf("want %q in %q", reason, err)
+		}
+	}
+	if s2.store.Has(s1.ID, hashKey("large")) {
+		t.Error("replica over quota was stored")
+	}
+	// a refused replica is not handed off again later
+	for _, s := range []*FileServer{s2, s3} {
+		if hints, _ := s1.hints.For(s.ID); len(hints) > 0 {
+			t.Errorf("want no hints for (%s) have %+v", s.ID, hints)
+		}
+	}
+	if have := s2.store.Usage(s1.ID); have.Objects != 1 {
+		t.Errorf("want 1 replica counted have %+v", have)
+	}
+}
+
+func TestStoreQuotaChargesStaged(t *testing.T) {
+	memory := NewMemoryStorage()
+	opts := StoreOpts{PathTransformFunc: CASPathTransformFunc, Storage: memory, DefaultQuota: Quota{MaxBytes: 10}}
+	s := NewStore(opts)
+	peer, owner := generateId(), generateId()
+	ctx := context.Background()
+
+	// what a peer staged counts against its quota before it is complete
+	if _, err := s.WriteStaged(ctx, peer, "staged", 0, bytes.NewReader(make([]byte, 8))); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.Usage(peer); have != (Usage{Staged: 8}) {
+		t.Errorf("want 8 bytes staged have %+v", have)
+	}
+	if err := s.CheckQuota(peer, "other", 4); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("want %v have %v", ErrQuotaExceeded, err)
+	}
+	if have := NewStore(opts).Usage(peer); have != (Usage{Staged: 8}) {
+		t.Errorf("want 8 bytes staged after reopening have %+v", have)
+	}
+
+	// and once it is in place of the owner's replica, it still counts
+	// against the peer, also after reopening the store
+	if err := s.Promote(peer, "staged", owner, "key", nil, ObjectMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.Usage(peer); have != (Usage{Bytes: 8, Objects: 1}) {
+		t.Errorf("want 8 bytes in 1 object have %+v", have)
+	}
+	if have := s.Usage(owner); have != (Usage{}) {
+		t.Errorf("want nothing charged to the owner have %+v", have)
+	}
+	if have := NewStore(opts).Usages(); len(have) != 1 || have[peer] != (Usage{Bytes: 8, Objects: 1}) {
+		t.Errorf("want only the peer charged after reopening have %+v", have)
+	}
+
+	// the owner writing it again takes the charge over
+	if _, err := s.Write(owner, "key", bytes.NewReader(make([]byte, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.Usages(); len(have) != 1 || have[owner] != (Usage{Bytes: 2, Objects: 1}) {
+		t.Errorf("want only the owner charged have %+v", have)
+	}
+	if err := s.Delete(owner, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if have := s.Usages(); len(have) != 0 {
+		t.Errorf("want nothing charged have %+v", have)
+	}
+}
+
+func TestFileServerChargesSender(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServerWithOpts(t, FileServerOpts{DefaultQuota: Quota{MaxBytes: 64}}, s1)
+	waitFor(t, func() bool { return len(s1.peerList()) == 1 && len(s2.peerList()) == 1 })
+
+	ctx := context.Background()
+	send := func(id, key string, data []byte, staged bool) error {
+		requestID := generateId()
+		ackCh, done := s1.registerRequest(requestID, 1)
+		defer done()
+
+		msg := MessageStoreFile{RequestID: requestID, ID: id, Key: key, Size: int64(len(data))}
+		if staged {
+			hash := sha256.Sum256(data)
+			msg.Hash = hash[:]
+		}
+		streams, acking, _ := s1.openStoreStreams(msg, s1.peerList())
+		s1.sendReplicas(ctx, streams, func(w io.Writer) (int, error) {
+			return w.Write(data)
+		})
+		return s1.waitForAcks(ctx, key, ackCh, acking, 1)
+	}
+
+	if err := send(generateId(), hashKey("first"), make([]byte, 40), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// neither fresh namespaces, shards nor chunks get around the quota of
+	// the node that sends them
+	chunk := bytes.Repeat([]byte("c"), 40)
+	chunkHash := sha256.Sum256(chunk)
+	for _, id := range []string{generateId(), s1.ID + shardNamespaceSuffix, chunkNamespace} {
+		key, staged := hashKey(id), true
+		if id == chunkNamespace {
+			key, staged = hex.EncodeToString(chunkHash[:]), false
+		}
+		if err := send(id, key, chunk, staged); err == nil || !strings.Contains(err.Error(), ErrQuotaExceeded.Error()) {
+			t.Errorf("want %v storing in (%s) have %v", ErrQuotaExceeded, id, err)
+		}
+	}
+	if have := s2.store.Usage(s1.ID); have != (Usage{Bytes: 40, Objects: 1}) {
+		t.Errorf("want 40 bytes in 1 object have %+v", have)
+	}
+}
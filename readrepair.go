@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"time"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+// readRepair waits for the rest of the peers asked for the file to answer
+// and repairs the ones that should hold the file but are missing it or
+// hold another version. When we read our own copy, that is the version
+// they get. Only when we had to fetch the file do they get the version
+// most of them hold. Peers that do not answer at all are left alone, they
+// may just be slow.
+func (s *FileServer) readRepair(key string, asked []p2p.Peer, responses map[string]MessageGetFileResponse, fetchedFrom string, respCh chan peerResponse, done func()){
+	timeout := time.NewTimer(s.RequestTimeout)
+	defer timeout.Stop()
+
+	for waiting := true; waiting && len(responses) < len(asked); {
+		select{
+		case resp := <- respCh:
+			if msg, ok := resp.payload.(MessageGetFileResponse); ok{
+				responses[resp.from] = msg
+			}
+		case <- timeout.C:
+			waiting = false
+		case <- s.quitCh:
+			waiting = false
+		}
+	}
+	done()
+
+	ctx, cancel := s.quitContext()
+	defer cancel()
+
+	responsible, _ := s.splitReplicaPeers(key, asked)
+	if fetchedFrom == ""{
+		if err := s.repairFromOwnCopy(ctx, key, responsible, responses); err != nil{
+			log.Printf("[%s] read repair of file (%s) failed: %s", s.Transport.Addr(), key, err)
+		}
+		return
+	}
+
+	hash, source := majorityVersion(responses, fetchedFrom)
+	if source == ""{
+		return
+	}
+
+	stale := staleReplicas(responsible, responses, hash)
+	if len(stale) == 0{
+		return
+	}
+
+	repair := s.repairReplicas
+	if responses[source].Chunked{
+		repair = s.repairChunkedReplicas
+	}
+	if err := repair(ctx, key, source, hash, stale); err != nil{
+		log.Printf("[%s] read repair of file (%s) failed: %s", s.Transport.Addr(), key, err)
+	}
+}
+
+// staleReplicas returns the peers that are missing the replica or hold
+// one that does not hash to want. Peers that do not report hashes can
+// only be told to be stale when they are missing it.
+func staleReplicas(peers []p2p.Peer, responses map[string]MessageGetFileResponse, want []byte) []p2p.Peer{
+	stale := []p2p.Peer{}
+	for _, peer := range peers{
+		resp, ok := responses[peer.RemoteAddr().String()]
+		if !ok{
+			continue
+		}
+		if !resp.Found || (len(resp.Hash) > 0 && !bytes.Equal(resp.Hash, want)){
+			stale = append(stale, peer)
+		}
+	}
+	return stale
+}
+
+// replicaHashes are the hashes the replicas of our own copy of a file
+// have, as a whole replica and as the manifest of a chunked one.
+type replicaHashes struct{
+	whole []byte
+	chunked []byte
+}
+
+// matches reports whether the peer holds a replica of our copy. Peers
+// that do not report hashes are taken at their word.
+func (h replicaHashes) matches(resp MessageGetFileResponse) bool{
+	if len(resp.Hash) == 0{
+		return true
+	}
+	if resp.Chunked{
+		return bytes.Equal(resp.Hash, h.chunked)
+	}
+	return bytes.Equal(resp.Hash, h.whole)
+}
+
+// ownReplicaHashes returns the hashes the replicas of our own copy of the
+// file have. Replicas and manifests are encrypted deterministically, so
+// they follow from our copy.
+func (s *FileServer) ownReplicaHashes(key string) (replicaHashes, error){
+	hashes := replicaHashes{}
+	_, r, err := s.readOwn(key)
+	if err != nil{
+		return hashes, err
+	}
+	data, err := io.ReadAll(r)
+	if rc, ok := r.(io.ReadCloser); ok{
+		rc.Close()
+	}
+	if err != nil{
+		return hashes, err
+	}
+
+	replica, err := encryptDeterministic(s.EncKey, data)
+	if err != nil{
+		return hashes, err
+	}
+	whole := sha256.Sum256(replica)
+	hashes.whole = whole[:]
+
+	if s.chunking(){
+		file, err := s.chunkFile(bytes.NewReader(data))
+		if err != nil{
+			return hashes, err
+		}
+		chunked := sha256.Sum256(file.manifest)
+		hashes.chunked = chunked[:]
+	}
+	return hashes, nil
+}
+
+// repairFromOwnCopy sends our own copy of the file to the responsible
+// peers whose replica does not match it. Replicas and manifests are
+// encrypted deterministically, so what each peer should hold follows
+// from our copy, no matter what the others hold.
+func (s *FileServer) repairFromOwnCopy(ctx context.Context, key string, responsible []p2p.Peer, responses map[string]MessageGetFileResponse) error{
+	_, r, err := s.readOwn(key)
+	if err != nil{
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if rc, ok := r.(io.ReadCloser); ok{
+		rc.Close()
+	}
+	if err != nil{
+		return err
+	}
+
+	chunked, whole := s.splitChunkPeers(responsible)
+	if len(whole) > 0{
+		replica, err := encryptDeterministic(s.EncKey, data)
+		if err != nil{
+			return err
+		}
+		hash := sha256.Sum256(replica)
+		if stale := staleReplicas(whole, responses, hash[:]); len(stale) > 0{
+			if err := s.sendRepairs(ctx, key, replica, hash[:], stale); err != nil{
+				return err
+			}
+		}
+	}
+
+	if len(chunked) > 0{
+		file, err := s.chunkFile(bytes.NewReader(data))
+		if err != nil{
+			return err
+		}
+		hash := sha256.Sum256(file.manifest)
+		stale := staleReplicas(chunked, responses, hash[:])
+		_, failed := s.replicateChunked(ctx, generateId(), key, file, stale)
+		for _, peer := range stale{
+			if !slices.Contains(failed, peer){
+				log.Printf("[%s] repaired file (%s) on (%s)", s.Transport.Addr(), key, peer.RemoteAddr())
+			}
+		}
+	}
+	return nil
+}
+
+// majorityVersion returns the hash most peers hold and a peer to copy
+// it from. On a tie the version we read the file from wins.
+func majorityVersion(responses map[string]MessageGetFileResponse, preferred string) ([]byte, string){
+	counts := map[string]int{}
+	for _, resp := range responses{
+		if resp.Found && len(resp.Hash) > 0{
+			counts[string(resp.Hash)]++
+		}
+	}
+
+	preferredHash := ""
+	if resp, ok := responses[preferred]; ok && resp.Found{
+		preferredHash = string(resp.Hash)
+	}
+
+	best := preferredHash
+	for hash, count := range counts{
+		if count > counts[best] || (count == counts[best] && best != preferredHash && hash < best){
+			best = hash
+		}
+	}
+	if counts[best] == 0{
+		return nil, ""
+	}
+
+	source := ""
+	if preferredHash == best{
+		source = preferred
+	}
+	for from, resp := range responses{
+		if source == "" && resp.Found && string(resp.Hash) == best{
+			source = from
+		}
+	}
+
+	return []byte(best), source
+}
+
+// repairReplicas copies the encrypted replica from the source peer and
+// sends it on to the stale peers as it is.
+func (s *FileServer) repairReplicas(ctx context.Context, key string, source string, hash []byte, stale []p2p.Peer) error{
+	request := func(streamID uint32) any{
+		return MessageFetchFile{
+			RequestID: generateId(),
+			ID: s.ID,
+			Key: hashKey(key),
+			StreamID: streamID,
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err := s.fetchOverStream(ctx, source, request, func(r io.Reader) (int64, error){
+		return io.Copy(buf, newHashCheckReader(r, hash))
+	})
+	if err != nil{
+		return err
+	}
+
+	return s.sendRepairs(ctx, key, buf.Bytes(), hash, stale)
+}
+
+// sendRepairs sends the encrypted replica to the stale peers. Nobody
+// waits for the acknowledgements, a repair that fails is retried on the
+// next read.
+func (s *FileServer) sendRepairs(ctx context.Context, key string, replica []byte, hash []byte, stale []p2p.Peer) error{
+	streams, _, _ := s.openReplicaStreams(generateId(), key, int64(len(replica)), hash, stale)
+	_, _, err := s.sendReplicas(ctx, streams, func(w io.Writer) (int, error){
+		n, err := io.Copy(w, bytes.NewReader(replica))
+		return int(n), err
+	})
+	if err != nil{
+		return err
+	}
+
+	for _, peer := range stale{
+		log.Printf("[%s] repaired file (%s) on (%s)", s.Transport.Addr(), key, peer.RemoteAddr())
+	}
+	return nil
+}
+
+// repairChunkedReplicas chunks our own copy of the file again and sends
+// the stale peers the chunks they lack along with the manifest. The
+// chunks and manifest come out the same as the source's, as long as our
+// copy is the version the source holds.
+func (s *FileServer) repairChunkedReplicas(ctx context.Context, key string, source string, hash []byte, stale []p2p.Peer) error{
+	_, r, err := s.readOwn(key)
+	if err != nil{
+		return err
+	}
+	if rc, ok := r.(io.ReadCloser); ok{
+		defer rc.Close()
+	}
+
+	file, err := s.chunkFile(r)
+	if err != nil{
+		return err
+	}
+	if sum := sha256.Sum256(file.manifest); !bytes.Equal(sum[:], hash){
+		return fmt.Errorf("our copy is not the version (%s) holds", source)
+	}
+
+	chunked, _ := s.splitChunkPeers(stale)
+	_, failed := s.replicateChunked(ctx, generateId(), key, file, chunked)
+	for _, peer := range chunked{
+		if !slices.Contains(failed, peer){
+			log.Printf("[%s] repaired file (%s) on (%s)", s.Transport.Addr(), key, peer.RemoteAddr())
+		}
+	}
+	return nil
+}
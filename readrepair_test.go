@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMajorityVersion(t *testing.T){
+	good, bad := []byte("good"), []byte("bad")
+	responses := map[string]MessageGetFileResponse{
+		"a": {Found: true, Hash: good},
+		"b": {Found: true, Hash: good},
+		"c": {Found: true, Hash: bad},
+		"d": {Found: false},
+	}
+
+	// the majority wins over the copy we happened to read
+	hash, source := majorityVersion(responses, "c")
+	if !bytes.Equal(hash, good) || (source != "a" && source != "b"){
+		t.Errorf("want %s from a or b have %s from %s", good, hash, source)
+	}
+
+	// on a tie the copy we read wins
+	delete(responses, "b")
+	if hash, source := majorityVersion(responses, "c"); !bytes.Equal(hash, bad) || source != "c"{
+		t.Errorf("want %s from c have %s from %s", bad, hash, source)
+	}
+
+	if _, source := majorityVersion(map[string]MessageGetFileResponse{"d": {}}, ""); source != ""{
+		t.Errorf("want no version when nobody holds the file, have one from %s", source)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrTooFewShards = errors.New("too few shards to reconstruct the data")
+
+// arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1,
+// done through log and exp tables
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init(){
+	x := 1
+	for i := 0; i < 255; i++{
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x & 0x100 != 0{
+			x ^= 0x11d
+		}
+	}
+	// doubled so products can index the table without a modulo
+	for i := 255; i < len(gfExp); i++{
+		gfExp[i] = gfExp[i - 255]
+	}
+}
+
+func gfMul(a, b byte) byte{
+	if a == 0 || b == 0{
+		return 0
+	}
+	return gfExp[int(gfLog[a]) + int(gfLog[b])]
+}
+
+func gfInv(a byte) byte{
+	return gfExp[255 - int(gfLog[a])]
+}
+
+// ReedSolomon splits data into data shards and computes parity shards
+// over them, so the data can be reconstructed from any dataShards of all
+// the shards. The data shards are the data itself, the parity shards are
+// rows of a Cauchy matrix applied to them, which keeps every square
+// selection of rows invertible.
+type ReedSolomon struct{
+	dataShards int
+	parityShards int
+	// matrix has a row per shard: the identity for the data shards
+	// followed by the Cauchy rows for the parity shards
+	matrix [][]byte
+}
+
+func NewReedSolomon(dataShards, parityShards int) (*ReedSolomon, error){
+	if dataShards <= 0 || parityShards < 0{
+		return nil, fmt.Errorf("invalid shard counts %d+%d", dataShards, parityShards)
+	}
+	if dataShards + parityShards > 256{
+		return nil, fmt.Errorf("at most 256 shards are supported, have %d+%d", dataShards, parityShards)
+	}
+
+	total := dataShards + parityShards
+	matrix := make([][]byte, total)
+	for i := range matrix{
+		matrix[i] = make([]byte, dataShards)
+		if i < dataShards{
+			matrix[i][i] = 1
+			continue
+		}
+		for j := 0; j < dataShards; j++{
+			matrix[i][j] = gfInv(byte(i) ^ byte(j))
+		}
+	}
+
+	return &ReedSolomon{
+		dataShards: dataShards,
+		parityShards: parityShards,
+		matrix: matrix,
+	}, nil
+}
+
+func (rs *ReedSolomon) DataShards() int{
+	return rs.dataShards
+}
+
+func (rs *ReedSolomon) ParityShards() int{
+	return rs.parityShards
+}
+
+// Split cuts the data into equally sized data shards, zero padding the
+// last one, and leaves room for the parity shards. Encode fills them in.
+func (rs *ReedSolomon) Split(data []byte) [][]byte{
+	size := (len(data) + rs.dataShards - 1) / rs.dataShards
+	size = max(size, 1)
+
+	padded := make([]byte, size * (rs.dataShards + rs.parityShards))
+	copy(padded, data)
+
+	shards := make([][]byte, rs.dataShards + rs.parityShards)
+	for i := range shards{
+		shards[i] = padded[i * size:(i + 1) * size]
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards.
+func (rs *ReedSolomon) Encode(shards [][]byte) error{
+	if err := rs.checkShards(shards, false); err != nil{
+		return err
+	}
+
+	for i := rs.dataShards; i < len(shards); i++{
+		rs.computeShard(rs.matrix[i], shards[:rs.dataShards], shards[i])
+	}
+	return nil
+}
+
+// Reconstruct fills in the shards that are nil from the ones present, as
+// long as at least dataShards of them are.
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error{
+	if err := rs.checkShards(shards, true); err != nil{
+		return err
+	}
+
+	size := 0
+	rows := []int{}
+	for i, shard := range shards{
+		if shard != nil && len(rows) < rs.dataShards{
+			rows = append(rows, i)
+			size = len(shard)
+		}
+	}
+	if len(rows) < rs.dataShards{
+		return fmt.Errorf("%w: have %d of the %d needed", ErrTooFewShards, len(rows), rs.dataShards)
+	}
+
+	sub := make([][]byte, rs.dataShards)
+	present := make([][]byte, rs.dataShards)
+	for i, row := range rows{
+		sub[i] = rs.matrix[row]
+		present[i] = shards[row]
+	}
+	decode, err := invertMatrix(sub)
+	if err != nil{
+		return err
+	}
+
+	data := make([][]byte, rs.dataShards)
+	for i := range data{
+		data[i] = shards[i]
+		if data[i] == nil{
+			data[i] = make([]byte, size)
+			rs.computeShard(decode[i], present, data[i])
+		}
+	}
+
+	for i := range shards{
+		switch{
+		case shards[i] != nil:
+		case i < rs.dataShards:
+			shards[i] = data[i]
+		default:
+			shards[i] = make([]byte, size)
+			rs.computeShard(rs.matrix[i], data, shards[i])
+		}
+	}
+	return nil
+}
+
+// Join concatenates the data shards and cuts off the padding.
+func (rs *ReedSolomon) Join(shards [][]byte, size int) ([]byte, error){
+	held := 0
+	for _, shard := range shards[:rs.dataShards]{
+		if shard == nil{
+			return nil, fmt.Errorf("%w: data shards are missing", ErrTooFewShards)
+		}
+		held += len(shard)
+	}
+	if held < size{
+		return nil, fmt.Errorf("shards hold %d bytes, want %d", held, size)
+	}
+
+	data := make([]byte, 0, held)
+	for _, shard := range shards[:rs.dataShards]{
+		data = append(data, shard...)
+	}
+	return data[:size], nil
+}
+
+func (rs *ReedSolomon) checkShards(shards [][]byte, allowMissing bool) error{
+	if len(shards) != rs.dataShards + rs.parityShards{
+		return fmt.Errorf("want %d shards have %d", rs.dataShards + rs.parityShards, len(shards))
+	}
+
+	size := -1
+	for _, shard := range shards{
+		if shard == nil && allowMissing{
+			continue
+		}
+		if size >= 0 && len(shard) != size{
+			return errors.New("shards differ in size")
+		}
+		size = len(shard)
+	}
+	return nil
+}
+
+// computeShard sets out to the inputs weighted by the coefficients.
+func (rs *ReedSolomon) computeShard(coefficients []byte, inputs [][]byte, out []byte){
+	for i := range out{
+		out[i] = 0
+	}
+	for j, input := range inputs{
+		c := coefficients[j]
+		if c == 0{
+			continue
+		}
+		for i, b := range input{
+			out[i] ^= gfMul(c, b)
+		}
+	}
+}
+
+// invertMatrix inverts a square matrix by Gauss-Jordan elimination.
+func invertMatrix(m [][]byte) ([][]byte, error){
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range work{
+		work[i] = make([]byte, 2 * n)
+		copy(work[i], m[i])
+		work[i][n + i] = 1
+	}
+
+	for col := 0; col < n; col++{
+		pivot := col
+		for pivot < n && work[pivot][col] == 0{
+			pivot++
+		}
+		if pivot == n{
+			return nil, errors.New("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for j := range work[col]{
+			work[col][j] = gfMul(work[col][j], scale)
+		}
+
+		for row := 0; row < n; row++{
+			if row == col || work[row][col] == 0{
+				continue
+			}
+			factor := work[row][col]
+			for j := range work[row]{
+				work[row][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+
+	inv := make([][]byte, n)
+	for i := range inv{
+		inv[i] = work[i][n:]
+	}
+	return inv, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReedSolomonReconstruct(t *testing.T){
+	rs, err := NewReedSolomon(4, 2)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	data := []byte("some data that does not split evenly into four shards")
+	shards := rs.Split(data)
+	if err := rs.Encode(shards); err != nil{
+		t.Fatal(err)
+	}
+
+	// every pair of lost shards can be recovered from the other four
+	for a := 0; a < 6; a++{
+		for b := a + 1; b < 6; b++{
+			lost := make([][]byte, len(shards))
+			for i, shard := range shards{
+				if i != a && i != b{
+					lost[i] = append([]byte{}, shard...)
+				}
+			}
+
+			if err := rs.Reconstruct(lost); err != nil{
+				t.Fatal(err)
+			}
+			for i := range shards{
+				if !bytes.Equal(lost[i], shards[i]){
+					t.Errorf("losing shards %d and %d: shard %d was not restored", a, b, i)
+				}
+			}
+
+			joined, err := rs.Join(lost, len(data))
+			if err != nil{
+				t.Fatal(err)
+			}
+			if !bytes.Equal(joined, data){
+				t.Errorf("want %s have %s", data, joined)
+			}
+		}
+	}
+
+	shards[0], shards[1], shards[2] = nil, nil, nil
+	if err := rs.Reconstruct(shards); err == nil{
+		t.Error("expected reconstructing from three of six shards to fail")
+	}
+}
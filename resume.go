@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+// stagingKey is the key a transfer of the version of the file with the
+// given hash is staged under, so a transfer is never resumed with the
+// bytes of another version.
+func stagingKey(key string, hash []byte) string{
+	return key + "@" + hex.EncodeToString(hash)
+}
+
+// replicaStagingKey is the key the replica a peer sends is staged under,
+// in the peer's namespace, so what it stages counts against its quota and
+// only it can resume the transfer.
+func replicaStagingKey(msg MessageStoreFile) string{
+	return stagingKey(msg.ID + "/" + msg.Key, msg.Hash)
+}
+
+// MessageGetStaged asks a peer how much of a replica it has staged from
+// an earlier transfer that broke off. The peer answers with a
+// MessageGetStagedResponse carrying the same RequestID.
+type MessageGetStaged struct{
+	RequestID string
+	ID string
+	Key string
+	Hash []byte
+}
+
+type MessageGetStagedResponse struct{
+	RequestID string
+	Size int64
+}
+
+// storeStaged stages the part of the replica the peer sends and stores
+// the replica once it is complete and matches its hash.
+func (s *FileServer) storeStaged(peer p2p.Peer, msg MessageStoreFile, r io.Reader) (int64, error){
+	ctx, cancel := s.quitContext()
+	defer cancel()
+
+	staged := replicaStagingKey(msg)
+	n, err := s.store.WriteStaged(ctx, peer.ID(), staged, msg.Offset, r)
+	if err != nil{
+		return n, err
+	}
+
+	if err := s.store.Promote(peer.ID(), staged, msg.ID, msg.Key, msg.Hash, msg.Meta); err != nil{
+		return n, err
+	}
+	return n, s.replicaStored(msg, nil)
+}
+
+// stagedOffset asks the peer how much of the replica it already holds,
+// zero if it cannot tell.
+func (s *FileServer) stagedOffset(ctx context.Context, peer p2p.Peer, id string, key string, hash []byte) int64{
+	if !peer.Supports(FeatureResume){
+		return 0
+	}
+
+	requestID := generateId()
+	respCh, done := s.registerRequest(requestID, 1)
+	defer done()
+
+	payload, err := s.request(ctx, peer, respCh, MessageGetStaged{RequestID: requestID, ID: id, Key: key, Hash: hash})
+	if err != nil{
+		return 0
+	}
+	resp, ok := payload.(MessageGetStagedResponse)
+	if !ok{
+		return 0
+	}
+	return resp.Size
+}
+
+// fetchStaged fetches the encrypted file into the staging area, resuming
+// where an earlier attempt broke off, and only decrypts it into place once
+// all of it arrived and it matches the hash the peer announced. When a
+// resumed file does not match, the bytes staged earlier may be the bad
+// ones, so the file is fetched once more from the start. Nothing is kept
+// of a fetch ctx cancels.
+func (s *FileServer) fetchStaged(ctx context.Context, from string, requestID string, key string, resp MessageGetFileResponse) error{
+	staged := stagingKey(hashKey(key), resp.Hash)
+	resumed := s.store.StagedSize(s.ID, staged) > 0
+
+	err := s.fetchStagedOnce(ctx, from, requestID, key, resp)
+	if resumed && errors.Is(err, ErrCorrupt){
+		log.Printf("[%s] resumed file (%s) is corrupt, fetching it again", s.Transport.Addr(), key)
+		err = s.fetchStagedOnce(ctx, from, requestID, key, resp)
+	}
+	return err
+}
+
+func (s *FileServer) fetchStagedOnce(ctx context.Context, from string, requestID string, key string, resp MessageGetFileResponse) error{
+	staged := stagingKey(hashKey(key), resp.Hash)
+
+	offset := s.store.StagedSize(s.ID, staged)
+	if offset > resp.Size{
+		s.store.DiscardStaged(s.ID, staged)
+		offset = 0
+	}
+
+	if offset < resp.Size{
+		request := func(streamID uint32) any{
+			return MessageFetchFile{
+				RequestID: requestID,
+				ID: s.ID,
+				Key: hashKey(key),
+				StreamID: streamID,
+				Offset: offset,
+			}
+		}
+
+		err := s.fetchOverStream(ctx, from, request, func(r io.Reader) (int64, error){
+			return s.store.WriteStaged(ctx, s.ID, staged, offset, r)
+		})
+		if err != nil{
+			// we gave up on the file, so nothing resumes the transfer
+			if ctx.Err() != nil{
+				s.store.DiscardStaged(s.ID, staged)
+			}
+			return err
+		}
+	}
+
+	_, r, err := s.store.ReadStaged(s.ID, staged)
+	if err != nil{
+		return err
+	}
+	defer r.Close()
+
+	if _, err := s.store.WriteDecryptWithMeta(ctx, s.EncKey, s.ID, key, newHashCheckReader(r, resp.Hash), ownMeta(resp.Meta)); err != nil{
+		if ctx.Err() == nil{
+			// the staged file is complete but wrong, it cannot be resumed
+			s.store.DiscardStaged(s.ID, staged)
+		}
+		return fmt.Errorf("decrypting staged file: %w", err)
+	}
+
+	return s.store.DiscardStaged(s.ID, staged)
+}
+
+func (s *FileServer) handleMessageGetStaged(from string, msg MessageGetStaged) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
+	}
+
+	resp := MessageGetStagedResponse{
+		RequestID: msg.RequestID,
+	}
+	if s.checkPeerObject(msg.ID, s.store.pathOf(msg.Key)) == nil{
+		replica := MessageStoreFile{ID: msg.ID, Key: msg.Key, Hash: msg.Hash}
+		resp.Size = s.store.StagedSize(peer.ID(), replicaStagingKey(replica))
+	}
+	return s.send(peer, &Message{Payload: resp})
+}
+
+func (s *FileServer) handleMessageGetStagedResponse(from string, msg MessageGetStagedResponse) error{
+	s.deliverResponse(msg.RequestID, from, msg)
+	return nil
+}
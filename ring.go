@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const defaultVirtualNodes = 64
+
+// HashRing places keys on nodes by consistent hashing. Every node owns
+// several virtual points on the ring so keys spread evenly across nodes,
+// and only the keys next to a node's points move when it joins or leaves.
+type HashRing struct{
+	lock sync.RWMutex
+	virtualNodes int
+	points []uint64
+	owners map[uint64]string
+	nodes map[string]struct{}
+}
+
+func NewHashRing(virtualNodes int) *HashRing{
+	if virtualNodes <= 0{
+		virtualNodes = defaultVirtualNodes
+	}
+
+	return &HashRing{
+		virtualNodes: virtualNodes,
+		owners: make(map[uint64]string),
+		nodes: make(map[string]struct{}),
+	}
+}
+
+func ringHash(s string) uint64{
+	hash := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+func (r *HashRing) Add(node string){
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.nodes[node]; ok{
+		return
+	}
+	r.nodes[node] = struct{}{}
+
+	for i := 0; i < r.virtualNodes; i++{
+		point := ringHash(fmt.Sprintf("%s#%d", node, i))
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *HashRing) Remove(node string){
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.nodes[node]; !ok{
+		return
+	}
+	delete(r.nodes, node)
+
+	points := r.points[:0]
+	for _, point := range r.points{
+		if r.owners[point] == node{
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+func (r *HashRing) Has(node string) bool{
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.nodes[node]
+	return ok
+}
+
+func (r *HashRing) Len() int{
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.nodes)
+}
+
+// Lookup returns the n distinct nodes responsible for the key, walking the
+// ring clockwise from the key's position. Fewer nodes are returned if the
+// ring does not have n.
+func (r *HashRing) Lookup(key string, n int) []string{
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	n = min(n, len(r.nodes))
+	if n <= 0{
+		return nil
+	}
+
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+
+	nodes := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	for i := 0; len(nodes) < n; i++{
+		node := r.owners[r.points[(start + i) % len(r.points)]]
+		if _, ok := seen[node]; ok{
+			continue
+		}
+		seen[node] = struct{}{}
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingLookup(t *testing.T){
+	ring := NewHashRing(defaultVirtualNodes)
+	if nodes := ring.Lookup("key", 2); len(nodes) != 0{
+		t.Errorf("expected no nodes on an empty ring, have %v", nodes)
+	}
+
+	for i := 0; i < 5; i++{
+		ring.Add(fmt.Sprintf("node_%d", i))
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++{
+		nodes := ring.Lookup(fmt.Sprintf("key_%d", i), 3)
+		if len(nodes) != 3{
+			t.Fatalf("want 3 nodes have %v", nodes)
+		}
+		if nodes[0] == nodes[1] || nodes[1] == nodes[2] || nodes[0] == nodes[2]{
+			t.Errorf("expected distinct nodes, have %v", nodes)
+		}
+		counts[nodes[0]]++
+	}
+
+	for node, count := range counts{
+		if count < 100{
+			t.Errorf("node %s only owns %d of 1000 keys", node, count)
+		}
+	}
+
+	if nodes := ring.Lookup("key", 10); len(nodes) != 5{
+		t.Errorf("want every node when asking for more than the ring has, have %v", nodes)
+	}
+}
+
+func TestHashRingRemoveOnlyMovesItsKeys(t *testing.T){
+	ring := NewHashRing(defaultVirtualNodes)
+	for i := 0; i < 5; i++{
+		ring.Add(fmt.Sprintf("node_%d", i))
+	}
+
+	before := map[string]string{}
+	for i := 0; i < 1000; i++{
+		key := fmt.Sprintf("key_%d", i)
+		before[key] = ring.Lookup(key, 1)[0]
+	}
+
+	ring.Remove("node_2")
+
+	for key, owner := range before{
+		now := ring.Lookup(key, 1)[0]
+		if owner != "node_2" && now != owner{
+			t.Errorf("key %s moved from %s to %s", key, owner, now)
+		}
+		if now == "node_2"{
+			t.Errorf("key %s still placed on removed node", key)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// quarantineDirName is the folder below the root corrupt objects are
+	// moved to, at the same path they had below the root. They are kept
+	// for inspection and never served.
+	quarantineDirName = ".quarantine"
+	defaultScrubInterval = 24 * time.Hour
+)
+
+// verifyPath reads the object at path below the namespace id and checks it
+// against the hash recorded when it was written, at no more than rate
+// bytes per second if rate is set. It fails with ErrCorrupt if the
+// content no longer matches, and with fs.ErrNotExist if no hash was
+// recorded for the object.
+func (s *Store) verifyPath(ctx context.Context, id, path string, rate *rateLimiter) (int64, error){
+	if !fs.ValidPath(path) {
+		return 0, fmt.Errorf("invalid object path (%s)", path)
+	}
+
+	// the hash and the file are taken from the same write of it
+	name := fmt.Sprintf("%s/%s", id, path)
+	unlock := s.locks.acquire(name)
+	meta, err := s.readMeta(name)
+	if err == nil && len(meta.Hash) == 0 {
+		err = fs.ErrNotExist
+	}
+	var file io.ReadCloser
+	if err == nil {
+		_, file, err = s.Storage.Read(name)
+	}
+	unlock()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var r io.Reader = newHashCheckReader(file, meta.Hash)
+	if rate != nil {
+		r = rate.reader(ctx, r)
+	}
+	return io.Copy(io.Discard, contextReader{ctx: ctx, r: r})
+}
+
+// Quarantine moves the object at path below the namespace id out of the
+// store, into the quarantine folder, and drops its metadata and its key
+// from the index. Has no longer reports it afterwards.
+func (s *Store) Quarantine(id, path string) error{
+	if !fs.ValidPath(path) {
+		return fmt.Errorf("invalid object path (%s)", path)
+	}
+
+	name := fmt.Sprintf("%s/%s", id, path)
+	unlock := s.locks.acquire(name)
+	defer unlock()
+
+	meta, _ := s.readMeta(name)
+	size, existed := s.sizeOf(name)
+	account := s.chargedTo(name)
+	if err := s.Storage.Rename(name, fmt.Sprintf("%s/%s", quarantineDirName, name)); err != nil {
+		return err
+	}
+	if existed {
+		s.release(account, size)
+	}
+	s.leaves.Remove(id, path)
+	if err := s.Storage.Delete(metaName(name)); err != nil {
+		return err
+	}
+	if len(meta.Key) > 0 {
+		return s.index.Remove(id, meta.Key)
+	}
+	return nil
+}
+
+// rateLimiter spreads reads out so that no more than rate bytes are read
+// per second across all the readers it hands out.
+type rateLimiter struct{
+	rate int64
+	start time.Time
+	read int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter{
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader{
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+// wait blocks until n more bytes may be read.
+func (l *rateLimiter) wait(ctx context.Context, n int) error{
+	l.read += int64(n)
+	due := l.start.Add(time.Duration(l.read) * time.Second / time.Duration(l.rate))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select{
+	case <- timer.C:
+		return nil
+	case <- ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type limitedReader struct{
+	ctx context.Context
+	r io.Reader
+	limiter *rateLimiter
+}
+
+func (l *limitedReader) Read(b []byte) (int, error){
+	n, err := l.r.Read(b)
+	if waitErr := l.limiter.wait(l.ctx, n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// ScrubResult is what a scrub found out about one corrupt object.
+type ScrubResult struct{
+	ID string
+	Path string
+	// Repaired is set when a good copy was fetched from a peer in place
+	// of the quarantined one. Err says why it was not otherwise.
+	Repaired bool
+	Err string
+}
+
+// ScrubReport sums up a pass of the scrubber over the store.
+type ScrubReport struct{
+	Started time.Time
+	Finished time.Time
+	// Checked objects were read back and compared with their recorded
+	// hash, Bytes is how much was read doing so. Objects written before
+	// hashes were recorded cannot be checked and are Skipped.
+	Checked int
+	Skipped int
+	Bytes int64
+	Corrupt []ScrubResult
+}
+
+// scrubber remembers the report of the last pass and makes sure only one
+// pass runs at a time.
+type scrubber struct{
+	running sync.Mutex
+	lock sync.Mutex
+	last ScrubReport
+}
+
+// scrubLoop scrubs the store every ScrubInterval.
+func (s *FileServer) scrubLoop(){
+	ctx, cancel := s.quitContext()
+	defer cancel()
+
+	ticker := time.NewTicker(s.ScrubInterval)
+	defer ticker.Stop()
+
+	for{
+		select{
+		case <- ticker.C:
+			if _, err := s.Scrub(ctx); err != nil && ctx.Err() == nil{
+				log.Printf("[%s] scrubbing failed: %s", s.Transport.Addr(), err)
+			}
+		case <- ctx.Done():
+			return
+		}
+	}
+}
+
+// Scrub reads back every object in the store at no more than ScrubRate
+// bytes per second and checks it against the hash recorded when it was
+// written. Corrupt objects are quarantined and a good copy is fetched
+// from the peers that hold the same replica. Our own files are restored
+// from their replicas as Get would, by the key recorded with them.
+//
+// A pass that is already running is waited for rather than started
+// again.
+func (s *FileServer) Scrub(ctx context.Context) (ScrubReport, error){
+	s.scrubber.running.Lock()
+	defer s.scrubber.running.Unlock()
+
+	report := ScrubReport{Started: time.Now()}
+	rate := newRateLimiter(s.ScrubRate)
+
+	corrupt := []ScrubResult{}
+	err := s.store.walkObjects(func(id, path string, info StorageInfo) error {
+		n, err := s.store.verifyPath(ctx, id, path, rate)
+		report.Bytes += n
+
+		switch{
+		case err == nil:
+			report.Checked++
+		case errors.Is(err, fs.ErrNotExist):
+			// no hash recorded, or deleted while we were walking
+			report.Skipped++
+		case errors.Is(err, ErrCorrupt):
+			report.Checked++
+			corrupt = append(corrupt, ScrubResult{ID: id, Path: path})
+		default:
+			return err
+		}
+		return nil
+	})
+
+	// the corrupt objects found before a failure are still dealt with
+	for _, result := range corrupt{
+		report.Corrupt = append(report.Corrupt, s.repairObject(ctx, result.ID, result.Path))
+	}
+	report.Finished = time.Now()
+
+	s.scrubber.lock.Lock()
+	s.scrubber.last = report
+	s.scrubber.lock.Unlock()
+
+	return report, err
+}
+
+// LastScrub returns the report of the last finished pass of the scrubber,
+// the zero ScrubReport if there was none yet.
+func (s *FileServer) LastScrub() ScrubReport{
+	s.scrubber.lock.Lock()
+	defer s.scrubber.lock.Unlock()
+
+	return s.scrubber.last
+}
+
+// repairObject quarantines the corrupt object and asks the peers for the
+// replica they hold at the same path, checked against the hash we
+// recorded for it. Nobody else holds our own files as they are, those
+// are fetched back by their key.
+func (s *FileServer) repairObject(ctx context.Context, id, path string) ScrubResult{
+	result := ScrubResult{ID: id, Path: path}
+
+	meta, err := s.store.readMeta(fmt.Sprintf("%s/%s", id, path))
+	if err == nil {
+		err = s.store.Quarantine(id, path)
+	}
+	if err != nil {
+		result.Err = fmt.Sprintf("quarantine: %s", err)
+		return result
+	}
+	log.Printf("[%s] quarantined corrupt object (%s/%s)", s.Transport.Addr(), id, path)
+
+	if id == s.ID {
+		if len(meta.Key) == 0 {
+			result.Err = "the key of the file was not recorded"
+			return result
+		}
+		if err := s.restoreOwnFile(ctx, meta.Key); err != nil {
+			result.Err = err.Error()
+			return result
+		}
+
+		log.Printf("[%s] restored file (%s) from its replicas", s.Transport.Addr(), meta.Key)
+		return ScrubResult{ID: id, Path: path, Repaired: true}
+	}
+
+	leaf := MerkleLeaf{ID: id, Path: path, Hash: meta.Hash, Meta: meta}
+	result.Err = "no peer holds a good copy"
+	for _, peer := range s.peersSupporting(FeatureAntiEntropy){
+		// the owner only holds the file unencrypted under its own key
+		if peer.ID() == id {
+			continue
+		}
+		if err := s.fetchObject(ctx, peer, leaf); err != nil{
+			log.Printf("[%s] could not restore (%s/%s) from (%s): %s", s.Transport.Addr(), id, path, peer.RemoteAddr(), err)
+			continue
+		}
+
+		log.Printf("[%s] restored (%s/%s) from (%s)", s.Transport.Addr(), id, path, peer.RemoteAddr())
+		return ScrubResult{ID: id, Path: path, Repaired: true}
+	}
+	return result
+}
+
+// restoreOwnFile fetches our own file back from its replicas, which Get
+// does whenever we do not hold it.
+func (s *FileServer) restoreOwnFile(ctx context.Context, key string) error{
+	r, err := s.GetContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	if !s.store.Has(s.ID, key) {
+		return fmt.Errorf("file (%s) was not stored again", key)
+	}
+	return nil
+}
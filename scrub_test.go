@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStoreQuarantine(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root: t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	id := generateId()
+	data := []byte("bytes that will rot")
+
+	if _, err := s.Write(id, "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	path := s.pathOf("key")
+	if n, err := s.verifyPath(context.Background(), id, path, nil); err != nil || n != int64(len(data)) {
+		t.Fatalf("want %d verified bytes have %d (%v)", len(data), n, err)
+	}
+
+	fullPath := fmt.Sprintf("%s/%s/%s", s.Root, id, path)
+	if err := os.WriteFile(fullPath, []byte("bytes that will rot!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.verifyPath(context.Background(), id, path, nil); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("want %v have %v", ErrCorrupt, err)
+	}
+
+	if err := s.Quarantine(id, path); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "key") {
+		t.Error("quarantined object is still in the store")
+	}
+	if _, err := s.Hash(id, "key"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want the hash dropped have %v", err)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/%s/%s/%s", s.Root, quarantineDirName, id, path)); err != nil {
+		t.Error(err)
+	}
+
+	// the quarantine is not part of the store
+	err := s.walkObjects(func(id, path string, info StorageInfo) error {
+		return fmt.Errorf("unexpected object (%s/%s)", id, path)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Error("zero rate should not limit")
+	}
+
+	l := newRateLimiter(1000)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.wait(context.Background(), 40); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150 * time.Millisecond {
+		t.Errorf("200 bytes at 1000 bytes per second took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 1000); !errors.Is(err, context.Canceled) {
+		t.Errorf("want %v have %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	segmentFileSuffix = ".seg"
+	segmentIndexFileName = "index.json"
+	defaultMaxSegmentSize = 64 << 20
+	defaultCompactRatio = 0.5
+)
+
+type SegmentStorageOpts struct{
+	// Dir is the folder the segments and their index are kept in.
+	Dir string
+	// MaxSegmentSize is how large a segment grows before a new one is
+	// started. A file larger than that takes up a segment of its own.
+	MaxSegmentSize int64
+	// CompactRatio is the share of a segment that has to be taken up by
+	// replaced and deleted files before it is compacted.
+	CompactRatio float64
+	// CompactInterval is how often the segments are compacted in the
+	// background. Zero leaves it to calls of Compact.
+	CompactInterval time.Duration
+	// Durable syncs the segment after every record, so a file is still
+	// there after a power loss and not just after a crash of the process.
+	Durable bool
+}
+
+// SegmentStorage appends every file to large segment files rather than
+// keeping it as a file of its own, which keeps the number of files on
+// disk down when storing many small objects. Segments are made up of the
+// same checksummed records as a pack, see PackedStorage. Where every file
+// lies is kept in memory and saved to an index whenever the storage is
+// compacted or closed, so it is only read back from the segments written
+// since.
+//
+// Compaction copies the files still in use out of the segments mostly
+// taken up by replaced and deleted ones and removes those segments.
+//
+// Writes and appends are buffered in memory before they are added to a
+// segment.
+type SegmentStorage struct{
+	SegmentStorageOpts
+	lock sync.RWMutex
+	segments map[int]*segment
+	active *segment
+	files map[string]*segmentFile
+	// tombstones holds the segment every file was last deleted or renamed
+	// away in. The record has to outlive compaction while an older
+	// segment may still hold the file, or replaying the segments would
+	// bring the file back.
+	tombstones map[string]int
+	compacting sync.Mutex
+	quitCh chan struct{}
+	wg sync.WaitGroup
+}
+
+type segment struct{
+	id int
+	file *os.File
+	size int64
+	// readers counts the open readers of the segment. A segment that was
+	// compacted away is only closed once they are all done.
+	readers atomic.Int64
+	dropped atomic.Bool
+	closeOnce sync.Once
+}
+
+// segmentFile is where the content of a file lies, and which segment
+// holds the last record that changed it.
+type segmentFile struct{
+	Extents []segmentExtent
+	Size int64
+	ModTime time.Time
+	Last int
+}
+
+type segmentExtent struct{
+	Segment int
+	Offset int64
+	Length int64
+}
+
+// segmentIndex is what the index file holds: where every file lies once
+// the records up to Offset in Segment are applied.
+type segmentIndex struct{
+	Segment int
+	Offset int64
+	Files map[string]*segmentFile
+	Tombstones map[string]int
+}
+
+// OpenSegmentStorage opens the segments in opts.Dir, creating the folder
+// if there is none, and starts compacting them in the background if
+// opts.CompactInterval is set.
+func OpenSegmentStorage(opts SegmentStorageOpts) (*SegmentStorage, error){
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	if opts.CompactRatio <= 0 {
+		opts.CompactRatio = defaultCompactRatio
+	}
+	if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &SegmentStorage{
+		SegmentStorageOpts: opts,
+		segments: make(map[int]*segment),
+		files: make(map[string]*segmentFile),
+		tombstones: make(map[string]int),
+		quitCh: make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		s.closeSegments()
+		return nil, err
+	}
+
+	if opts.CompactInterval > 0 {
+		s.wg.Add(1)
+		go s.compactLoop()
+	}
+	return s, nil
+}
+
+func (s *SegmentStorage) segmentPath(id int) string{
+	return filepath.Join(s.Dir, fmt.Sprintf("%08d%s", id, segmentFileSuffix))
+}
+
+// load opens the segments, reads the index back and replays the records
+// written after it. Without a usable index every segment is replayed.
+func (s *SegmentStorage) load() error{
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	ids := []int{}
+	for _, entry := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), segmentFileSuffix))
+		if err != nil || !strings.HasSuffix(entry.Name(), segmentFileSuffix) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		seg := &segment{id: id, file: file}
+		s.segments[id] = seg
+		fi, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		seg.size = fi.Size()
+	}
+
+	from, offset := 0, int64(0)
+	if index, err := s.readIndex(); err == nil {
+		s.files, s.tombstones = index.Files, index.Tombstones
+		from, offset = index.Segment, index.Offset
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("could not read the segment index, replaying every segment: %s", err)
+	}
+
+	for _, id := range ids {
+		if id < from {
+			continue
+		}
+		start := int64(0)
+		if id == from {
+			start = offset
+		}
+		if err := s.replay(s.segments[id], start); err != nil {
+			return err
+		}
+	}
+
+	if len(ids) == 0 {
+		return s.roll()
+	}
+	s.active = s.segments[ids[len(ids) - 1]]
+	return nil
+}
+
+// readIndex reads the index file, failing if it refers to segments that
+// are gone.
+func (s *SegmentStorage) readIndex() (segmentIndex, error){
+	index := segmentIndex{}
+	b, err := os.ReadFile(filepath.Join(s.Dir, segmentIndexFileName))
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(b, &index); err != nil {
+		return index, err
+	}
+
+	if _, ok := s.segments[index.Segment]; !ok {
+		return index, fmt.Errorf("segment %d is missing", index.Segment)
+	}
+	for name, file := range index.Files {
+		for _, extent := range file.Extents {
+			if _, ok := s.segments[extent.Segment]; !ok {
+				return index, fmt.Errorf("segment %d of (%s) is missing", extent.Segment, name)
+			}
+		}
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]*segmentFile)
+	}
+	if index.Tombstones == nil {
+		index.Tombstones = make(map[string]int)
+	}
+	return index, nil
+}
+
+// replay applies the records of the segment from offset on, cutting the
+// segment off at the first record that is incomplete or does not match
+// its checksum.
+func (s *SegmentStorage) replay(seg *segment, offset int64) error{
+	fi, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	for offset < fi.Size() {
+		record, err := readPackedRecord(io.NewSectionReader(seg.file, offset, fi.Size() - offset), fi.Size() - offset)
+		if err != nil {
+			break
+		}
+		s.apply(seg.id, record, offset + packedHeaderSize + int64(len(record.name)))
+		offset += packedHeaderSize + int64(len(record.name)) + int64(len(record.data))
+	}
+
+	if offset < fi.Size() {
+		if err := seg.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	seg.size = offset
+	return nil
+}
+
+// apply changes the files as the record in the segment says, with the
+// content the record holds at offset in the segment.
+func (s *SegmentStorage) apply(id int, record packedRecord, offset int64){
+	extent := segmentExtent{Segment: id, Offset: offset, Length: int64(len(record.data))}
+	switch record.op {
+	case packedOpWrite:
+		s.files[record.name] = &segmentFile{Extents: []segmentExtent{extent}, Size: extent.Length, ModTime: record.modTime, Last: id}
+		delete(s.tombstones, record.name)
+	case packedOpAppend:
+		file := &segmentFile{}
+		if old, ok := s.files[record.name]; ok {
+			file.Extents = old.truncated(record.at)
+		}
+		file.Extents = append(file.Extents, extent)
+		file.Size = record.at + extent.Length
+		file.ModTime = record.modTime
+		file.Last = id
+		s.files[record.name] = file
+		delete(s.tombstones, record.name)
+	case packedOpRename:
+		file, ok := s.files[record.name]
+		if !ok {
+			return
+		}
+		to := string(record.data)
+		moved := *file
+		moved.Last = id
+		delete(s.files, record.name)
+		s.files[to] = &moved
+		s.tombstones[record.name] = id
+		delete(s.tombstones, to)
+	case packedOpDelete:
+		delete(s.files, record.name)
+		s.tombstones[record.name] = id
+	}
+}
+
+// truncated returns the extents of the first size bytes of the file.
+func (f *segmentFile) truncated(size int64) []segmentExtent{
+	extents := []segmentExtent{}
+	for _, extent := range f.Extents {
+		if size <= 0 {
+			break
+		}
+		extent.Length = min(extent.Length, size)
+		extents = append(extents, extent)
+		size -= extent.Length
+	}
+	return extents
+}
+
+// roll starts a new segment to append to. It is called with the lock
+// held.
+func (s *SegmentStorage) roll() error{
+	id := 1
+	if s.active != nil {
+		id = s.active.id + 1
+	}
+
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR | os.O_CREATE | os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if s.active != nil {
+		// the sealed segment is not written to again
+		if err := s.active.file.Sync(); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+	}
+	if s.Durable {
+		if err := syncDir(s.Dir); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+	}
+
+	seg := &segment{id: id, file: file}
+	s.segments[id] = seg
+	s.active = seg
+	return nil
+}
+
+// add appends the record to the active segment and applies it, starting
+// a new segment first if the active one is full. It is called with the
+// lock held.
+func (s *SegmentStorage) add(record packedRecord) error{
+	b := record.encode()
+	if s.active.size > 0 && s.active.size + int64(len(b)) > s.MaxSegmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	seg := s.active
+	if _, err := seg.file.WriteAt(b, seg.size); err != nil {
+		// what made it into the segment is cut off again
+		seg.file.Truncate(seg.size)
+		return err
+	}
+	if s.Durable {
+		if err := seg.file.Sync(); err != nil {
+			seg.file.Truncate(seg.size)
+			return err
+		}
+	}
+
+	s.apply(seg.id, record, seg.size + packedHeaderSize + int64(len(record.name)))
+	seg.size += int64(len(b))
+	return nil
+}
+
+func (s *SegmentStorage) Has(name string) bool{
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, ok := s.files[name]
+	return ok
+}
+
+func (s *SegmentStorage) Stat(name string) (StorageInfo, error){
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		return StorageInfo{}, fmt.Errorf("stat %s: %w", name, fs.ErrNotExist)
+	}
+	return StorageInfo{Name: name, Size: file.Size, ModTime: file.ModTime}, nil
+}
+
+func (s *SegmentStorage) Read(name string) (int64, io.ReadCloser, error){
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		return 0, nil, fmt.Errorf("open %s: %w", name, fs.ErrNotExist)
+	}
+	return file.Size, s.open(file), nil
+}
+
+// open returns a reader over the extents of the file, which keeps the
+// segments they lie in open until it is closed. It is called with the
+// lock held.
+func (s *SegmentStorage) open(file *segmentFile) *segmentReader{
+	r := &segmentReader{}
+	readers := make([]io.Reader, len(file.Extents))
+	for i, extent := range file.Extents {
+		seg := s.segments[extent.Segment]
+		seg.readers.Add(1)
+		r.segments = append(r.segments, seg)
+		readers[i] = io.NewSectionReader(seg.file, extent.Offset, extent.Length)
+	}
+	r.r = io.MultiReader(readers...)
+	return r
+}
+
+type segmentReader struct{
+	r io.Reader
+	segments []*segment
+	closed bool
+}
+
+func (r *segmentReader) Read(b []byte) (int, error){
+	return r.r.Read(b)
+}
+
+func (r *segmentReader) Close() error{
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	for _, seg := range r.segments {
+		if seg.readers.Add(-1) == 0 && seg.dropped.Load() {
+			seg.close()
+		}
+	}
+	return nil
+}
+
+func (seg *segment) close(){
+	seg.closeOnce.Do(func() {
+		seg.file.Close()
+	})
+}
+
+// drop closes the segment once nobody reads from it any more.
+func (seg *segment) drop(){
+	seg.dropped.Store(true)
+	if seg.readers.Load() == 0 {
+		seg.close()
+	}
+}
+
+func (s *SegmentStorage) Write(name string, r io.Reader) (int64, error){
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return int64(len(data)), s.add(packedRecord{op: packedOpWrite, modTime: time.Now(), name: name, data: data})
+}
+
+func (s *SegmentStorage) Append(name string, offset int64, r io.Reader) (int64, error){
+	if size := s.fileSize(name); size < offset {
+		return 0, errShortFile(offset, size)
+	}
+
+	data, err := io.ReadAll(r)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	size := int64(0)
+	if file, ok := s.files[name]; ok {
+		size = file.Size
+	}
+	if size < offset {
+		return 0, errShortFile(offset, size)
+	}
+	if addErr := s.add(packedRecord{op: packedOpAppend, at: offset, modTime: time.Now(), name: name, data: data}); addErr != nil {
+		return 0, addErr
+	}
+	return int64(len(data)), err
+}
+
+func (s *SegmentStorage) fileSize(name string) int64{
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if file, ok := s.files[name]; ok {
+		return file.Size
+	}
+	return 0
+}
+
+func (s *SegmentStorage) Rename(from, to string) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.files[from]; !ok {
+		return fmt.Errorf("rename %s: %w", from, fs.ErrNotExist)
+	}
+	return s.add(packedRecord{op: packedOpRename, modTime: time.Now(), name: from, data: []byte(to)})
+}
+
+func (s *SegmentStorage) Delete(name string) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		return nil
+	}
+	return s.add(packedRecord{op: packedOpDelete, modTime: time.Now(), name: name})
+}
+
+// List calls fn without holding on to the storage, fn may change it.
+func (s *SegmentStorage) List(prefix string, fn func(StorageInfo) error) error{
+	s.lock.RLock()
+	infos := []StorageInfo{}
+	for name, file := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, StorageInfo{Name: name, Size: file.Size, ModTime: file.ModTime})
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear removes every segment along with the index and starts over.
+func (s *SegmentStorage) Clear() error{
+	s.compacting.Lock()
+	defer s.compacting.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.Remove(filepath.Join(s.Dir, segmentIndexFileName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for id, seg := range s.segments {
+		seg.drop()
+		if err := os.Remove(s.segmentPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		delete(s.segments, id)
+	}
+
+	s.files = make(map[string]*segmentFile)
+	s.tombstones = make(map[string]int)
+	s.active = nil
+	return s.roll()
+}
+
+// SegmentStats is how much of the segments is taken up by files still in
+// use.
+type SegmentStats struct{
+	Segments int
+	Files int
+	Size int64
+	Live int64
+}
+
+func (s *SegmentStorage) Stats() SegmentStats{
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stats := SegmentStats{Segments: len(s.segments), Files: len(s.files)}
+	for _, seg := range s.segments {
+		stats.Size += seg.size
+	}
+	for _, live := range s.liveBytes() {
+		stats.Live += live
+	}
+	return stats
+}
+
+// liveBytes returns how many bytes of every segment belong to the
+// records of files still in use. It is called with the lock held.
+func (s *SegmentStorage) liveBytes() map[int]int64{
+	live := map[int]int64{}
+	for name, file := range s.files {
+		for _, extent := range file.Extents {
+			live[extent.Segment] += packedHeaderSize + int64(len(name)) + extent.Length
+		}
+	}
+	return live
+}
+
+func (s *SegmentStorage) compactLoop(){
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <- ticker.C:
+			if err := s.Compact(); err != nil {
+				log.Printf("compacting the segments in (%s) failed: %s", s.Dir, err)
+			}
+		case <- s.quitCh:
+			return
+		}
+	}
+}
+
+// Compact rewrites the files still in use out of every sealed segment
+// that is at least CompactRatio replaced or deleted files, and removes
+// those segments. Reads and writes carry on while it runs.
+func (s *SegmentStorage) Compact() error{
+	s.compacting.Lock()
+	defer s.compacting.Unlock()
+
+	s.lock.RLock()
+	live := s.liveBytes()
+	victims := []int{}
+	for id, seg := range s.segments {
+		if id == s.active.id {
+			continue
+		}
+		if float64(seg.size - live[id]) >= s.CompactRatio * float64(seg.size) {
+			victims = append(victims, id)
+		}
+	}
+	s.lock.RUnlock()
+	sort.Ints(victims)
+
+	for _, id := range victims {
+		if err := s.compactSegment(id); err != nil {
+			return err
+		}
+	}
+	if len(victims) == 0 {
+		return nil
+	}
+
+	// an index that still refers to a removed segment is not used, the
+	// segments are replayed instead, so it is saved once and without
+	// holding up writes
+	s.lock.RLock()
+	index := s.snapshotIndex()
+	s.lock.RUnlock()
+	return s.saveIndex(index)
+}
+
+// compactSegment copies every file that lies in the segment, or was last
+// changed by a record in it, to the active segment and removes it.
+func (s *SegmentStorage) compactSegment(id int) error{
+	s.lock.RLock()
+	names := s.usersOf(id)
+	s.lock.RUnlock()
+
+	// the files are copied one at a time so the storage is not held up
+	// for long
+	for _, name := range names {
+		s.lock.Lock()
+		err := s.relocate(name, id)
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// files appended to while we were copying
+	for _, name := range s.usersOf(id) {
+		if err := s.relocate(name, id); err != nil {
+			return err
+		}
+	}
+
+	older := false
+	for other := range s.segments {
+		older = older || other < id
+	}
+	for name, tombstone := range s.tombstones {
+		if tombstone != id {
+			continue
+		}
+		if !older {
+			delete(s.tombstones, name)
+			continue
+		}
+		if err := s.add(packedRecord{op: packedOpDelete, modTime: time.Now(), name: name}); err != nil {
+			return err
+		}
+	}
+
+	// the copies have to be on disk before the only other copy is gone
+	if err := s.active.file.Sync(); err != nil {
+		return err
+	}
+
+	seg := s.segments[id]
+	delete(s.segments, id)
+	seg.drop()
+	return os.Remove(s.segmentPath(id))
+}
+
+// usersOf returns the files that need the segment. It is called with the
+// lock held.
+func (s *SegmentStorage) usersOf(id int) []string{
+	names := []string{}
+	for name, file := range s.files {
+		if file.uses(id) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (f *segmentFile) uses(id int) bool{
+	if f.Last == id {
+		return true
+	}
+	for _, extent := range f.Extents {
+		if extent.Segment == id {
+			return true
+		}
+	}
+	return false
+}
+
+// relocate writes the file anew to the active segment if it still needs
+// the segment. It is called with the lock held.
+func (s *SegmentStorage) relocate(name string, id int) error{
+	file, ok := s.files[name]
+	if !ok || !file.uses(id) {
+		return nil
+	}
+
+	r := s.open(file)
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return s.add(packedRecord{op: packedOpWrite, modTime: file.ModTime, name: name, data: data})
+}
+
+// snapshotIndex returns where every file lies. The files are replaced
+// rather than changed, so copying the maps is enough. It is called with
+// the lock held.
+func (s *SegmentStorage) snapshotIndex() segmentIndex{
+	index := segmentIndex{
+		Segment: s.active.id,
+		Offset: s.active.size,
+		Files: make(map[string]*segmentFile, len(s.files)),
+		Tombstones: make(map[string]int, len(s.tombstones)),
+	}
+	for name, file := range s.files {
+		index.Files[name] = file
+	}
+	for name, id := range s.tombstones {
+		index.Tombstones[name] = id
+	}
+	return index
+}
+
+// saveIndex replaces the index file, a crash half way through leaves the
+// old one in place.
+func (s *SegmentStorage) saveIndex(index segmentIndex) error{
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.Dir, segmentIndexFileName)
+	f, err := os.CreateTemp(s.Dir, "." + segmentIndexFileName + tempFileMarker + "*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err == nil {
+		err = syncDir(s.Dir)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Close stops compacting, saves the index and closes the segments. The
+// storage cannot be used afterwards.
+func (s *SegmentStorage) Close() error{
+	close(s.quitCh)
+	s.wg.Wait()
+
+	s.compacting.Lock()
+	defer s.compacting.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.active.file.Sync()
+	if err == nil {
+		err = s.saveIndex(s.snapshotIndex())
+	}
+	s.closeSegments()
+	return err
+}
+
+func (s *SegmentStorage) closeSegments(){
+	for _, seg := range s.segments {
+		seg.drop()
+	}
+}
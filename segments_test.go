@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentStorageCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := SegmentStorageOpts{Dir: dir, MaxSegmentSize: 1024}
+	s, err := OpenSegmentStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := writeStorageFile(s, fmt.Sprintf("file/%d", i), []byte(fmt.Sprintf("content of %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a reader open while its segment is compacted away keeps reading it
+	_, r, err := s.Read("file/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if i % 10 != 0 {
+			s.Delete(fmt.Sprintf("file/%d", i))
+		}
+	}
+	s.Rename("file/10", "renamed/10")
+
+	before := s.Stats()
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after := s.Stats()
+	if after.Size >= before.Size / 2 || after.Segments >= before.Segments {
+		t.Errorf("compaction only shrank %+v to %+v", before, after)
+	}
+	if b, err := io.ReadAll(r); err != nil || string(b) != "content of 0" {
+		t.Errorf("want content of 0 have %s (%v)", b, err)
+	}
+	r.Close()
+
+	check := func(s *SegmentStorage) {
+		t.Helper()
+
+		if have := s.Stats().Files; have != 10 {
+			t.Errorf("want 10 files have %d", have)
+		}
+		if have := readAll(t, s, "renamed/10"); have != "content of 10" {
+			t.Errorf("want content of 10 have %s", have)
+		}
+		for i := 0; i < 100; i += 10 {
+			if i != 10 && readAll(t, s, fmt.Sprintf("file/%d", i)) != fmt.Sprintf("content of %d", i) {
+				t.Errorf("file/%d was not kept", i)
+			}
+		}
+	}
+	check(s)
+
+	// reopened from the index, and by replaying the segments without it
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSegmentStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s)
+	s.Close()
+
+	if err := os.Remove(filepath.Join(dir, segmentIndexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSegmentStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(s)
+}
+
+func TestSegmentStorageKeepsDeletes(t *testing.T) {
+	dir := t.TempDir()
+	opts := SegmentStorageOpts{Dir: dir, MaxSegmentSize: 256}
+	s, err := OpenSegmentStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first segment stays mostly in use, so only the second one with
+	// the delete in it is compacted
+	writeStorageFile(s, "deleted", make([]byte, 16))
+	writeStorageFile(s, "kept", make([]byte, 150))
+	writeStorageFile(s, "garbage", make([]byte, 150))
+	s.Delete("deleted")
+	s.Delete("garbage")
+	writeStorageFile(s, "active", make([]byte, 200))
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.segmentPath(1)); err != nil {
+		t.Fatalf("the first segment was compacted: %v", err)
+	}
+	if _, err := os.Stat(s.segmentPath(2)); err == nil {
+		t.Fatal("the second segment was not compacted")
+	}
+	s.Close()
+
+	// without the index the delete still has to win over the write in
+	// the first segment
+	if err := os.Remove(filepath.Join(dir, segmentIndexFileName)); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSegmentStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Has("deleted") || s.Has("garbage") {
+		t.Error("deleted file came back")
+	}
+	if !s.Has("kept") || !s.Has("active") {
+		t.Error("file was lost")
+	}
+}
+
+func TestSegmentStorageStaleIndex(t *testing.T) {
+	dir := t.TempDir()
+	opts := SegmentStorageOpts{Dir: dir, MaxSegmentSize: 256}
+	s, err := OpenSegmentStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		writeStorageFile(s, fmt.Sprintf("file/%d", i), make([]byte, 100))
+	}
+	s.Close()
+	stale, err := os.ReadFile(filepath.Join(dir, segmentIndexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenSegmentStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 20; i++ {
+		s.Delete(fmt.Sprintf("file/%d", i))
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// a crash before the index was saved leaves the one from before the
+	// compaction, which refers to segments that are gone
+	if err := os.WriteFile(filepath.Join(dir, segmentIndexFileName), stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenSegmentStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if have := s.Stats().Files; have != 1 || !s.Has("file/0") {
+		t.Errorf("want only file/0 have %d files", have)
+	}
+}
@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
@@ -20,170 +26,1286 @@ type FileServerOpts struct{
 	PathTransformFunc PathTransformFunc
 	Transport p2p.Transport
 	BootstrapNodes []string
+	// RequestTimeout bounds how long Get waits for peers to answer a
+	// request or to start streaming a file before giving up on them.
+	RequestTimeout time.Duration
+	// ReadConsistency and WriteConsistency are the consistency levels
+	// Get and Store use. They default to ConsistencyAny.
+	ReadConsistency Consistency
+	WriteConsistency Consistency
+	// ReplicationFactor is the number of peers each file is replicated
+	// to, picked by consistent hashing over the peers' node IDs. Zero
+	// replicates every file to every peer.
+	ReplicationFactor int
+	// ReconnectBackoff is how long to wait before redialing a bootstrap
+	// node after a failed attempt, doubling after every further failure
+	// up to MaxReconnectBackoff.
+	ReconnectBackoff time.Duration
+	MaxReconnectBackoff time.Duration
+	// TombstoneTTL is how long a delete is remembered so it can be
+	// passed on to peers that were offline when it happened. A peer
+	// that stays away for longer may hand the deleted file back out.
+	TombstoneTTL time.Duration
+	// AntiEntropyInterval is how often the replicas we hold are
+	// compared with every peer's to catch up on writes we missed.
+	AntiEntropyInterval time.Duration
+	// HintTTL is how long a disconnected node keeps its place on the
+	// ring, with the writes it misses kept as hints and replayed once it
+	// reconnects. MaxHintBytes caps the total size of the hinted files.
+	HintTTL time.Duration
+	MaxHintBytes int64
+	// DataShards and ParityShards switch from replicating every file to
+	// erasure coding it: the file is split into DataShards shards plus
+	// ParityShards parity shards placed on different peers, and can be
+	// read back from any DataShards of them. Zero DataShards replicates.
+	DataShards int
+	ParityShards int
+	// Chunking replicates files as a manifest of content defined chunks,
+	// so peers only receive the chunks they do not hold yet and store
+	// every chunk once however many files it is part of. It is ignored
+	// when erasure coding.
+	Chunking bool
+	// StagingTTL is how long a transfer that broke off is kept around to
+	// be resumed.
+	StagingTTL time.Duration
+	// Durable makes the store sync the folder a file is written to as
+	// well as the file itself, see StoreOpts.
+	Durable bool
+	// Storage is where the store keeps its files, a DiskStorage below
+	// StorageRoot if it is not set. A MemoryStorage runs the server
+	// without touching the disk.
+	Storage Storage
+	// ScrubInterval is how often every object we hold is read back and
+	// checked against its hash, reading no more than ScrubRate bytes per
+	// second while doing so. Zero ScrubRate does not limit the rate.
+	ScrubInterval time.Duration
+	ScrubRate int64
+	// Quotas caps what the store holds for every node by its ID, ours
+	// included. The nodes not listed are capped by DefaultQuota. Replicas
+	// that do not fit are refused.
+	Quotas map[string]Quota
+	DefaultQuota Quota
+	// DiskReserve is how many bytes are kept free on the disk the store
+	// is on. Replicas that would eat into it are refused.
+	DiskReserve int64
 }
 
+const (
+	defaultRequestTimeout = 2 * time.Second
+	defaultReconnectBackoff = 500 * time.Millisecond
+	defaultMaxReconnectBackoff = 30 * time.Second
+)
+
 type FileServer struct{
 	FileServerOpts
 
 	peerLock sync.Mutex
 	peers map[string]p2p.Peer
+	// dialAttempts counts the failed attempts to reach each bootstrap
+	// node since we were last connected to it.
+	dialAttempts map[string]int
+	// ring places keys on the node IDs of the connected peers and of
+	// the ones that went down less than HintTTL ago
+	ring *HashRing
+	// downNodes holds the nodes that are still on the ring while down,
+	// with the timer that takes them off
+	downNodes map[string]*time.Timer
 	store *Store
+	tombstones *tombstoneSet
+	hints *hintSet
+	chunkRefs *chunkRefSet
+	// erasure is set when files are erasure coded instead of replicated
+	erasure *ReedSolomon
+	scrubber scrubber
 	quitCh chan struct{}
+	// stoppedCh is closed once the transport of a started server is
+	// closed
+	started atomic.Bool
+	stoppedCh chan struct{}
+
+	// requests holds the pending requests waiting for peers to
+	// answer, keyed by request ID.
+	requestLock sync.Mutex
+	requests map[string]chan peerResponse
+
+	// handlers holds the messages of every peer that wait for the ones
+	// before them to be handled, keyed by the address of the peer.
+	handlerLock sync.Mutex
+	handlers map[string][]*Message
+
+	// trees holds the Merkle trees built for anti-entropy, keyed by the
+	// namespaces left out, until the leaves, tombstones or chunk
+	// references they were built from change.
+	treeLock sync.Mutex
+	treeVersion [3]uint64
+	trees map[string]*MerkleTree
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer{
 	storeOpts := StoreOpts{
 		Root: opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		Durable: opts.Durable,
+		Storage: opts.Storage,
+		Quotas: opts.Quotas,
+		DefaultQuota: opts.DefaultQuota,
 	}
 
 	if len(opts.ID) == 0{
 		opts.ID = generateId()
 	}
 
+	if opts.RequestTimeout == 0{
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+
+	if opts.ReconnectBackoff == 0{
+		opts.ReconnectBackoff = defaultReconnectBackoff
+	}
+
+	if opts.MaxReconnectBackoff == 0{
+		opts.MaxReconnectBackoff = defaultMaxReconnectBackoff
+	}
+
+	if opts.TombstoneTTL == 0{
+		opts.TombstoneTTL = defaultTombstoneTTL
+	}
+
+	if opts.AntiEntropyInterval == 0{
+		opts.AntiEntropyInterval = defaultAntiEntropyInterval
+	}
+
+	if opts.HintTTL == 0{
+		opts.HintTTL = defaultHintTTL
+	}
+
+	if opts.MaxHintBytes == 0{
+		opts.MaxHintBytes = defaultMaxHintBytes
+	}
+
+	if opts.StagingTTL == 0{
+		opts.StagingTTL = defaultStagingTTL
+	}
+
+	if opts.ScrubInterval == 0{
+		opts.ScrubInterval = defaultScrubInterval
+	}
+
+	store := NewStore(storeOpts)
+	tombstones, err := loadTombstones(store.Storage, tombstoneFileName, opts.TombstoneTTL)
+	if err != nil{
+		log.Printf("could not load tombstones, starting without them: %s", err)
+	}
+
+	hints, err := loadHints(store.Storage, hintFileName, opts.HintTTL, opts.MaxHintBytes)
+	if err != nil{
+		log.Printf("could not load hints, starting without them: %s", err)
+	}
+
+	chunkRefs, err := loadChunkRefs(store.Storage, chunkRefsFileName)
+	if err != nil{
+		log.Printf("could not load chunk references, starting without them: %s", err)
+	}
+
+	var erasure *ReedSolomon
+	if opts.DataShards > 0{
+		// a bad configuration is reported by Start
+		erasure, _ = NewReedSolomon(opts.DataShards, opts.ParityShards)
+	}
+
 	return &FileServer{
 		FileServerOpts: opts,
-		store: NewStore(storeOpts),
+		erasure: erasure,
+		store: store,
+		tombstones: tombstones,
+		hints: hints,
+		chunkRefs: chunkRefs,
+		downNodes: make(map[string]*time.Timer),
 		quitCh: make(chan struct{}),
+		stoppedCh: make(chan struct{}),
 		peers: make(map[string]p2p.Peer),
+		dialAttempts: make(map[string]int),
+		ring: NewHashRing(defaultVirtualNodes),
+		requests: make(map[string]chan peerResponse),
+		handlers: make(map[string][]*Message),
+		trees: make(map[string]*MerkleTree),
 	}
 }
 
+// Features the file server negotiates with its peers. Messages that
+// belong to a feature are only sent to peers that support it, so nodes
+// can be upgraded one at a time.
+const (
+	// FeatureGetFile covers MessageGetFile, MessageGetFileResponse
+	// and MessageFetchFile.
+	FeatureGetFile p2p.Feature = 1 << iota
+	// FeatureStoreAck covers MessageStoreFileAck.
+	FeatureStoreAck
+	// FeatureDeleteFile covers MessageDeleteFile.
+	FeatureDeleteFile
+	// FeatureAntiEntropy covers the MessageSync messages and
+	// MessageFetchObject.
+	FeatureAntiEntropy
+	// FeatureChunks covers MessageHasChunks, MessageHasChunksResponse
+	// and chunked replicas.
+	FeatureChunks
+	// FeatureResume covers MessageGetStaged, MessageGetStagedResponse
+	// and transfers that start at an offset.
+	FeatureResume
+	// FeatureList covers MessageListFiles and MessageListFilesResponse.
+	FeatureList
+)
+
+// ServerFeatures are the features this build of the file server supports.
+// The server's transport should advertise them during the handshake.
+const ServerFeatures = FeatureGetFile | FeatureStoreAck | FeatureDeleteFile | FeatureAntiEntropy | FeatureChunks | FeatureResume | FeatureList
+
 type Message struct{
 	Payload any
 }
 
+// MessageStoreFile tells a peer to store the file sent over the stream
+// with the given ID. Peers that support FeatureStoreAck answer with a
+// MessageStoreFileAck carrying the same RequestID.
 type MessageStoreFile struct{
+	RequestID string
+	ID string
+	Key string
+	Size int64
+	StreamID uint32
+	// Hash is the SHA-256 of the whole replica. When it is set the peer
+	// stages what it receives and only stores the replica once all of
+	// it arrived, so an interrupted transfer can be resumed at Offset,
+	// with Size the bytes that are left.
+	Hash []byte
+	Offset int64
+	// ChunkCount is set when the file is the manifest of a chunked file,
+	// to the number of chunks it refers to. Their IDs are sent over the
+	// stream ahead of the manifest, a list of all of them does not fit
+	// in a message for large files.
+	ChunkCount int
+	// Meta is the owner's metadata of the file, stored along with the
+	// replica.
+	Meta ObjectMeta
+}
+
+// MessageStoreFileAck reports whether a peer persisted a file. Err is
+// empty on success.
+type MessageStoreFileAck struct{
+	RequestID string
+	Err string
+}
+
+// MessageDeleteFile passes tombstones on to a peer, which drops its copy
+// of every file that was deleted after it was written.
+type MessageDeleteFile struct{
+	Tombstones []Tombstone
+}
+
+// send gob encodes the message and hands it to the peer, which frames it
+// for the wire.
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error{
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return peer.Send(buf.Bytes())
+}
+
+// broadcast sends the message to every peer, carrying on past
+// peers that fail so one bad connection does not hold up the rest.
+func (s *FileServer) broadcast(msg *Message) error{
+	var errs []error
+	for _, peer := range s.peerList(){
+		if err := s.send(peer, msg); err != nil{
+			errs = append(errs, fmt.Errorf("sending to (%s): %w", peer.RemoteAddr(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *FileServer) peer(addr string) (p2p.Peer, bool){
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// peersSupporting returns the peers we can send the feature's messages to.
+func (s *FileServer) peersSupporting(feature p2p.Feature) []p2p.Peer{
+	peers := []p2p.Peer{}
+	for _, peer := range s.peerList(){
+		if peer.Supports(feature){
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// splitReplicaPeers splits the peers into those responsible for the key
+// and the rest. Every peer is responsible when no replication factor
+// is configured.
+func (s *FileServer) splitReplicaPeers(key string, peers []p2p.Peer) ([]p2p.Peer, []p2p.Peer){
+	if s.ReplicationFactor <= 0{
+		return peers, nil
+	}
+
+	responsibleIDs := map[string]bool{}
+	for _, id := range s.ring.Lookup(hashKey(key), s.ReplicationFactor){
+		responsibleIDs[id] = true
+	}
+
+	responsible, others := []p2p.Peer{}, []p2p.Peer{}
+	for _, peer := range peers{
+		if responsibleIDs[peer.ID()]{
+			responsible = append(responsible, peer)
+			// a node connected twice only needs one copy
+			delete(responsibleIDs, peer.ID())
+		} else {
+			others = append(others, peer)
+		}
+	}
+
+	return responsible, others
+}
+
+func (s *FileServer) peerList() []p2p.Peer{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers{
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// MessageGetFile asks a peer whether it holds a file. The peer answers
+// with a MessageGetFileResponse carrying the same RequestID.
+type MessageGetFile struct{
+	RequestID string
 	ID string
 	Key string
+}
+
+type MessageGetFileResponse struct{
+	RequestID string
+	Found bool
 	Size int64
+	// Hash is the SHA-256 of the replica as stored, empty if the peer
+	// does not report one.
+	Hash []byte
+	// Chunked is set when the replica is the manifest of a chunked file.
+	Chunked bool
+	// Meta is the metadata stored along with the replica.
+	Meta ObjectMeta
+}
+
+// MessageFetchFile asks a peer that answered positively to send the file
+// back over the stream with the given ID, starting at Offset.
+type MessageFetchFile struct{
+	RequestID string
+	ID string
+	Key string
+	StreamID uint32
+	Offset int64
+}
+
+// peerResponse is a peer's response to one of our requests.
+type peerResponse struct{
+	from string
+	payload any
+}
+
+// registerRequest routes the responses carrying the request ID to the
+// returned channel until the returned func is called.
+func (s *FileServer) registerRequest(requestID string, size int) (chan peerResponse, func()){
+	respCh := make(chan peerResponse, size)
+
+	s.requestLock.Lock()
+	s.requests[requestID] = respCh
+	s.requestLock.Unlock()
+
+	return respCh, func ()  {
+		s.requestLock.Lock()
+		delete(s.requests, requestID)
+		s.requestLock.Unlock()
+	}
+}
+
+// deliverResponse hands a response to the request waiting on it. Late
+// responses to requests that already completed or timed out are dropped.
+func (s *FileServer) deliverResponse(requestID string, from string, payload any){
+	s.requestLock.Lock()
+	defer s.requestLock.Unlock()
+
+	respCh, ok := s.requests[requestID]
+	if !ok{
+		return
+	}
+
+	select{
+	case respCh <- peerResponse{from: from, payload: payload}:
+	default:
+	}
+}
+
+func (s *FileServer) Get(key string)(io.Reader, error){
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get but gives up once ctx is done, resetting the
+// stream the file is being received on and dropping what was received.
+func (s *FileServer) GetContext(ctx context.Context, key string)(io.Reader, error){
+	return s.GetWithOptions(ctx, key, ReadOptions{Consistency: s.ReadConsistency})
+}
+
+// GetWithOptions is like GetContext but only returns the file once as
+// many replicas as the consistency level asks for confirm they hold it.
+func (s *FileServer) GetWithOptions(ctx context.Context, key string, opts ReadOptions)(io.Reader, error){
+	peers := s.peersSupporting(FeatureGetFile)
+	required := opts.Consistency.required(s.replicaCount(len(peers)))
+	local := s.store.Has(s.ID,key)
+
+	// erasure coded files have no replicas to confirm our copy with
+	if local && (required == 0 || s.erasure != nil){
+	fmt.Printf("[%s]serving file (%s) from local disk\n", s.Transport.Addr(), key)
+
+		_, r, err :=s.readOwn(key)
+		return r, err
+	}
+
+	// replicas are counted as for writes, where our own copy is not one
+	// of them, and we need at least one to read the file from
+	need := max(required, 1)
+
+	if !local{
+		if _, ok := s.tombstones.Get(s.ID, hashKey(key)); ok{
+			return nil, fmt.Errorf("[%s] file (%s) was deleted", s.Transport.Addr(), key)
+		}
+
+		fmt.Printf("[%s]don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+
+		if s.erasure != nil{
+			return s.getErasureCoded(ctx, key)
+		}
+	}
+
+	// ask the nodes responsible for the key first and only fall back to
+	// everybody else if none of them has it. Confirmations from several
+	// replicas have to come out of a single round.
+	responsible, others := s.splitReplicaPeers(key, peers)
+	rounds := [][]p2p.Peer{responsible, others}
+	if required > 1{
+		rounds = [][]p2p.Peer{peers}
+	}
+
+	var err error
+	for _, round := range rounds{
+		if len(round) == 0{
+			continue
+		}
+
+		var r io.Reader
+		r, err = s.getFromPeers(ctx, key, round, need, !local)
+		if err == nil || ctx.Err() != nil{
+			return r, err
+		}
+	}
+
+	if err == nil{
+		err = fmt.Errorf("[%s] file (%s) could not be found on the network", s.Transport.Addr(), key)
+	}
+	return nil, err
+}
+
+// replicaCount returns how many peers a file is meant to be replicated to.
+func (s *FileServer) replicaCount(peers int) int{
+	if s.ReplicationFactor > 0{
+		return s.ReplicationFactor
+	}
+	return peers
+}
+
+// getFromPeers asks the peers for the file and waits until need of them
+// confirm they hold the same version of it: the one matching our own copy
+// if we have it. Unless we do, the file is then fetched from one of them.
+// Once the file is returned, or found to be held by too few replicas
+// while we have our own copy, the remaining answers are collected in the
+// background to repair the replicas that are missing or differ.
+func (s *FileServer) getFromPeers(ctx context.Context, key string, peers []p2p.Peer, need int, fetch bool)(io.Reader, error){
+	requestID := generateId()
+	respCh, done := s.registerRequest(requestID, len(peers))
+	repairing := false
+	defer func ()  {
+		if !repairing{
+			done()
+		}
+	}()
+
+	var own *replicaHashes
+	if !fetch{
+		hashes, err := s.ownReplicaHashes(key)
+		if err != nil{
+			return nil, err
+		}
+		own = &hashes
+	}
+
+	msg := Message{
+		Payload: MessageGetFile{
+			RequestID: requestID,
+			ID: s.ID,
+			Key: hashKey(key),
+		},
+	}
+
+	asked := []p2p.Peer{}
+	for _, peer := range peers{
+		if err := s.send(peer, &msg); err != nil{
+			log.Printf("[%s] could not ask (%s) for file (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), key, err)
+			continue
+		}
+		asked = append(asked, peer)
+	}
+
+	timeout := time.NewTimer(s.RequestTimeout)
+	defer timeout.Stop()
+
+	responses := map[string]MessageGetFileResponse{}
+	// the peers holding each version of the file, by its hash
+	versions := map[string][]string{}
+	tried := map[string]bool{}
+	confirmed := 0
+	for len(responses) < len(asked){
+		select{
+		case resp := <- respCh:
+			msg, ok := resp.payload.(MessageGetFileResponse)
+			if !ok{
+				continue
+			}
+			responses[resp.from] = msg
+			if !msg.Found{
+				continue
+			}
+
+			version := string(msg.Hash)
+			if own != nil{
+				if !own.matches(msg){
+					continue
+				}
+				version = ""
+			}
+			found := append(versions[version], resp.from)
+			versions[version] = found
+			confirmed = max(confirmed, len(found))
+			if len(found) < need{
+				continue
+			}
+
+			if !fetch{
+				_ ,r, err := s.readOwn(key)
+				if err == nil{
+					repairing = true
+					go s.readRepair(key, asked, responses, "", respCh, done)
+				}
+				return r, err
+			}
+
+			for _, from := range found{
+				if tried[from]{
+					continue
+				}
+				tried[from] = true
+
+				if err := s.fetchFile(ctx, from, requestID, key, responses[from]); err != nil{
+					if ctx.Err() != nil{
+						return nil, ctx.Err()
+					}
+					log.Printf("[%s] fetching file (%s) from (%s) failed: %s", s.Transport.Addr(), key, from, err)
+					continue
+				}
+
+				_ ,r, err := s.readOwn(key)
+				if err == nil{
+					repairing = true
+					go s.readRepair(key, asked, responses, from, respCh, done)
+				}
+				return r, err
+			}
+		case <- timeout.C:
+			return nil, fmt.Errorf("[%s] timed out waiting for peers to answer request for file (%s)", s.Transport.Addr(), key)
+		case <- ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if need > 1 && confirmed < need{
+		// our copy is the version every replica should hold
+		if !fetch{
+			repairing = true
+			go s.readRepair(key, asked, responses, "", respCh, done)
+		}
+		return nil, fmt.Errorf("%w: only %d of the %d replicas needed hold the same version of file (%s)", ErrConsistencyNotMet, confirmed, need, key)
+	}
+
+	return nil, fmt.Errorf("[%s] file (%s) could not be found on the network", s.Transport.Addr(), key)
+}
+
+// fetchFile opens a stream to the peer, asks it to send the file over
+// that stream and writes what it receives to disk. What the peer sends
+// is rejected unless it matches the hash the peer announced.
+func (s *FileServer) fetchFile(ctx context.Context, from string, requestID string, key string, resp MessageGetFileResponse) error{
+	if resp.Chunked{
+		return s.fetchChunkedFile(ctx, from, requestID, key, resp.Hash, ownMeta(resp.Meta))
+	}
+	if peer, ok := s.peer(from); ok && peer.Supports(FeatureResume) && len(resp.Hash) > 0{
+		if err := s.fetchStaged(ctx, from, requestID, key, resp); err != nil{
+			return err
+		}
+		return s.setChunkRefs(s.ID, key, nil)
+	}
+
+	request := func(streamID uint32) any{
+		return MessageFetchFile{
+			RequestID: requestID,
+			ID: s.ID,
+			Key: hashKey(key),
+			StreamID: streamID,
+		}
+	}
+
+	err := s.fetchOverStream(ctx, from, request, func(r io.Reader) (int64, error){
+		if len(resp.Hash) > 0{
+			r = newHashCheckReader(r, resp.Hash)
+		}
+		return s.store.WriteDecryptWithMeta(ctx, s.EncKey,s.ID, key, r, ownMeta(resp.Meta))
+	})
+	if err != nil{
+		return err
+	}
+	// our copy is whole now, whatever it was before
+	return s.setChunkRefs(s.ID, key, nil)
+}
+
+// ownMeta returns the metadata to store our own copy of a file with,
+// given the metadata of a replica of it.
+func ownMeta(replica ObjectMeta) ObjectMeta{
+	meta := replica.userMeta()
+	meta.OwnerKey = nil
+	meta.OwnerHash = nil
+	return meta
+}
+
+// replicaMeta returns the metadata replicas of our file are stored with:
+// the metadata of our own copy, with the key and hash encrypted. The
+// replicas are sent with as much of it as can be had.
+func (s *FileServer) replicaMeta(key string) ObjectMeta{
+	own, err := s.store.Stat(s.ID, key)
+	if err != nil{
+		log.Printf("[%s] sending file (%s) without its metadata: %s", s.Transport.Addr(), key, err)
+	}
+	meta := own.userMeta()
+
+	meta.OwnerKey, err = encryptDeterministic(s.EncKey, []byte(key))
+	if err == nil && len(own.Hash) > 0{
+		meta.OwnerHash, err = encryptDeterministic(s.EncKey, own.Hash)
+	}
+	if err != nil{
+		log.Printf("[%s] sending file (%s) without its key: %s", s.Transport.Addr(), key, err)
+	}
+	return meta
+}
+
+// Stat returns the metadata of our own copy of the file. The Size of a
+// file kept as a manifest is that of the file, not of the manifest.
+func (s *FileServer) Stat(key string) (ObjectMeta, error){
+	meta, err := s.store.Stat(s.ID, key)
+	if err != nil || !s.chunkRefs.Has(s.ID, key){
+		return meta, err
+	}
+
+	_, r, err := s.store.readStream(s.ID, key)
+	if err != nil{
+		return meta, err
+	}
+	defer r.Close()
+
+	refs, err := s.readManifest(r)
+	if err != nil{
+		return meta, err
+	}
+	meta.Size = 0
+	for _, ref := range refs{
+		meta.Size += ref.Size
+	}
+	return meta, nil
+}
+
+// fetchOverStream opens a stream to the peer, sends it the request built
+// for that stream and hands what the peer sends back to write.
+func (s *FileServer) fetchOverStream(ctx context.Context, from string, request func(streamID uint32) any, write func(io.Reader) (int64, error)) error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
+	}
+
+	stream, err := peer.OpenStream()
+	if err != nil{
+		return err
+	}
+	defer stream.Close()
+
+	stop := context.AfterFunc(ctx, func ()  {
+		stream.Reset()
+	})
+	defer stop()
+
+	if err := s.send(peer, &Message{Payload: request(stream.ID())}); err != nil{
+		stream.Reset()
+		return err
+	}
+
+	// the peer might have lost the file since answering, so don't wait
+	// for it to start sending any longer than for the answer itself.
+	timer := time.AfterFunc(s.RequestTimeout, func ()  {
+		stream.Reset()
+	})
+
+	// first, read the file size so we can limit the amount of bytes we read
+	// from the stream instead of hanging on it forever.
+	var fileSize int64
+	err = binary.Read(stream, binary.LittleEndian, &fileSize)
+	timer.Stop()
+	if err != nil{
+		return err
+	}
+
+	n, err := write(&exactReader{r: stream, remaining: fileSize})
+	if err != nil{
+		stream.Reset()
+		return err
+	}
+
+	fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n",s.Transport.Addr(), n, from)
+
+	return nil
+}
+
+func (s *FileServer) Store(key string, r io.Reader) error{
+	return s.StoreContext(context.Background(), key, r)
+}
+
+// StoreContext is like Store but gives up once ctx is done. The local
+// file is removed if it was only partially written, and the streams to
+// peers are reset so they discard their partial copy.
+func (s *FileServer) StoreContext(ctx context.Context, key string, r io.Reader) error{
+	return s.StoreWithOptions(ctx, key, r, WriteOptions{Consistency: s.WriteConsistency})
+}
+
+// StoreWithOptions is like StoreContext but waits for as many replicas as
+// the consistency level asks for to acknowledge they persisted the file.
+// The local copy is kept even if the level is not met.
+func (s *FileServer) StoreWithOptions(ctx context.Context, key string, r io.Reader, opts WriteOptions) error{
+	// writing the file again undoes an earlier delete
+	if err := s.tombstones.Remove(s.ID, hashKey(key)); err != nil{
+		return err
+	}
+
+	fileBuffer := new(bytes.Buffer)
+	meta := ObjectMeta{ContentType: opts.ContentType, Tags: opts.Tags}
+
+	// a chunked file is kept as the manifest its replicas are, and shares
+	// its chunks with them
+	var file *chunkedFile
+	var size int64
+	var err error
+	if s.chunking(){
+		size, err = io.Copy(fileBuffer, contextReader{ctx: ctx, r: r})
+		if err == nil{
+			file, err = s.chunkFile(bytes.NewReader(fileBuffer.Bytes()))
+		}
+		if err == nil{
+			err = s.storeOwnChunked(ctx, key, file, meta)
+		}
+	} else {
+		tee := io.TeeReader(r, fileBuffer)
+		size, err = s.store.WriteWithMeta(ctx, s.ID, key ,tee, meta)
+		if err == nil{
+			err = s.setChunkRefs(s.ID, key, nil)
+		}
+	}
+	if err != nil{
+		return err
+	}
+
+	if s.erasure != nil{
+		return s.storeErasureCoded(ctx, key, fileBuffer, opts)
+	}
+
+	peers := s.peerList()
+	replicas, _ := s.splitReplicaPeers(key, peers)
+	required := opts.Consistency.required(s.replicaCount(len(peers)))
+
+	requestID := generateId()
+	ackCh, done := s.registerRequest(requestID, len(replicas))
+	defer done()
+
+	chunked, replicas := s.splitChunkPeers(replicas)
+
+	// replicas are encrypted deterministically, so a transfer that
+	// breaks off can be resumed later with the same bytes
+	data := fileBuffer.Bytes()
+	replica, err := encryptDeterministic(s.EncKey, data)
+	if err != nil{
+		return err
+	}
+	hash := sha256.Sum256(replica)
+
+	streams, acking, failed := s.openReplicaStreams(requestID, key, int64(len(replica)), hash[:], replicas)
+	// the chunked replicas are only sent once the whole ones are on their way
+	chunkedAcking := 0
+	for _, peer := range chunked{
+		if peer.Supports(FeatureStoreAck){
+			chunkedAcking++
+		}
+	}
+	acking += chunkedAcking
+
+	// replicas that are down or could not be reached get the file once
+	// they are back
+	missed := s.downReplicas(key)
+	for _, peer := range failed{
+		missed = append(missed, peer.ID())
+	}
+	s.addHints(key, size, missed)
+
+	if acking < required{
+		// fail before sending anything we already know cannot be acknowledged
+		for _, stream := range streams{
+			stream.Reset()
+		}
+		return fmt.Errorf("%w: %s write of (%s) needs %d acknowledgements but only %d replicas can give one",
+			ErrConsistencyNotMet, opts.Consistency, key, required, acking)
+	}
+
+	n, broken, err := s.sendReplicas(ctx, streams, func(w io.Writer) (int, error){
+		n, err := io.Copy(w, contextReader{ctx: ctx, r: bytes.NewReader(replica)})
+		return int(n), err
+	})
+	if ctx.Err() != nil{
+		// the streams failed because we reset them
+		return ctx.Err()
+	}
+	// the replicas breaking off all at once is handled like any of them
+	// breaking off
+	if err != nil && len(broken) < len(streams){
+		return err
+	}
+
+	fmt.Printf("[%s] received and written %d bytes to disk\n",s.Transport.Addr(), n)
+
+	// a peer that refuses the file resets its stream and acknowledges
+	// why, so only wait for that. The peers whose transfer broke off keep
+	// what they received and get the rest once they are back, they do
+	// not acknowledge it before.
+	if len(broken) > 0{
+		opened := []p2p.Peer{}
+		for _, peer := range replicas{
+			if !slices.Contains(failed, peer){
+				opened = append(opened, peer)
+			}
+		}
+
+		missed := []string{}
+		for _, i := range broken{
+			if streams[i].ResetByPeer(){
+				continue
+			}
+			missed = append(missed, opened[i].ID())
+			if opened[i].Supports(FeatureStoreAck){
+				acking--
+			}
+		}
+		s.addHints(key, size, missed)
+	}
+
+	if len(chunked) > 0{
+		n, failed := s.replicateChunked(ctx, requestID, key, file, chunked)
+		if ctx.Err() != nil{
+			return ctx.Err()
+		}
+		acking += n - chunkedAcking
+
+		missed := []string{}
+		for _, peer := range failed{
+			missed = append(missed, peer.ID())
+		}
+		s.addHints(key, size, missed)
+	}
+
+	if required == 0{
+		return nil
+	}
+
+	return s.waitForAcks(ctx, key, ackCh, acking, required)
+}
+
+// openReplicaStreams opens a stream to every peer and tells it to store
+// the size bytes of the encrypted file sent over it, which hash to hash.
+// It returns the streams that were set up, how many of their peers
+// acknowledge writes and the peers that could not be reached.
+func (s *FileServer) openReplicaStreams(requestID string, key string, size int64, hash []byte, peers []p2p.Peer) ([]*p2p.Stream, int, []p2p.Peer){
+	msg := MessageStoreFile{
+		RequestID: requestID,
+		ID: s.ID,
+		Key: hashKey(key),
+		Size: size,
+		Hash: hash,
+		Meta: s.replicaMeta(key),
+	}
+	return s.openStoreStreams(msg, peers)
+}
+
+// openStoreStreams is like openReplicaStreams but sends every peer a copy
+// of msg with the ID of its stream filled in.
+func (s *FileServer) openStoreStreams(msg MessageStoreFile, peers []p2p.Peer) ([]*p2p.Stream, int, []p2p.Peer){
+	streams := []*p2p.Stream{}
+	acking := 0
+	failed := []p2p.Peer{}
+	for _, peer := range peers{
+		stream, err := peer.OpenStream()
+		if err != nil{
+			log.Printf("[%s] could not open stream to (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+			failed = append(failed, peer)
+			continue
+		}
+
+		msg.StreamID = stream.ID()
+		if err := s.send(peer, &Message{Payload: msg}); err != nil{
+			stream.Reset()
+			log.Printf("[%s] could not send file to (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+			failed = append(failed, peer)
+			continue
+		}
+
+		streams = append(streams, stream)
+		if peer.Supports(FeatureStoreAck){
+			acking++
+		}
+	}
+
+	return streams, acking, failed
+}
+
+// sendReplicas has write copy the encrypted file into every stream at
+// once and closes them, or resets them all if ctx is done first. A
+// stream that breaks is left out from then on so it does not hold up the
+// others, and its index is returned, also when write fails because all
+// of them broke.
+func (s *FileServer) sendReplicas(ctx context.Context, streams []*p2p.Stream, write func(io.Writer) (int, error)) (int, []int, error){
+	stop := context.AfterFunc(ctx, func ()  {
+		for _, stream := range streams{
+			stream.Reset()
+		}
+	})
+	defer stop()
+
+	fanout := &fanoutWriter{
+		streams: streams,
+		broken: make([]bool, len(streams)),
+	}
+	n, err := write(fanout)
+
+	broken := []int{}
+	for i, stream := range streams{
+		if fanout.broken[i]{
+			broken = append(broken, i)
+			continue
+		}
+		if err != nil{
+			stream.Reset()
+			continue
+		}
+		stream.Close()
+	}
+
+	return n, broken, err
+}
+
+// fanoutWriter writes to every stream that did not break yet, resetting
+// the ones that do. It only fails once all of them broke.
+type fanoutWriter struct{
+	streams []*p2p.Stream
+	broken []bool
 }
 
-func (s *FileServer) broadcast(msg *Message) error{
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
+func (f *fanoutWriter) Write(b []byte) (int, error){
+	var err error
+	for i, stream := range f.streams{
+		if f.broken[i]{
+			continue
+		}
+		if _, err = stream.Write(b); err != nil{
+			stream.Reset()
+			f.broken[i] = true
+		}
 	}
 
-	for _, peer := range s.peers{
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil{
-			return err
+	if len(f.streams) > 0 && !slices.Contains(f.broken, false){
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// waitForAcks waits until required of the acking replicas acknowledged
+// they persisted the file.
+func (s *FileServer) waitForAcks(ctx context.Context, key string, ackCh chan peerResponse, acking int, required int) error{
+	timeout := time.NewTimer(s.RequestTimeout)
+	defer timeout.Stop()
+
+	acked := 0
+	var errs []error
+	for answered := 0; answered < acking && acked < required; {
+		select{
+		case resp := <- ackCh:
+			ack, ok := resp.payload.(MessageStoreFileAck)
+			if !ok{
+				continue
+			}
+			answered++
+			if len(ack.Err) > 0{
+				errs = append(errs, fmt.Errorf("(%s): %s", resp.from, ack.Err))
+				continue
+			}
+			acked++
+		case <- timeout.C:
+			errs = append(errs, errors.New("timed out waiting for acknowledgements"))
+			answered = acking
+		case <- ctx.Done():
+			return ctx.Err()
 		}
 	}
 
+	if acked < required{
+		return fmt.Errorf("%w: %d of %d required replicas acknowledged (%s): %w",
+			ErrConsistencyNotMet, acked, required, key, errors.Join(errs...))
+	}
+
 	return nil
 }
 
-type MessageGetFile struct{
-	ID string
-	key string
+func (s *FileServer) Delete(key string) error{
+	return s.DeleteContext(context.Background(), key)
 }
 
-func (s *FileServer) Get(key string)(io.Reader, error){
-	if s.store.Has(s.ID,key){
-	fmt.Printf("[%s]serving file (%s) from local disk\n", s.Transport.Addr(), key)
+// DeleteContext removes the file from local disk and tells every peer to
+// drop its replica. The delete is remembered for TombstoneTTL and passed
+// on to peers that were offline once they reconnect.
+func (s *FileServer) DeleteContext(ctx context.Context, key string) error{
+	if err := ctx.Err(); err != nil{
+		return err
+	}
 
-		_, r, err :=s.store.Read(s.ID,key)
-		return r, err
+	if err := s.store.Delete(s.ID, key); err != nil{
+		return err
+	}
+	if err := s.setChunkRefs(s.ID, key, nil); err != nil{
+		return err
+	}
+
+	tombstone := Tombstone{
+		ID: s.ID,
+		Key: hashKey(key),
+		Deleted: time.Now(),
+	}
+	if _, err := s.tombstones.Add(tombstone); err != nil{
+		return err
 	}
 
-	fmt.Printf("[%s]don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+	tombstones := []Tombstone{tombstone}
+	if s.erasure != nil{
+		for i := 0; i < s.DataShards + s.ParityShards; i++{
+			tombstones = append(tombstones, Tombstone{
+				ID: shardNamespace(s.ID),
+				Key: shardKey(key, i),
+				Deleted: tombstone.Deleted,
+			})
+		}
+	}
 
 	msg := Message{
-		Payload: MessageGetFile{
-			ID: s.ID,
-			key: hashKey(key),
+		Payload: MessageDeleteFile{
+			Tombstones: tombstones,
 		},
 	}
 
-	if err := s.broadcast(&msg); err != nil{
-		return nil, err
+	var errs []error
+	for _, peer := range s.peersSupporting(FeatureDeleteFile){
+		if err := s.send(peer, &msg); err != nil{
+			errs = append(errs, fmt.Errorf("sending delete to (%s): %w", peer.RemoteAddr(), err))
+		}
 	}
 
-	// to be removed
-	time.Sleep(time.Millisecond * 500)
+	return errors.Join(errs...)
+}
 
-	for _, peer := range s.peers{
-		// first, read the file size so we can limit the amount of  bytes we read from connection
-		// of hanging from continuous reading in order to prevent the amount
-		var fileSize int64 
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+// syncTombstones passes every delete we know of on to a peer that just
+// connected, in case it missed some of them.
+func (s *FileServer) syncTombstones(peer p2p.Peer){
+	if !peer.Supports(FeatureDeleteFile){
+		return
+	}
 
-		n, err := s.store.WriteDecrypt(s.EncKey,s.ID, key, io.LimitReader(peer, fileSize))
-		// n, err := s.store.Write(key, io.LimitReader(peer, fileSize))
-		if err != nil{
-			return nil, err
-		}
-		
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s):",s.Transport.Addr(), n, peer.RemoteAddr())
+	tombstones, err := s.tombstones.List()
+	if err != nil{
+		log.Printf("[%s] could not expire tombstones: %s", s.Transport.Addr(), err)
+	}
+	if len(tombstones) == 0{
+		return
+	}
 
-		peer.CloseStream()
+	msg := Message{
+		Payload: MessageDeleteFile{
+			Tombstones: tombstones,
+		},
 	}
+	if err := s.send(peer, &msg); err != nil{
+		log.Printf("[%s] could not send tombstones to (%s): %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+	}
+}
 
-	_ ,r, err := s.store.Read(s.ID, key)
-	return r, err
+// Stop stops the server and, if it was started, waits until it stopped
+// listening.
+func (s *FileServer) Stop(){
+	close(s.quitCh)
+	if s.started.Load(){
+		<-s.stoppedCh
+	}
 }
 
+// quitContext returns a context that is done once the server stops, for
+// the work the server does in the background.
+func (s *FileServer) quitContext() (context.Context, context.CancelFunc){
+	ctx, cancel := context.WithCancel(context.Background())
+	go func ()  {
+		select{
+		case <-s.quitCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
 
-func (s *FileServer) Store(key string, r io.Reader) error{
-	fileBuffer := new(bytes.Buffer)
-	tee := io.TeeReader(r, fileBuffer)
+func (s *FileServer) OnPeer(p p2p.Peer) error{
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
-	size, err := s.store.Write(s.ID, key ,tee)
-	if err != nil{
-		return err
+	s.peers[p.RemoteAddr().String()] = p
+	s.ring.Add(p.ID())
+	if timer, ok := s.downNodes[p.ID()]; ok{
+		timer.Stop()
+		delete(s.downNodes, p.ID())
 	}
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			Key: hashKey(key),
-			Size: size + 16, 
-		},
+	if addr := p.DialAddr(); len(addr) > 0{
+		delete(s.dialAttempts, addr)
 	}
 
-	if err := s.broadcast(&msg); err != nil{
-		return err
-	}
+	go s.syncTombstones(p)
+	go s.replayHints(p)
+
+	log.Printf("connected with remote %s", p.RemoteAddr())
 
-	// TODO: fix this sleeping
-	time.Sleep(5 * time.Millisecond)
+	return nil
+}
+
+// OnPeerDisconnect forgets the peer and, if it is one of our bootstrap
+// nodes, starts reconnecting to it.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer){
+	s.peerLock.Lock()
+	key := p.RemoteAddr().String()
+	if s.peers[key] == p{
+		delete(s.peers, key)
+	}
 
-	peers := []io.Writer{}
+	// the node stays on the ring while another connection to it is up,
+	// and for HintTTL after that in case it comes back
+	connected := false
 	for _, peer := range s.peers{
-		peers = append(peers, peer)
+		connected = connected || peer.ID() == p.ID()
 	}
-	mu := io.MultiWriter(peers...)
-	mu.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mu)
-	if err != nil {
-		return err
+	if _, down := s.downNodes[p.ID()]; !connected && !down{
+		id := p.ID()
+		s.downNodes[id] = time.AfterFunc(s.HintTTL, func ()  {
+			s.forgetNode(id)
+		})
 	}
+	s.peerLock.Unlock()
 
-	fmt.Printf("[%s] received and written %d bytes to disk\n",s.Transport.Addr(), n)
+	log.Printf("disconnected from remote %s", p.RemoteAddr())
 
-	return nil
+	if addr := p.DialAddr(); s.isBootstrapNode(addr){
+		go s.connect(addr)
+	}
 }
 
-func (s *FileServer) Stop(){
-	close(s.quitCh)
+// forgetNode takes a node that stayed down for HintTTL off the ring.
+func (s *FileServer) forgetNode(id string){
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if _, ok := s.downNodes[id]; !ok{
+		return
+	}
+	delete(s.downNodes, id)
+	s.ring.Remove(id)
 }
 
-func (s *FileServer) OnPeer(p p2p.Peer) error{
+// downReplicas returns the nodes that should hold a replica of the key
+// but are down.
+func (s *FileServer) downReplicas(key string) []string{
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
-	s.peers[p.RemoteAddr().String()] = p
+	down := []string{}
+	if s.ReplicationFactor <= 0{
+		for id := range s.downNodes{
+			down = append(down, id)
+		}
+		return down
+	}
 
-	log.Printf("connected with remote %s", p.RemoteAddr())
+	for _, id := range s.ring.Lookup(hashKey(key), s.ReplicationFactor){
+		if _, ok := s.downNodes[id]; ok{
+			down = append(down, id)
+		}
+	}
+	return down
+}
 
-	return nil
+func (s *FileServer) isBootstrapNode(addr string) bool{
+	if len(addr) == 0{
+		return false
+	}
+
+	for _, node := range s.BootstrapNodes{
+		if node == addr{
+			return true
+		}
+	}
+	return false
 }
 
 func (s *FileServer) loop(){
 	defer func ()  {
 		log.Println("File server stopped due to error or user quit action")
 		s.Transport.Close()	
+		close(s.stoppedCh)
 	}()
 
 	for{
@@ -192,113 +1314,495 @@ func (s *FileServer) loop(){
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil{
 				log.Println("decoding error: ",err)
+				continue
 			}
 
-			if err := s.handleMessage(rpc.From, &msg); err != nil{
-				log.Println("handle message error: ", err)
-				
-			}
+			s.dispatch(rpc.From, &msg)
 		case <- s.quitCh:
 			return
 		}
 	}
 }
 
+// dispatch hands the message to the handler of the peer it came from.
+// The messages of one peer are handled one after the other in the order
+// they arrived, so a delete sent after a store is only handled once the
+// replica is written. Those of different peers do not wait for each
+// other.
+func (s *FileServer) dispatch(from string, msg *Message){
+	s.handlerLock.Lock()
+	defer s.handlerLock.Unlock()
+
+	if queued, ok := s.handlers[from]; ok{
+		s.handlers[from] = append(queued, msg)
+		return
+	}
+	s.handlers[from] = nil
+	go s.handleMessages(from, msg)
+}
+
+// handleMessages handles msg and then the messages queued behind it,
+// until none are left.
+func (s *FileServer) handleMessages(from string, msg *Message){
+	for{
+		if err := s.handleMessage(from, msg); err != nil{
+			log.Println("handle message error: ", err)
+		}
+
+		s.handlerLock.Lock()
+		queued := s.handlers[from]
+		if len(queued) == 0{
+			delete(s.handlers, from)
+			s.handlerLock.Unlock()
+			return
+		}
+		msg, s.handlers[from] = queued[0], queued[1:]
+		s.handlerLock.Unlock()
+	}
+}
+
 func (s *FileServer) handleMessage(from string, msg *Message) error{
 	switch v := msg.Payload.(type){
 	case MessageStoreFile:
 		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
 		return s.handleMessageGetFile(from, v)
+	case MessageGetFileResponse:
+		return s.handleMessageGetFileResponse(from, v)
+	case MessageFetchFile:
+		return s.handleMessageFetchFile(from, v)
+	case MessageStoreFileAck:
+		return s.handleMessageStoreFileAck(from, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageSyncRoot:
+		return s.handleMessageSyncRoot(from, v)
+	case MessageSyncRootResponse:
+		return s.handleMessageSyncRootResponse(from, v)
+	case MessageSyncLeaves:
+		return s.handleMessageSyncLeaves(from, v)
+	case MessageSyncLeavesResponse:
+		return s.handleMessageSyncLeavesResponse(from, v)
+	case MessageFetchObject:
+		return s.handleMessageFetchObject(from, v)
+	case MessageHasChunks:
+		return s.handleMessageHasChunks(from, v)
+	case MessageHasChunksResponse:
+		return s.handleMessageHasChunksResponse(from, v)
+	case MessageGetStaged:
+		return s.handleMessageGetStaged(from, v)
+	case MessageGetStagedResponse:
+		return s.handleMessageGetStagedResponse(from, v)
+	case MessageListFiles:
+		return s.handleMessageListFiles(from, v)
+	case MessageListFilesResponse:
+		return s.handleMessageListFilesResponse(from, v)
 	}
 
 	return nil
 }
 
 func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error{
-	peer, ok := s.peers[from]
+	peer, ok := s.peer(from)
 	if !ok{
 		return fmt.Errorf("peer (%s) could not be found in the peer map", from)
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
-	if err != nil {
+	n, err := s.storeReplica(peer, msg)
+
+	if peer.Supports(FeatureStoreAck){
+		ack := MessageStoreFileAck{
+			RequestID: msg.RequestID,
+		}
+		if err != nil{
+			ack.Err = err.Error()
+		}
+
+		if sendErr := s.send(peer, &Message{Payload: ack}); sendErr != nil{
+			log.Printf("[%s] could not acknowledge file (%s) to (%s): %s", s.Transport.Addr(), msg.Key, from, sendErr)
+		}
+	}
+
+	if err != nil{
 		return err
 	}
 
 	log.Printf("[%s] written (%d) bytes to disk\n",s.Transport.Addr(), n)
 
-	peer.CloseStream()
-
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile)error{
-	
-	if !s.store.Has(msg.ID, msg.key){
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk",s.Transport.Addr() , msg.key)
+// storeReplica writes the file the peer sends over the stream to disk.
+// Chunks are only kept if they hash to the ID they are stored under.
+// Replicas that do not fit the quota or the disk reserve are refused
+// before any of them is read.
+func (s *FileServer) storeReplica(peer p2p.Peer, msg MessageStoreFile) (int64, error){
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil{
+		return 0, err
 	}
+	defer stream.Close()
 
-	fmt.Printf("[%s] serving file (%s) over the network\n",s.Transport.Addr(), msg.key)
-	
-	fileSize, r, err := s.store.Read(msg.ID, msg.key)
+	if err := s.checkPeerObject(msg.ID, s.store.pathOf(msg.Key)); err != nil{
+		stream.Reset()
+		return 0, err
+	}
+	if err := s.admitReplica(peer, msg); err != nil{
+		stream.Reset()
+		return 0, err
+	}
+	// a manifest is useless without its chunks, so it is refused unless
+	// we hold all of them
+	chunks, err := readChunkIDs(stream, msg.ChunkCount, msg.Size)
+	if err == nil{
+		err = s.checkChunks(chunks)
+	}
+	if err != nil{
+		stream.Reset()
+		return 0, err
+	}
+	// whatever the peer claims, its replicas count against its own quota
+	msg.Meta.ChargedTo = peer.ID()
+
+	var r io.Reader = &exactReader{r: stream, remaining: msg.Size}
+	if len(msg.Hash) > 0 && msg.ID != chunkNamespace{
+		n, err := s.storeStaged(peer, msg, r)
+		if err != nil{
+			// what was staged is only kept for a transfer that broke
+			// off, a peer that gave up on it does not resume it
+			if stream.ResetByPeer(){
+				s.store.DiscardStaged(peer.ID(), replicaStagingKey(msg))
+			}
+			stream.Reset()
+		}
+		return n, err
+	}
+	if msg.ID == chunkNamespace{
+		want, err := hex.DecodeString(msg.Key)
+		if err != nil{
+			stream.Reset()
+			return 0, fmt.Errorf("invalid chunk ID (%s): %w", msg.Key, err)
+		}
+		r = newHashCheckReader(r, want)
+	}
+
+	n, err := s.store.WriteWithMeta(context.Background(), msg.ID, msg.Key, r, msg.Meta)
 	if err != nil {
+		stream.Reset()
+		return n, err
+	}
+	if msg.ID == chunkNamespace{
+		return n, nil
+	}
+
+	return n, s.replicaStored(msg, chunks)
+}
+
+// replicaStored updates what we keep track of for a replica that was
+// just written, which refers to the chunks if it is a manifest.
+func (s *FileServer) replicaStored(msg MessageStoreFile, chunks []string) error{
+	// a replica that is not a manifest releases the chunks an older
+	// version of it referred to
+	if err := s.setChunkRefs(msg.ID, msg.Key, chunks); err != nil{
+		return err
+	}
+
+	tombstone, ok := s.tombstones.Get(msg.ID, msg.Key)
+	if !ok{
+		return nil
+	}
+	// the owner wrote the file again after deleting it
+	if s.writtenAfter(msg.ID, msg.Key, tombstone.Deleted){
+		return s.tombstones.Remove(msg.ID, msg.Key)
+	}
+	// or this version of it is older than the delete and arrived late
+	if err := s.store.Delete(msg.ID, msg.Key); err != nil{
+		return err
+	}
+	return s.setChunkRefs(msg.ID, msg.Key, nil)
+}
+
+func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile)error{
+	peer, ok := s.peer(from)
+	if !ok{
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	resp := MessageGetFileResponse{
+		RequestID: msg.RequestID,
+	}
+
+	// the hash recorded when the file was written is answered with, the
+	// file is only read for the ones written before hashes were recorded
+	if s.checkPeerObject(msg.ID, s.store.pathOf(msg.Key)) == nil && s.hasLiveFile(msg.ID, msg.Key){
+		meta, err := s.store.Stat(msg.ID, msg.Key)
+		if err == nil && len(meta.Hash) == 0{
+			meta.Size, meta.Hash, err = s.store.fileHash(s.store.objectName(msg.ID, msg.Key))
+		}
+		if err == nil{
+			resp.Found = true
+			resp.Size = meta.Size
+			resp.Hash = meta.Hash
+			resp.Chunked = s.chunkRefs.Has(msg.ID, msg.Key)
+			resp.Meta = meta
+		}
+	}
+
+	return s.send(peer, &Message{Payload: resp})
+}
+
+// checkPeerObject fails unless a peer may have the object at path below
+// the namespace id: it has to stay within a namespace that is not ours,
+// ours holds our files unencrypted.
+func (s *FileServer) checkPeerObject(id, path string) error{
+	if err := checkObjectPath(id, path); err != nil{
 		return err
 	}
+	if id == s.ID{
+		return fmt.Errorf("namespace (%s) is our own", id)
+	}
+	return nil
+}
+
+// hasLiveFile reports whether we hold a replica that was not deleted by
+// its owner, in case the tombstone arrived before we got to drop it.
+func (s *FileServer) hasLiveFile(id, key string) bool{
+	if !s.store.Has(id, key){
+		return false
+	}
+
+	tombstone, ok := s.tombstones.Get(id, key)
+	if !ok{
+		return true
+	}
+	return s.writtenAfter(id, key, tombstone.Deleted)
+}
+
+// writtenAfter reports whether the owner wrote the replica we hold after
+// the time it deleted the file at. Both times come from the owner's
+// clock, not ours. A replica without the time it was written cannot be
+// told newer, so the delete wins.
+func (s *FileServer) writtenAfter(id, key string, deleted time.Time) bool{
+	meta, err := s.store.readMeta(s.store.objectName(id, key))
+	return err == nil && meta.Modified.After(deleted)
+}
+
+// handleMessageDeleteFile drops the replicas the tombstones cover. A
+// replica the owner wrote after the delete is it storing the file again,
+// so it is kept and the older tombstone ignored.
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error{
+	var errs []error
+	for _, tombstone := range msg.Tombstones{
+		// we are the authority on our own files, and nothing outside
+		// the namespaces of others is deleted
+		if err := s.checkPeerObject(tombstone.ID, s.store.pathOf(tombstone.Key)); err != nil{
+			continue
+		}
+
+		if s.store.Has(tombstone.ID, tombstone.Key) && s.writtenAfter(tombstone.ID, tombstone.Key, tombstone.Deleted){
+			continue
+		}
+
+		added, err := s.tombstones.Add(tombstone)
+		if err != nil{
+			errs = append(errs, err)
+			continue
+		}
+		if !added || !s.store.Has(tombstone.ID, tombstone.Key){
+			continue
+		}
 
-	// checking if the reader is a readcloser, if it is then closing it.
-	rc, ok := r.(io.ReadCloser)
-	if ok{
-		fmt.Println("closing readClose")
-		defer rc.Close()
+		if err := s.store.Delete(tombstone.ID, tombstone.Key); err != nil{
+			errs = append(errs, err)
+			continue
+		}
+		if err := s.setChunkRefs(tombstone.ID, tombstone.Key, nil); err != nil{
+			errs = append(errs, err)
+		}
+		log.Printf("[%s] dropped file (%s) deleted by its owner, as told by (%s)", s.Transport.Addr(), tombstone.Key, from)
 	}
 
-	peer, ok := s.peers[from]
+	return errors.Join(errs...)
+}
+
+func (s *FileServer) handleMessageGetFileResponse(from string, msg MessageGetFileResponse) error{
+	s.deliverResponse(msg.RequestID, from, msg)
+	return nil
+}
+
+func (s *FileServer) handleMessageStoreFileAck(from string, msg MessageStoreFileAck) error{
+	s.deliverResponse(msg.RequestID, from, msg)
+	return nil
+}
+
+func (s *FileServer) handleMessageFetchFile(from string, msg MessageFetchFile)error{
+	peer, ok := s.peer(from)
 	if !ok{
 		return fmt.Errorf("peer %s not in map", from)
 	}
 
-	// first send the "IncomingStream" byte to the peer
-	// and the we can send the file size as an int64
-	peer.Send([]byte{p2p.IncomingStream})
-	// var fileSize int64 = 32
-	binary.Write(peer, binary.LittleEndian, fileSize)
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil{
+		return err
+	}
+
+	if err := s.checkPeerObject(msg.ID, s.store.pathOf(msg.Key)); err != nil{
+		stream.Reset()
+		return fmt.Errorf("[%s] peer (%s) asked for file (%s): %w", s.Transport.Addr(), from, msg.Key, err)
+	}
+	if !s.hasLiveFile(msg.ID, msg.Key){
+		stream.Reset()
+		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk",s.Transport.Addr() , msg.Key)
+	}
 
-	n ,err := io.Copy(peer, r)
+	fmt.Printf("[%s] serving file (%s) over the network\n",s.Transport.Addr(), msg.Key)
+	
+	fileSize, r, err := s.store.readStream(msg.ID, msg.Key)
 	if err != nil {
+		stream.Reset()
 		return err
 	}
 
-	fmt.Printf("[%s] has written %d bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	if msg.Offset < 0 || msg.Offset > fileSize{
+		stream.Reset()
+		r.Close()
+		return fmt.Errorf("[%s] cannot serve file (%s) from offset %d", s.Transport.Addr(), msg.Key, msg.Offset)
+	}
 
+	// the part before the offset is read rather than skipped, so the
+	// file is still checked against its hash as a whole
+	s.serveOverStream(stream, from, msg.ID, s.store.pathOf(msg.Key), fileSize-msg.Offset, &offsetReader{r: r, skip: msg.Offset})
 	return nil
 }
 
+// serveOverStream sends the size of the object at path below the
+// namespace id followed by its content in the background, so the
+// messages of the peer behind the request are not held up by it, and
+// closes r once it is done. An object that turns out corrupt is
+// quarantined and repaired as the scrubber does.
+func (s *FileServer) serveOverStream(stream *p2p.Stream, to string, id, path string, fileSize int64, r io.ReadCloser){
+	go func ()  {
+		defer r.Close()
+		defer stream.Close()
+
+		// first send the file size as an int64 so the peer knows
+		// how much to read from the stream
+		if err := binary.Write(stream, binary.LittleEndian, fileSize); err != nil{
+			log.Printf("[%s] could not serve file to %s: %s", s.Transport.Addr(), to, err)
+			return
+		}
+
+		n ,err := io.Copy(stream, r)
+		if err != nil {
+			stream.Reset()
+			log.Printf("[%s] could not serve file to %s: %s", s.Transport.Addr(), to, err)
+			if errors.Is(err, ErrCorrupt){
+				ctx, cancel := s.quitContext()
+				defer cancel()
+				s.repairObject(ctx, id, path)
+			}
+			return
+		}
+
+		fmt.Printf("[%s] has written %d bytes over the network to %s\n", s.Transport.Addr(), n, to)
+	}()
+}
+
+// offsetReader reads r from skip bytes on.
+type offsetReader struct{
+	r io.ReadCloser
+	skip int64
+}
+
+func (o *offsetReader) Read(b []byte) (int, error){
+	if o.skip > 0{
+		n, err := io.CopyN(io.Discard, o.r, o.skip)
+		o.skip -= n
+		if err != nil{
+			return 0, err
+		}
+	}
+	return o.r.Read(b)
+}
+
+func (o *offsetReader) Close() error{
+	return o.r.Close()
+}
+
 func (s *FileServer) bootstrapNetwork() error{
 	for _, addr:= range s.BootstrapNodes{
 		if len(addr) == 0 {
 			continue
 		}
 
-		go func (addr string)  {
-			fmt.Printf("[%s] attempting to connect with remote %s\n",s.Transport.Addr(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error:", err)
-			}
-		}(addr)
+		go s.connect(addr)
 	}
 
 	return nil
 }
 
+// connect dials the bootstrap node until it succeeds or the server stops,
+// backing off exponentially between failed attempts. A connection that
+// is dropped before OnPeer accepts it counts as a failed attempt too.
+func (s *FileServer) connect(addr string){
+	for{
+		select{
+		case <- s.quitCh:
+			return
+		default:
+		}
+
+		s.peerLock.Lock()
+		attempt := s.dialAttempts[addr]
+		s.dialAttempts[addr]++
+		s.peerLock.Unlock()
+
+		if attempt > 0{
+			backoff := s.reconnectBackoff(attempt)
+			fmt.Printf("[%s] reconnecting to %s in %s\n", s.Transport.Addr(), addr, backoff)
+
+			select{
+			case <- time.After(backoff):
+			case <- s.quitCh:
+				return
+			}
+		}
+
+		fmt.Printf("[%s] attempting to connect with remote %s\n",s.Transport.Addr(), addr)
+		err := s.Transport.Dial(addr)
+		if err == nil {
+			return
+		}
+		log.Println("dial error:", err)
+	}
+}
+
+func (s *FileServer) reconnectBackoff(attempt int) time.Duration{
+	backoff := s.ReconnectBackoff
+	for i := 1; i < attempt && backoff < s.MaxReconnectBackoff; i++{
+		backoff *= 2
+	}
+
+	return min(backoff, s.MaxReconnectBackoff)
+}
+
 func (s *FileServer) Start() error{
+	if s.DataShards > 0 && s.erasure == nil{
+		_, err := NewReedSolomon(s.DataShards, s.ParityShards)
+		return fmt.Errorf("erasure coding: %w", err)
+	}
+
 	fmt.Printf("[%s] starting fileserver\n", s.Transport.Addr())
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
+	s.started.Store(true)
 
 	s.bootstrapNetwork()
 
+	go s.antiEntropyLoop()
+	go s.scrubLoop()
+
 	s.loop()
 
 	return nil
@@ -307,4 +1811,19 @@ func (s *FileServer) Start() error{
 func init(){
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileResponse{})
+	gob.Register(MessageFetchFile{})
+	gob.Register(MessageStoreFileAck{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageSyncRoot{})
+	gob.Register(MessageSyncRootResponse{})
+	gob.Register(MessageSyncLeaves{})
+	gob.Register(MessageSyncLeavesResponse{})
+	gob.Register(MessageFetchObject{})
+	gob.Register(MessageHasChunks{})
+	gob.Register(MessageHasChunksResponse{})
+	gob.Register(MessageGetStaged{})
+	gob.Register(MessageGetStagedResponse{})
+	gob.Register(MessageListFiles{})
+	gob.Register(MessageListFilesResponse{})
 }
\ No newline at end of file
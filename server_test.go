@@ -0,0 +1,1273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	p2p "github.com/StaphoneWizzoh/TunerStore/peer2peer"
+)
+
+func newTestServer(t *testing.T, nodes ...*FileServer) *FileServer{
+	return newTestServerWithOpts(t, FileServerOpts{}, nodes...)
+}
+
+// newTestServerWithOpts starts a server on a free port with the test
+// defaults filled into opts, bootstrapping from the nodes. It returns once
+// the server listens, and stopping it at the end of the test waits for it
+// to shut down.
+func newTestServerWithOpts(t *testing.T, opts FileServerOpts, nodes ...*FileServer) *FileServer{
+	t.Helper()
+
+	opts.ID = generateId()
+
+	tcpTransport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr: ":0",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Features: ServerFeatures,
+		NodeID: opts.ID,
+	})
+
+	opts.EncKey = newEncryptionKey()
+	opts.StorageRoot = t.TempDir()
+	opts.PathTransformFunc = CASPathTransformFunc
+	opts.Transport = tcpTransport
+	for _, node := range nodes{
+		opts.BootstrapNodes = append(opts.BootstrapNodes, node.Transport.Addr())
+	}
+	opts.ReconnectBackoff = 10 * time.Millisecond
+
+	s := NewFileServer(opts)
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Start() }()
+	waitFor(t, func() bool { return s.started.Load() || len(errCh) > 0 })
+	if !s.started.Load(){
+		t.Fatal(<-errCh)
+	}
+	t.Cleanup(func() {
+		s.Stop()
+		<-errCh
+	})
+
+	return s
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, cond func() bool){
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(){
+		if time.Now().After(deadline){
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dial connects the server to another one.
+func dial(t *testing.T, s *FileServer, to *FileServer){
+	t.Helper()
+
+	if err := s.Transport.Dial(to.Transport.Addr()); err != nil{
+		t.Fatal(err)
+	}
+}
+
+func TestFileServerReconnectsToBootstrapNodes(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	first := s2.peerList()[0]
+	first.Close()
+
+	waitFor(t, func() bool {
+		peers := s2.peerList()
+		return len(peers) == 1 && peers[0] != first
+	})
+	waitFor(t, func() bool { return len(s1.peerList()) == 1 })
+}
+
+func TestFileServerReplicationFactor(t *testing.T) {
+	opts := FileServerOpts{ReplicationFactor: 2}
+	s1 := newTestServerWithOpts(t, opts)
+	s2 := newTestServerWithOpts(t, opts, s1)
+	s3 := newTestServerWithOpts(t, opts, s1, s2)
+	s4 := newTestServerWithOpts(t, opts, s1, s2, s3)
+	waitFor(t, func() bool { return len(s4.peerList()) == 3 })
+
+	for i := 0; i < 10; i++{
+		key := fmt.Sprintf("replicated_%d", i)
+		if err := s4.Store(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+
+		want := s4.ring.Lookup(hashKey(key), 2)
+		waitFor(t, func() bool {
+			holders := []string{}
+			for _, s := range []*FileServer{s1, s2, s3}{
+				if s.store.Has(s4.ID, hashKey(key)){
+					holders = append(holders, s.ID)
+				}
+			}
+			return len(holders) == 2 && (holders[0] == want[0] || holders[0] == want[1]) && (holders[1] == want[0] || holders[1] == want[1])
+		})
+	}
+}
+
+func TestFileServerConsistency(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	s3 := newTestServer(t, s1, s2)
+	waitFor(t, func() bool { return len(s3.peerList()) == 2 })
+
+	ctx := context.Background()
+	data := []byte("a file every replica has")
+	if err := s3.StoreWithOptions(ctx, "consistent_file", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// an ALL write only returns once every replica persisted the file
+	for _, s := range []*FileServer{s1, s2}{
+		if !s.store.Has(s3.ID, hashKey("consistent_file")){
+			t.Fatalf("(%s) does not have the file after an ALL write", s.Transport.Addr())
+		}
+	}
+
+	if err := s3.store.Delete(s3.ID, "consistent_file"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s3.GetWithOptions(ctx, "consistent_file", ReadOptions{Consistency: ConsistencyQuorum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+
+	if err := s2.store.Delete(s3.ID, hashKey("consistent_file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.store.Delete(s3.ID, "consistent_file"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s3.GetWithOptions(ctx, "consistent_file", ReadOptions{Consistency: ConsistencyAll})
+	if !errors.Is(err, ErrConsistencyNotMet) {
+		t.Errorf("want %v have %v", ErrConsistencyNotMet, err)
+	}
+}
+
+func TestFileServerConsistencyAllStaleReplica(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	s3 := newTestServer(t, s1, s2)
+	waitFor(t, func() bool { return len(s3.peerList()) == 2 })
+
+	ctx := context.Background()
+	data := []byte("the current version")
+	if err := s3.StoreWithOptions(ctx, "stale_file", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	stale := func() {
+		t.Helper()
+		if _, err := s2.store.Write(s3.ID, hashKey("stale_file"), bytes.NewReader([]byte("an older version"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale()
+
+	// an ALL write needs both peers, so does an ALL read, even though we
+	// hold the file ourselves, and the stale replica does not count
+	all := ReadOptions{Consistency: ConsistencyAll}
+	if _, err := s3.GetWithOptions(ctx, "stale_file", all); !errors.Is(err, ErrConsistencyNotMet) {
+		t.Fatalf("want %v have %v", ErrConsistencyNotMet, err)
+	}
+
+	// the stale replica is repaired from our copy
+	var r io.Reader
+	waitFor(t, func() bool {
+		var err error
+		r, err = s3.GetWithOptions(ctx, "stale_file", all)
+		return err == nil
+	})
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+
+	// without our own copy the replicas have to agree among themselves
+	stale()
+	if err := s3.store.Delete(s3.ID, "stale_file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.GetWithOptions(ctx, "stale_file", all); !errors.Is(err, ErrConsistencyNotMet) {
+		t.Errorf("want %v have %v", ErrConsistencyNotMet, err)
+	}
+	if s3.store.Has(s3.ID, "stale_file") {
+		t.Error("file was fetched although the replicas disagree")
+	}
+}
+
+// gatedStorage holds up appends to the staging area once the first bytes
+// went through, until the gate is opened, so a transfer can be cancelled
+// half way.
+type gatedStorage struct {
+	Storage
+	armed atomic.Bool
+	held chan struct{}
+	gate chan struct{}
+	once sync.Once
+}
+
+func newGatedStorage(t *testing.T) *gatedStorage {
+	return &gatedStorage{
+		Storage: NewDiskStorage(t.TempDir(), false),
+		held: make(chan struct{}),
+		gate: make(chan struct{}),
+	}
+}
+
+func (g *gatedStorage) Append(name string, offset int64, r io.Reader) (int64, error) {
+	if g.armed.Load() && strings.HasPrefix(name, stagingDirName + "/") {
+		r = &gatedReader{r: r, storage: g}
+	}
+	return g.Storage.Append(name, offset, r)
+}
+
+type gatedReader struct {
+	r io.Reader
+	storage *gatedStorage
+	read int
+}
+
+func (r *gatedReader) Read(b []byte) (int, error) {
+	if r.read > 0 {
+		r.storage.once.Do(func() { close(r.storage.held) })
+		<-r.storage.gate
+	}
+	n, err := r.r.Read(b)
+	r.read += n
+	return n, err
+}
+
+// leftovers returns the temp files and staged transfers in the server's
+// storage.
+func leftovers(t *testing.T, s *FileServer) []string {
+	t.Helper()
+
+	names := []string{}
+	err := s.store.Storage.List("", func(info StorageInfo) error {
+		if isTempFile(path.Base(info.Name)) || strings.HasPrefix(info.Name, stagingDirName + "/") {
+			names = append(names, info.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestFileServerStoreContextCancelled(t *testing.T) {
+	gated := newGatedStorage(t)
+	s1 := newTestServerWithOpts(t, FileServerOpts{Storage: gated})
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	data := make([]byte, 1 << 20)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	gated.armed.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-gated.held
+		cancel()
+		close(gated.gate)
+	}()
+
+	err := s2.StoreContext(ctx, "cancelled_store", bytes.NewReader(data))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v have %v", context.Canceled, err)
+	}
+
+	// the peer sees the stream reset and drops what it received, it is
+	// not going to be resumed
+	waitFor(t, func() bool { return len(leftovers(t, s1)) == 0 })
+	if s1.store.Has(s2.ID, hashKey("cancelled_store")) {
+		t.Error("peer kept a partial replica")
+	}
+	if names := leftovers(t, s2); len(names) > 0 {
+		t.Errorf("want no temp files have %v", names)
+	}
+}
+
+func TestFileServerGetContextCancelled(t *testing.T) {
+	s1 := newTestServer(t)
+	gated := newGatedStorage(t)
+	s2 := newTestServerWithOpts(t, FileServerOpts{Storage: gated}, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	data := make([]byte, 1 << 20)
+	rand.New(rand.NewSource(3)).Read(data)
+	if err := s2.StoreWithOptions(context.Background(), "cancelled_get", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.store.Delete(s2.ID, "cancelled_get"); err != nil {
+		t.Fatal(err)
+	}
+
+	gated.armed.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-gated.held
+		cancel()
+		close(gated.gate)
+	}()
+
+	if _, err := s2.GetContext(ctx, "cancelled_get"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v have %v", context.Canceled, err)
+	}
+
+	// the download is dropped rather than kept to be resumed
+	if names := leftovers(t, s2); len(names) > 0 {
+		t.Errorf("want nothing staged have %v", names)
+	}
+	if s2.store.Has(s2.ID, "cancelled_get") {
+		t.Error("partial file was stored")
+	}
+	if names := leftovers(t, s1); len(names) > 0 {
+		t.Errorf("want no temp files on the peer have %v", names)
+	}
+
+	// the peer stopped serving the file and still holds it
+	r, err := s2.Get("cancelled_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, data) {
+		t.Error("file read back differs from the one stored")
+	}
+}
+
+func TestFileServerDeleteContextCancelled(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s2.StoreWithOptions(ctx, "kept_file", bytes.NewReader([]byte("not deleted")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := s2.DeleteContext(ctx, "kept_file"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v have %v", context.Canceled, err)
+	}
+
+	// a cancelled delete leaves the file in place everywhere
+	time.Sleep(50 * time.Millisecond)
+	if !s2.store.Has(s2.ID, "kept_file") || !s1.store.Has(s2.ID, hashKey("kept_file")) {
+		t.Error("file was deleted")
+	}
+	if _, ok := s2.tombstones.Get(s2.ID, hashKey("kept_file")); ok {
+		t.Error("delete was recorded")
+	}
+}
+
+func TestFileServerDeletePropagates(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	ctx := context.Background()
+	if err := s2.StoreWithOptions(ctx, "deleted_file", bytes.NewReader([]byte("soon gone")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// s3 holds a replica too but is offline while the file is deleted
+	s3 := newTestServer(t)
+	if _, err := s3.store.Write(s2.ID, hashKey("deleted_file"), bytes.NewReader([]byte("stale replica"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err := s2.Delete("deleted_file"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !s1.store.Has(s2.ID, hashKey("deleted_file")) })
+
+	dial(t, s3, s2)
+	waitFor(t, func() bool { return !s3.store.Has(s2.ID, hashKey("deleted_file")) })
+
+	if _, err := s2.Get("deleted_file"); err == nil {
+		t.Error("deleted file was found")
+	}
+
+	// storing the file again undoes the delete everywhere
+	if err := s2.StoreWithOptions(ctx, "deleted_file", bytes.NewReader([]byte("back again")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.store.Delete(s2.ID, "deleted_file"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s2.Get("deleted_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "back again" {
+		t.Errorf("want %s have %s", "back again", b)
+	}
+}
+
+func TestFileServerDeleteAfterStore(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	// the delete is sent before the replica is written, but handled after it
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("short_lived_%d", i)
+		if err := s2.StoreWithOptions(ctx, key, bytes.NewReader([]byte("soon gone")), WriteOptions{Consistency: ConsistencyAny}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s2.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// and once s1 acknowledged a later file, it handled everything before it
+	if err := s2.StoreWithOptions(ctx, "last", bytes.NewReader([]byte("kept")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		key := hashKey(fmt.Sprintf("short_lived_%d", i))
+		if s1.hasLiveFile(s2.ID, key) {
+			t.Errorf("deleted file (%s) came back", key)
+		}
+		if _, ok := s1.tombstones.Get(s2.ID, key); !ok {
+			t.Errorf("tombstone of (%s) was removed", key)
+		}
+	}
+}
+
+func TestFileServerDeleteGoesByOwnerClock(t *testing.T) {
+	s := newTestServer(t)
+	owner, key := generateId(), hashKey("file")
+	now := time.Now()
+	write := func(modified time.Time) {
+		t.Helper()
+		if _, err := s.store.WriteWithMeta(context.Background(), owner, key, bytes.NewReader([]byte("replica")), ObjectMeta{Modified: modified}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the replica reached our disk after the delete, but the owner wrote
+	// it before
+	write(now.Add(-time.Hour))
+	deleted := now.Add(-30 * time.Minute)
+	if err := s.handleMessageDeleteFile("peer", MessageDeleteFile{Tombstones: []Tombstone{{ID: owner, Key: key, Deleted: deleted}}}); err != nil {
+		t.Fatal(err)
+	}
+	if s.store.Has(owner, key) {
+		t.Error("replica from before the delete was kept")
+	}
+
+	// a version from before the delete arriving late leaves it in place
+	write(now.Add(-45 * time.Minute))
+	if err := s.replicaStored(MessageStoreFile{ID: owner, Key: key}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.tombstones.Get(owner, key); !ok {
+		t.Error("tombstone was removed by an older version")
+	}
+	if s.store.Has(owner, key) {
+		t.Error("older version was kept")
+	}
+
+	// and a version from after it undoes it
+	write(now)
+	if err := s.replicaStored(MessageStoreFile{ID: owner, Key: key}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.tombstones.Get(owner, key); ok {
+		t.Error("tombstone was kept for a newer version")
+	}
+	if !s.hasLiveFile(owner, key) {
+		t.Error("newer version is not live")
+	}
+}
+
+func TestFileServerAntiEntropy(t *testing.T) {
+	opts := FileServerOpts{AntiEntropyInterval: 20 * time.Millisecond}
+	s1 := newTestServerWithOpts(t, opts)
+	s2 := newTestServerWithOpts(t, opts)
+
+	// replicas of a third node that s2 missed while it was away
+	owner := generateId()
+	for i := 0; i < 5; i++{
+		key := hashKey(fmt.Sprintf("missed_%d", i))
+		if _, err := s1.store.Write(owner, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// and a replica s2 holds an outdated copy of
+	if _, err := s2.store.Write(owner, hashKey("outdated"), bytes.NewReader([]byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s1.store.Write(owner, hashKey("outdated"), bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a copy that reached s2 late is still the older version, going by
+	// when the owner wrote it
+	ctx := context.Background()
+	written := time.Now()
+	if _, err := s1.store.WriteWithMeta(ctx, owner, hashKey("late"), bytes.NewReader([]byte("new")), ObjectMeta{Modified: written}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s2.store.WriteWithMeta(ctx, owner, hashKey("late"), bytes.NewReader([]byte("old")), ObjectMeta{Modified: written.Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	dial(t, s2, s1)
+
+	content := func(s *FileServer, key string) string {
+		_, r, err := s.store.Read(owner, key)
+		if err != nil {
+			return ""
+		}
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		return string(b)
+	}
+	waitFor(t, func() bool {
+		for i := 0; i < 5; i++{
+			if !s2.store.Has(owner, hashKey(fmt.Sprintf("missed_%d", i))){
+				return false
+			}
+		}
+		return content(s2, hashKey("outdated")) == "new" && content(s2, hashKey("late")) == "new"
+	})
+	if have := content(s1, hashKey("late")); have != "new" {
+		t.Errorf("want new have %s", have)
+	}
+}
+
+func TestFileServerMerkleTreeFromMeta(t *testing.T) {
+	s := newTestServer(t)
+	owner := generateId()
+	leaves := func(tree *MerkleTree) []MerkleLeaf {
+		all := []MerkleLeaf{}
+		for b := 0; b < merkleBuckets; b++{
+			all = append(all, tree.Leaves(b)...)
+		}
+		return all
+	}
+
+	key := hashKey("kept")
+	if _, err := s.store.Write(owner, key, bytes.NewReader([]byte("kept"))); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := s.merkleTree(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256([]byte("kept"))
+	if have := leaves(tree); len(have) != 1 || !bytes.Equal(have[0].Hash, want[:]) {
+		t.Fatalf("want a leaf with the hash of kept have %+v", have)
+	}
+
+	// the leaves come from the recorded hashes, the objects are not read
+	// again, and the tree is reused until the store changes
+	if err := writeStorageFile(s.store.Storage, s.store.objectName(owner, key), []byte("changed behind its back")); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.merkleTree(s.ID); again != tree {
+		t.Error("tree was built again without any change")
+	}
+
+	if _, err := s.store.Write(owner, hashKey("added"), bytes.NewReader([]byte("added"))); err != nil {
+		t.Fatal(err)
+	}
+	tree, _ = s.merkleTree(s.ID)
+	if have := len(leaves(tree)); have != 2 {
+		t.Errorf("want 2 leaves have %d", have)
+	}
+	if err := s.store.Delete(owner, key); err != nil {
+		t.Fatal(err)
+	}
+	tree, _ = s.merkleTree(s.ID)
+	if have := leaves(tree); len(have) != 1 || have[0].Path != s.store.pathOf(hashKey("added")) {
+		t.Errorf("want only the added leaf have %+v", have)
+	}
+}
+
+func TestFileServerRefusesForeignFetches(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s1.peerList()) == 1 && len(s2.peerList()) == 1 })
+	peer := s2.peerList()[0]
+
+	if err := s1.Store("own_file", bytes.NewReader([]byte("unencrypted"))); err != nil {
+		t.Fatal(err)
+	}
+	path := s1.store.pathOf("own_file")
+	fetch := func(id, path string) error {
+		request := func(streamID uint32) any {
+			return MessageFetchObject{ID: id, Path: path, StreamID: streamID}
+		}
+		return s2.fetchOverStream(context.Background(), peer.RemoteAddr().String(), request, func(r io.Reader) (int64, error) {
+			return io.Copy(io.Discard, r)
+		})
+	}
+
+	for _, object := range [][2]string{
+		{s1.ID, path},
+		{"x", "../" + s1.ID + "/" + path},
+		{"x/..", s1.ID + "/" + path},
+		{"..", "x"},
+		{".meta", s1.ID + "/" + path},
+		{"", s1.ID + "/" + path},
+	}{
+		if err := fetch(object[0], object[1]); err == nil {
+			t.Errorf("fetched (%s/%s)", object[0], object[1])
+		}
+	}
+
+	// a file the store does not count as an object is not served either
+	if err := writeStorageFile(s1.store.Storage, "x/loose", []byte("loose")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetch("x", "loose"); err == nil {
+		t.Error("fetched a file that is not an object")
+	}
+
+	owner := generateId()
+	key := hashKey("replica")
+	if _, err := s1.store.Write(owner, key, bytes.NewReader([]byte("replica"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetch(owner, s1.store.pathOf(key)); err != nil {
+		t.Errorf("could not fetch a replica: %v", err)
+	}
+}
+
+func TestFileServerRefusesForeignWrites(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s1.peerList()) == 1 && len(s2.peerList()) == 1 })
+
+	if err := s2.StoreWithOptions(context.Background(), "own_file", bytes.NewReader([]byte("own")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// replicas sent to namespaces that are not the sender's to write to
+	key := "own_file"
+	ids := []string{s2.ID, "..", ".meta", "x/..", ""}
+	for _, id := range ids {
+		msg := MessageStoreFile{RequestID: generateId(), ID: id, Key: key, Size: 5}
+		streams, _, _ := s1.openStoreStreams(msg, s1.peerList())
+		s1.sendReplicas(context.Background(), streams, func(w io.Writer) (int, error) {
+			return w.Write([]byte("taken"))
+		})
+	}
+	// a replica sent afterwards is stored, by then the others were dealt with
+	if err := s1.StoreWithOptions(context.Background(), "after", bytes.NewReader([]byte("after")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range ids {
+		name := fmt.Sprintf("%s/%s", id, s2.store.pathOf(key))
+		if id != s2.ID && s2.store.Storage.Has(name) {
+			t.Errorf("replica was written to (%s)", name)
+		}
+	}
+	_, r, err := s2.store.Read(s2.ID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "own" {
+		t.Errorf("own file was overwritten with %s", b)
+	}
+	r.(io.Closer).Close()
+
+	// nor is a leaf a peer announces for such a namespace fetched
+	leaf := MerkleLeaf{ID: s2.ID, Path: s2.store.pathOf(key)}
+	if err := s2.fetchObject(context.Background(), s2.peerList()[0], leaf); err == nil {
+		t.Error("fetched into our own namespace")
+	}
+}
+
+func TestFileServerHintedHandoff(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t)
+	dial(t, s2, s1)
+	waitFor(t, func() bool { return len(s1.peerList()) == 1 })
+
+	// s2 goes down and misses the write
+	for _, peer := range s2.peerList(){
+		peer.Close()
+	}
+	waitFor(t, func() bool { return len(s1.peerList()) == 0 })
+
+	if err := s1.Store("hinted_file", bytes.NewReader([]byte("kept for later"))); err != nil {
+		t.Fatal(err)
+	}
+	if hints, _ := s1.hints.For(s2.ID); len(hints) != 1 {
+		t.Fatalf("want a hint for the down node have %v", hints)
+	}
+
+	dial(t, s2, s1)
+	waitFor(t, func() bool { return s2.store.Has(s1.ID, hashKey("hinted_file")) })
+	waitFor(t, func() bool {
+		hints, _ := s1.hints.For(s2.ID)
+		return len(hints) == 0
+	})
+}
+
+func TestFileServerReadRepair(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	s3 := newTestServer(t, s1, s2)
+	s4 := newTestServer(t, s1, s2, s3)
+	waitFor(t, func() bool { return len(s4.peerList()) == 3 })
+
+	ctx := context.Background()
+	if err := s4.StoreWithOptions(ctx, "repaired_file", bytes.NewReader([]byte("the good copy")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// s3's replica rots
+	if _, err := s3.store.Write(s4.ID, hashKey("repaired_file"), bytes.NewReader([]byte("rotten bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s4.store.Delete(s4.ID, "repaired_file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s4.Get("repaired_file"); err != nil {
+		t.Fatal(err)
+	}
+
+	readReplica := func(s *FileServer) string {
+		_, r, err := s.store.Read(s4.ID, hashKey("repaired_file"))
+		if err != nil {
+			return ""
+		}
+		defer r.(io.Closer).Close()
+		b, _ := io.ReadAll(r)
+		return string(b)
+	}
+	waitFor(t, func() bool {
+		return readReplica(s1) == readReplica(s2) && readReplica(s3) == readReplica(s1)
+	})
+}
+
+func TestFileServerReadRepairFromOwnCopy(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	s3 := newTestServer(t, s1, s2)
+	s4 := newTestServer(t, s1, s2, s3)
+	waitFor(t, func() bool { return len(s4.peerList()) == 3 })
+
+	ctx := context.Background()
+	if err := s4.StoreWithOptions(ctx, "owned_file", bytes.NewReader([]byte("the good copy")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := s1.store.Read(s4.ID, hashKey("owned_file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+
+	// most replicas agree on the same wrong version, but we hold our own
+	// copy and that is the one they get
+	for _, s := range []*FileServer{s2, s3} {
+		if _, err := s.store.Write(s4.ID, hashKey("owned_file"), bytes.NewReader([]byte("the wrong copy"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the stale replicas do not confirm our copy, but are repaired anyway
+	if _, err := s4.GetWithOptions(ctx, "owned_file", ReadOptions{Consistency: ConsistencyAll}); !errors.Is(err, ErrConsistencyNotMet) {
+		t.Fatalf("want %v have %v", ErrConsistencyNotMet, err)
+	}
+
+	waitFor(t, func() bool {
+		for _, s := range []*FileServer{s1, s2, s3} {
+			_, r, err := s.store.Read(s4.ID, hashKey("owned_file"))
+			if err != nil {
+				return false
+			}
+			b, _ := io.ReadAll(r)
+			r.(io.Closer).Close()
+			if !bytes.Equal(b, good) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestFileServerErasureCoding(t *testing.T) {
+	opts := FileServerOpts{DataShards: 2, ParityShards: 1}
+	s1 := newTestServerWithOpts(t, opts)
+	s2 := newTestServerWithOpts(t, opts, s1)
+	s3 := newTestServerWithOpts(t, opts, s1, s2)
+	s4 := newTestServerWithOpts(t, opts, s1, s2, s3)
+	waitFor(t, func() bool { return len(s4.peerList()) == 3 })
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("erasure coded "), 100)
+	if err := s4.StoreWithOptions(ctx, "coded_file", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every peer holds one shard and no full replica
+	holders := map[int]*FileServer{}
+	for _, s := range []*FileServer{s1, s2, s3}{
+		if s.store.Has(s4.ID, hashKey("coded_file")){
+			t.Errorf("(%s) holds a full replica", s.Transport.Addr())
+		}
+		for i := 0; i < 3; i++{
+			if s.store.Has(shardNamespace(s4.ID), shardKey("coded_file", i)){
+				holders[i] = s
+			}
+		}
+	}
+	if len(holders) != 3 {
+		t.Fatalf("want 3 shards placed have %d", len(holders))
+	}
+
+	// any two shards are enough to read the file back
+	if err := holders[0].store.Delete(shardNamespace(s4.ID), shardKey("coded_file", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s4.store.Delete(s4.ID, "coded_file"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s4.Get("coded_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+
+	if err := holders[1].store.Delete(shardNamespace(s4.ID), shardKey("coded_file", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s4.store.Delete(s4.ID, "coded_file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s4.Get("coded_file"); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("want %v have %v", ErrTooFewShards, err)
+	}
+
+	// a shard left over from an older version of the same size is not
+	// joined with the shards of the newer one
+	if err := s4.StoreWithOptions(ctx, "coded_file", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err = holders[0].store.Read(shardNamespace(s4.ID), shardKey("coded_file", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	newer := bytes.Repeat([]byte("coded again   "), 100)
+	if err := s4.StoreWithOptions(ctx, "coded_file", bytes.NewReader(newer), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := holders[0].store.Write(shardNamespace(s4.ID), shardKey("coded_file", 0), bytes.NewReader(old)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s4.store.Delete(s4.ID, "coded_file"); err != nil {
+		t.Fatal(err)
+	}
+	r, err = s4.Get("coded_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, newer) {
+		t.Errorf("want %s have %s", newer, b)
+	}
+
+	if err := holders[2].store.Delete(shardNamespace(s4.ID), shardKey("coded_file", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s4.store.Delete(s4.ID, "coded_file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s4.Get("coded_file"); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("want %v with one shard of each version have %v", ErrTooFewShards, err)
+	}
+}
+
+func TestFileServerChunking(t *testing.T) {
+	opts := FileServerOpts{Chunking: true}
+	s1 := newTestServerWithOpts(t, opts)
+	s2 := newTestServerWithOpts(t, opts, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	chunksOf := func(s *FileServer) int {
+		n := 0
+		s.store.walkObjects(func(id, path string, info StorageInfo) error {
+			if id == chunkNamespace {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	chunks := func() int { return chunksOf(s1) }
+
+	data := make([]byte, 256 << 10)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := bytes.Clone(data)
+	copy(edited[100 << 10:], "a small edit")
+
+	ctx := context.Background()
+	if err := s2.StoreWithOptions(ctx, "original", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	stored := chunks()
+	if stored < 2 {
+		t.Fatalf("want the file cut into several chunks have %d", stored)
+	}
+
+	// only the chunks around the edit are new
+	if err := s2.StoreWithOptions(ctx, "edited", bytes.NewReader(edited), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	if added := chunks() - stored; added < 1 || added > 3 {
+		t.Errorf("want at most 3 new chunks have %d", added)
+	}
+
+	// the owner keeps its own copies as manifests sharing the same chunks
+	if owned := chunksOf(s2); owned != chunks() {
+		t.Errorf("want the owner to hold the %d chunks its peer holds have %d", chunks(), owned)
+	}
+	if size, _ := s2.store.sizeOf(s2.store.objectName(s2.ID, "edited")); size >= int64(len(edited)) {
+		t.Errorf("want the owner's copy stored as a manifest have %d bytes", size)
+	}
+	meta, err := s2.Stat("edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != int64(len(edited)) {
+		t.Errorf("want size %d have %d", len(edited), meta.Size)
+	}
+	r, err := s2.Get("edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); !bytes.Equal(b, edited) {
+		t.Error("local copy read back differs from the one stored")
+	}
+
+	if err := s2.Delete("original"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !s1.store.Has(s2.ID, hashKey("original")) })
+	if want, owned := len(s2.chunkRefs.Replicas()[0].Chunks), chunksOf(s2); owned != want {
+		t.Errorf("want the chunks only the deleted file used dropped, %d of %d are left", owned, want)
+	}
+
+	if err := s2.store.Delete(s2.ID, "edited"); err != nil {
+		t.Fatal(err)
+	}
+	r, err = s2.Get("edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, edited) {
+		t.Error("file read back differs from the one stored")
+	}
+}
+
+func TestFileServerResumesDownloads(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s2.peerList()) == 1 })
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("resumable "), 1000)
+	if err := s2.StoreWithOptions(ctx, "resumed_file", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s1.store.Read(s2.ID, hashKey("resumed_file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	hash := sha256.Sum256(replica)
+	staged := stagingKey(hashKey("resumed_file"), hash[:])
+
+	readBack := func() {
+		t.Helper()
+
+		if err := s2.store.Delete(s2.ID, "resumed_file"); err != nil {
+			t.Fatal(err)
+		}
+		r, err := s2.Get("resumed_file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if !bytes.Equal(b, data) {
+			t.Error("file read back differs from the one stored")
+		}
+		if size := s2.store.StagedSize(s2.ID, staged); size != 0 {
+			t.Errorf("want the staged file dropped have %d bytes", size)
+		}
+	}
+
+	// an earlier transfer broke off half way, only the rest is fetched
+	if _, err := s2.store.WriteStaged(ctx, s2.ID, staged, 0, bytes.NewReader(replica[:len(replica) / 2])); err != nil {
+		t.Fatal(err)
+	}
+	readBack()
+
+	// what was staged got corrupted, the resumed file is rejected and
+	// fetched again
+	garbage := bytes.Repeat([]byte{'x'}, len(replica) / 2)
+	if _, err := s2.store.WriteStaged(ctx, s2.ID, staged, 0, bytes.NewReader(garbage)); err != nil {
+		t.Fatal(err)
+	}
+	readBack()
+}
+
+func TestFileServerRejectsCorruptReplicas(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	s3 := newTestServer(t, s1, s2)
+	waitFor(t, func() bool { return len(s3.peerList()) == 2 })
+
+	ctx := context.Background()
+	data := []byte("the bytes that were stored")
+	if err := s3.StoreWithOptions(ctx, "checked_file", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// s1's replica rots behind the store's back
+	path := fmt.Sprintf("%s/%s/%s", s1.store.Root, s3.ID, s1.store.pathOf(hashKey("checked_file")))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b) - 1] ^= 0xff
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	readReplica := func() error {
+		_, r, err := s1.store.Read(s3.ID, hashKey("checked_file"))
+		if err != nil {
+			return err
+		}
+		defer r.(io.Closer).Close()
+		_, err = io.ReadAll(r)
+		return err
+	}
+	if err := readReplica(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("want %v have %v", ErrCorrupt, err)
+	}
+
+	// the corrupt replica is never handed out, and once s1 finds out
+	// while serving it, it is repaired from the good one
+	var peer p2p.Peer
+	for _, p := range s3.peerList() {
+		if p.ID() == s1.ID {
+			peer = p
+		}
+	}
+	if _, err := s3.findObject(ctx, s3.ID, hashKey("checked_file"), []p2p.Peer{peer}); err == nil {
+		t.Error("corrupt replica was handed out")
+	}
+	waitFor(t, func() bool { return readReplica() == nil })
+
+	if err := s3.store.Delete(s3.ID, "checked_file"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s3.GetWithOptions(ctx, "checked_file", ReadOptions{Consistency: ConsistencyOne})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(r)
+	r.(io.Closer).Close()
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+}
+
+func TestFileServerScrubbing(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	s3 := newTestServer(t, s1, s2)
+	waitFor(t, func() bool { return len(s3.peerList()) == 2 })
+
+	ctx := context.Background()
+	data := []byte("the bytes that were stored")
+	if err := s3.StoreWithOptions(ctx, "scrubbed_file", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	rot := func(path string) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a replica is restored from a peer holding the same one
+	replica := s1.store.pathOf(hashKey("scrubbed_file"))
+	rot(fmt.Sprintf("%s/%s/%s", s1.store.Root, s3.ID, replica))
+
+	report, err := s1.Scrub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScrubResult{{ID: s3.ID, Path: replica, Repaired: true}}
+	if !reflect.DeepEqual(report.Corrupt, want) {
+		t.Errorf("want %+v have %+v", want, report.Corrupt)
+	}
+	if report.Checked != 1 {
+		t.Errorf("want 1 object checked have %d", report.Checked)
+	}
+	if !reflect.DeepEqual(s1.LastScrub(), report) {
+		t.Errorf("last scrub %+v is not %+v", s1.LastScrub(), report)
+	}
+	if _, err := s1.store.verifyPath(ctx, s3.ID, replica, nil); err != nil {
+		t.Error(err)
+	}
+
+	// our own file is fetched back from a replica by its recorded key
+	own := s3.store.pathOf("scrubbed_file")
+	rot(fmt.Sprintf("%s/%s/%s", s3.store.Root, s3.ID, own))
+
+	report, err = s3.Scrub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []ScrubResult{{ID: s3.ID, Path: own, Repaired: true}}
+	if !reflect.DeepEqual(report.Corrupt, want) {
+		t.Errorf("want %+v have %+v", want, report.Corrupt)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/%s/%s/%s", s3.store.Root, quarantineDirName, s3.ID, own)); err != nil {
+		t.Errorf("corrupt file was not quarantined: %s", err)
+	}
+
+	_, r, err := s3.store.Read(s3.ID, "scrubbed_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s (%v)", data, b, err)
+	}
+}
+
+func TestFileServerPropagatesMetadata(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t, s1)
+	waitFor(t, func() bool { return len(s1.peerList()) == 1 && len(s2.peerList()) == 1 })
+
+	ctx := context.Background()
+	tags := map[string]string{"owner": "finance", "year": "2024"}
+	opts := WriteOptions{Consistency: ConsistencyAll, ContentType: "text/csv", Tags: tags}
+	if err := s1.StoreWithOptions(ctx, "reports/q1.csv", bytes.NewReader([]byte("a,b,c")), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	own, err := s1.Stat("reports/q1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the replica carries the metadata, with the key only the owner can read
+	replica, err := s2.store.Stat(s1.ID, hashKey("reports/q1.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica.Key != hashKey("reports/q1.csv") || replica.ContentType != "text/csv" || !reflect.DeepEqual(replica.Tags, tags) {
+		t.Errorf("unexpected replica metadata %+v", replica)
+	}
+	if !replica.Created.Equal(own.Created) || !replica.Modified.Equal(own.Modified) {
+		t.Errorf("want the owner's times %s and %s have %s and %s", own.Created, own.Modified, replica.Created, replica.Modified)
+	}
+	key := new(bytes.Buffer)
+	if _, err := copyDecrypt(s1.EncKey, bytes.NewReader(replica.OwnerKey), key); err != nil || key.String() != "reports/q1.csv" {
+		t.Errorf("want the owner key to decrypt to the key have %q (%v)", key, err)
+	}
+
+	// fetching our own file back restores its metadata
+	if err := s1.store.Delete(s1.ID, "reports/q1.csv"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s1.Get("reports/q1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(r)
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+
+	fetched, err := s1.Stat("reports/q1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.ContentType != "text/csv" || !reflect.DeepEqual(fetched.Tags, tags) || len(fetched.OwnerKey) > 0 {
+		t.Errorf("unexpected metadata %+v", fetched)
+	}
+	if !fetched.Created.Equal(own.Created) {
+		t.Errorf("want created %s have %s", own.Created, fetched.Created)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// stagingDirName is the folder below the root partial transfers are
+	// kept in until they are complete.
+	stagingDirName = ".staging"
+	defaultStagingTTL = 24 * time.Hour
+)
+
+var ErrStagedMismatch = errors.New("staged file does not match the expected hash")
+
+func (s *Store) stagedName(id, key string) string{
+	return fmt.Sprintf("%s/%s", stagingDirName, s.objectName(id, key))
+}
+
+// StagedSize returns how many bytes of the file are staged, zero if none
+// are.
+func (s *Store) StagedSize(id, key string) int64{
+	info, err := s.Storage.Stat(s.stagedName(id, key))
+	if err != nil {
+		return 0
+	}
+	return info.Size
+}
+
+// WriteStaged cuts the staged file to offset and appends what r holds to
+// it. Unlike Write it keeps what was written when r fails, so the
+// transfer can resume from there. It fails if fewer than offset bytes are
+// staged. The staged bytes count against the quota of the namespace.
+func (s *Store) WriteStaged(ctx context.Context, id, key string, offset int64, r io.Reader) (int64, error){
+	name := s.stagedName(id, key)
+	before, _ := s.sizeOf(name)
+	n, err := s.Storage.Append(name, offset, contextReader{ctx: ctx, r: r})
+	after, _ := s.sizeOf(name)
+	s.stage(id, after - before)
+	return n, err
+}
+
+// ReadStaged opens the staged file.
+func (s *Store) ReadStaged(id, key string) (int64, io.ReadCloser, error){
+	return s.Storage.Read(s.stagedName(id, key))
+}
+
+// Promote moves the file staged under stagedKey by the namespace stagedID
+// in place of the file stored under key in the namespace id, once its
+// SHA-256 is want. It records meta along with it as WriteWithMeta does,
+// and counts it against the quota of the namespace stagedID in place of
+// the staged bytes. A staged file that does not match is discarded, it
+// cannot be completed any more. An empty want promotes the file as it
+// is.
+func (s *Store) Promote(stagedID, stagedKey, id, key string, want []byte, meta ObjectMeta) error{
+	staged := s.stagedName(stagedID, stagedKey)
+	size, hash, err := s.fileHash(staged)
+	if err != nil {
+		return err
+	}
+	if len(want) > 0 && !bytes.Equal(hash, want) {
+		s.DiscardStaged(stagedID, stagedKey)
+		return ErrStagedMismatch
+	}
+
+	name := s.objectName(id, key)
+	meta = meta.userMeta()
+	meta.Key = key
+	if stagedID != id {
+		meta.ChargedTo = stagedID
+	}
+	s.stage(stagedID, -size)
+	if err := s.placeObject(stagedID, id, staged, name, meta, size, hash); err != nil {
+		s.stage(stagedID, size)
+		return err
+	}
+	return nil
+}
+
+// DiscardStaged removes the staged file.
+func (s *Store) DiscardStaged(id, key string) error{
+	name := s.stagedName(id, key)
+	size, _ := s.sizeOf(name)
+	if err := s.Storage.Delete(name); err != nil {
+		return err
+	}
+	s.stage(id, -size)
+	return nil
+}
+
+// ExpireStaged removes the staged files nobody added to for longer than
+// ttl, the transfers they belong to are not going to resume. The temp
+// files of writes a crash interrupted are removed along with them.
+func (s *Store) ExpireStaged(ttl time.Duration) error{
+	expired := []string{}
+	err := s.Storage.List("", func(info StorageInfo) error {
+		if !isTempFile(path.Base(info.Name)) && !strings.HasPrefix(info.Name, stagingDirName + "/") {
+			return nil
+		}
+		if time.Since(info.ModTime) > ttl {
+			expired = append(expired, info.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range expired {
+		size, _ := s.sizeOf(name)
+		if err := s.Storage.Delete(name); err != nil {
+			return err
+		}
+		if id, _, ok := strings.Cut(strings.TrimPrefix(name, stagingDirName + "/"), "/"); ok && strings.HasPrefix(name, stagingDirName + "/") {
+			s.stage(id, -size)
+		}
+	}
+	return nil
+}
+
+// fileHash returns the size and SHA-256 of the file by the name.
+func (s *Store) fileHash(name string) (int64, []byte, error){
+	_, r, err := s.Storage.Read(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, hash.Sum(nil), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStoreStaging(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	ctx := context.Background()
+	id := generateId()
+	data := []byte("some staged bytes")
+	hash := sha256.Sum256(data)
+
+	if _, err := s.WriteStaged(ctx, id, "staged", 0, bytes.NewReader(data[:5])); err != nil {
+		t.Fatal(err)
+	}
+	if size := s.StagedSize(id, "staged"); size != 5 {
+		t.Fatalf("want 5 bytes staged have %d", size)
+	}
+	if s.Has(id, "key") {
+		t.Error("staged file is visible before it is promoted")
+	}
+
+	if _, err := s.WriteStaged(ctx, id, "staged", 10, bytes.NewReader(data[10:])); err == nil {
+		t.Error("resumed past the staged bytes")
+	}
+	if _, err := s.WriteStaged(ctx, id, "staged", 5, bytes.NewReader(data[5:])); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Promote(id, "staged", id, "key", hash[:], ObjectMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := s.Read(id, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+
+	// a staged file that does not match is dropped
+	if _, err := s.WriteStaged(ctx, id, "staged", 0, bytes.NewReader([]byte("other bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Promote(id, "staged", id, "key", hash[:], ObjectMeta{}); !errors.Is(err, ErrStagedMismatch) {
+		t.Errorf("want %v have %v", ErrStagedMismatch, err)
+	}
+	if size := s.StagedSize(id, "staged"); size != 0 {
+		t.Errorf("want mismatching file discarded have %d bytes staged", size)
+	}
+
+	if _, err := s.WriteStaged(ctx, id, "old", 0, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExpireStaged(-time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if size := s.StagedSize(id, "old"); size != 0 {
+		t.Errorf("want expired file removed have %d bytes staged", size)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is where a Store keeps its files: the objects, the metadata
+// recorded with them, staged transfers and the store's own bookkeeping.
+// Files are addressed by slash separated names.
+type Storage interface{
+	Has(name string) bool
+	// Stat fails with fs.ErrNotExist if there is no file by the name.
+	Stat(name string) (StorageInfo, error)
+	Read(name string) (int64, io.ReadCloser, error)
+	// Write replaces the file with what r holds. The file is only
+	// replaced once all of r was written, a failed write leaves the old
+	// one as it was.
+	Write(name string, r io.Reader) (int64, error)
+	// Append cuts the file to offset and appends what r holds, keeping
+	// what was appended if r fails. A missing file counts as empty, one
+	// shorter than offset cannot be appended to.
+	Append(name string, offset int64, r io.Reader) (int64, error)
+	// Rename moves the file to the new name, replacing the file there.
+	Rename(from, to string) error
+	// Delete removes the file. A missing file is not an error.
+	Delete(name string) error
+	// List calls fn for every file whose name starts with prefix, in no
+	// particular order.
+	List(prefix string, fn func(StorageInfo) error) error
+	// Clear removes every file.
+	Clear() error
+}
+
+type StorageInfo struct{
+	Name string
+	Size int64
+	ModTime time.Time
+}
+
+// readStorageFile reads the whole file.
+func readStorageFile(storage Storage, name string) ([]byte, error){
+	_, r, err := storage.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// writeStorageFile replaces the file with one holding b.
+func writeStorageFile(storage Storage, name string, b []byte) error{
+	_, err := storage.Write(name, bytes.NewReader(b))
+	return err
+}
+
+// errShortFile is returned when appending past the end of a file.
+func errShortFile(offset, size int64) error{
+	return fmt.Errorf("cannot append at offset %d, the file only holds %d bytes", offset, size)
+}
+
+// DiskStorage keeps every file as a file of its own below a root folder.
+type DiskStorage struct{
+	root string
+	// durable also syncs the folder a file is renamed into, so the file
+	// is still there after a power loss and not just after a crash of
+	// the process.
+	durable bool
+}
+
+func NewDiskStorage(root string, durable bool) *DiskStorage{
+	return &DiskStorage{
+		root: root,
+		durable: durable,
+	}
+}
+
+func (d *DiskStorage) path(name string) string{
+	return fmt.Sprintf("%s/%s", d.root, name)
+}
+
+func (d *DiskStorage) Has(name string) bool{
+	_, err := os.Stat(d.path(name))
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+func (d *DiskStorage) Stat(name string) (StorageInfo, error){
+	fi, err := os.Stat(d.path(name))
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (d *DiskStorage) Read(name string) (int64, io.ReadCloser, error){
+	file, err := os.Open(d.path(name))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	return fi.Size(), file, nil
+}
+
+// Write writes a temp file next to the file, syncs it and renames it
+// into place.
+func (d *DiskStorage) Write(name string, r io.Reader) (int64, error){
+	path := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "." + filepath.Base(path) + tempFileMarker + "*")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err == nil && d.durable {
+		err = syncDir(filepath.Dir(path))
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return n, err
+}
+
+// Append syncs what it appended, so it can be relied on after a crash.
+func (d *DiskStorage) Append(name string, offset int64, r io.Reader) (int64, error){
+	path := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() < offset {
+		return 0, errShortFile(offset, fi.Size())
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+func (d *DiskStorage) Rename(from, to string) error{
+	path := d.path(to)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(d.path(from), path); err != nil {
+		return err
+	}
+
+	if d.durable {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// Delete removes the file and the folders it leaves empty, up to the
+// top folder of its name. Other files that share part of its path are
+// left alone.
+func (d *DiskStorage) Delete(name string) error{
+	err := os.Remove(d.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for dir := path.Dir(name); strings.Contains(dir, "/"); dir = path.Dir(dir) {
+		if os.Remove(d.path(dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *DiskStorage) List(prefix string, fn func(StorageInfo) error) error{
+	// only the folder the prefix ends in needs to be walked
+	dir := d.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = d.path(prefix[:i])
+	}
+
+	return filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		// what was removed while we were walking is skipped
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(StorageInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+// Clear removes the root folder with everything in it.
+func (d *DiskStorage) Clear() error{
+	return os.RemoveAll(d.root)
+}
+
+// syncDir syncs the folder, persisting the files renamed into it.
+func syncDir(path string) error{
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// MemoryStorage keeps every file in memory, for stores that need not
+// outlive the process and for tests.
+type MemoryStorage struct{
+	lock sync.RWMutex
+	files map[string]memoryFile
+}
+
+// memoryFile is never changed once stored, readers may still hold its
+// data while it is replaced.
+type memoryFile struct{
+	data []byte
+	modTime time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage{
+	return &MemoryStorage{
+		files: make(map[string]memoryFile),
+	}
+}
+
+func (m *MemoryStorage) Has(name string) bool{
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.files[name]
+	return ok
+}
+
+func (m *MemoryStorage) Stat(name string) (StorageInfo, error){
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return StorageInfo{}, fmt.Errorf("stat %s: %w", name, fs.ErrNotExist)
+	}
+	return StorageInfo{Name: name, Size: int64(len(file.data)), ModTime: file.modTime}, nil
+}
+
+func (m *MemoryStorage) Read(name string) (int64, io.ReadCloser, error){
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return 0, nil, fmt.Errorf("open %s: %w", name, fs.ErrNotExist)
+	}
+	return int64(len(file.data)), io.NopCloser(bytes.NewReader(file.data)), nil
+}
+
+func (m *MemoryStorage) Write(name string, r io.Reader) (int64, error){
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.files[name] = memoryFile{data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+func (m *MemoryStorage) Append(name string, offset int64, r io.Reader) (int64, error){
+	m.lock.RLock()
+	size := int64(len(m.files[name].data))
+	m.lock.RUnlock()
+	if size < offset {
+		return 0, errShortFile(offset, size)
+	}
+
+	appended, err := io.ReadAll(r)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old := m.files[name].data
+	if int64(len(old)) < offset {
+		return 0, errShortFile(offset, int64(len(old)))
+	}
+	data := make([]byte, 0, offset + int64(len(appended)))
+	data = append(append(data, old[:offset]...), appended...)
+	m.files[name] = memoryFile{data: data, modTime: time.Now()}
+	return int64(len(appended)), err
+}
+
+func (m *MemoryStorage) Rename(from, to string) error{
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	file, ok := m.files[from]
+	if !ok {
+		return fmt.Errorf("rename %s: %w", from, fs.ErrNotExist)
+	}
+	delete(m.files, from)
+	m.files[to] = file
+	return nil
+}
+
+func (m *MemoryStorage) Delete(name string) error{
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.files, name)
+	return nil
+}
+
+// List calls fn without holding on to the storage, fn may change it.
+func (m *MemoryStorage) List(prefix string, fn func(StorageInfo) error) error{
+	m.lock.RLock()
+	infos := []StorageInfo{}
+	for name, file := range m.files {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, StorageInfo{Name: name, Size: int64(len(file.data)), ModTime: file.modTime})
+		}
+	}
+	m.lock.RUnlock()
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Clear() error{
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.files = make(map[string]memoryFile)
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/iotest"
+)
+
+// storageBackends returns a fresh storage of every kind.
+func storageBackends(t *testing.T) map[string]Storage {
+	packed, err := OpenPackedStorage(filepath.Join(t.TempDir(), "store.pack"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packed.Close() })
+	segments, err := OpenSegmentStorage(SegmentStorageOpts{Dir: t.TempDir(), MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { segments.Close() })
+
+	return map[string]Storage{
+		"disk": NewDiskStorage(t.TempDir(), false),
+		"memory": NewMemoryStorage(),
+		"packed": packed,
+		"segments": segments,
+	}
+}
+
+func readAll(t *testing.T, storage Storage, name string) string {
+	t.Helper()
+
+	b, err := readStorageFile(storage, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestStorage(t *testing.T) {
+	for kind, storage := range storageBackends(t) {
+		t.Run(kind, func(t *testing.T) {
+			if storage.Has("a/b") {
+				t.Fatal("empty storage has a file")
+			}
+			if _, err := storage.Stat("a/b"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("want %v have %v", fs.ErrNotExist, err)
+			}
+			if _, _, err := storage.Read("a/b"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("want %v have %v", fs.ErrNotExist, err)
+			}
+
+			if err := writeStorageFile(storage, "a/b", []byte("some content")); err != nil {
+				t.Fatal(err)
+			}
+			if info, err := storage.Stat("a/b"); err != nil || info.Size != 12 || info.Name != "a/b" {
+				t.Errorf("unexpected %+v (%v)", info, err)
+			}
+			if have := readAll(t, storage, "a/b"); have != "some content" {
+				t.Errorf("want some content have %s", have)
+			}
+
+			// a failed write leaves the old file as it was
+			if _, err := storage.Write("a/b", iotest.ErrReader(io.ErrUnexpectedEOF)); err == nil {
+				t.Error("write of a failing reader succeeded")
+			}
+			if have := readAll(t, storage, "a/b"); have != "some content" {
+				t.Errorf("want some content have %s", have)
+			}
+
+			// appending cuts the file to the offset first, and keeps what
+			// was appended before the reader failed
+			if _, err := storage.Append("a/b", 4, bytes.NewReader([]byte(" more"))); err != nil {
+				t.Fatal(err)
+			}
+			failing := io.MultiReader(bytes.NewReader([]byte(" and")), iotest.ErrReader(io.ErrUnexpectedEOF))
+			if n, err := storage.Append("a/b", 9, failing); err == nil || n != 4 {
+				t.Errorf("want 4 bytes appended and an error have %d (%v)", n, err)
+			}
+			if have := readAll(t, storage, "a/b"); have != "some more and" {
+				t.Errorf("want some more and have %s", have)
+			}
+			if _, err := storage.Append("a/b", 100, bytes.NewReader(nil)); err == nil {
+				t.Error("appended past the end of the file")
+			}
+			if _, err := storage.Append("a/c", 0, bytes.NewReader([]byte("new"))); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := storage.Rename("a/c", "d/e"); err != nil {
+				t.Fatal(err)
+			}
+			if storage.Has("a/c") || readAll(t, storage, "d/e") != "new" {
+				t.Error("file was not renamed")
+			}
+			if err := storage.Rename("a/c", "d/e"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("want %v have %v", fs.ErrNotExist, err)
+			}
+
+			names := []string{}
+			err := storage.List("a/", func(info StorageInfo) error {
+				names = append(names, info.Name)
+				return nil
+			})
+			if err != nil || len(names) != 1 || names[0] != "a/b" {
+				t.Errorf("want [a/b] have %v (%v)", names, err)
+			}
+
+			if err := storage.Delete("a/b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.Delete("a/b"); err != nil {
+				t.Errorf("deleting a missing file failed: %v", err)
+			}
+			if storage.Has("a/b") {
+				t.Error("deleted file is still there")
+			}
+
+			if err := storage.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			if storage.Has("d/e") {
+				t.Error("file survived clearing the storage")
+			}
+		})
+	}
+}
+
+func TestPackedStorageReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.pack")
+	storage, err := OpenPackedStorage(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeStorageFile(storage, "kept", []byte("kept"))
+	writeStorageFile(storage, "renamed", []byte("renamed"))
+	writeStorageFile(storage, "deleted", []byte("deleted"))
+	storage.Append("kept", 4, bytes.NewReader([]byte(" and appended")))
+	storage.Rename("renamed", "moved")
+	storage.Delete("deleted")
+	storage.Close()
+
+	// a record cut off by a crash is dropped
+	f, err := os.OpenFile(path, os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(packedRecord{op: packedOpWrite, name: "torn", data: []byte("torn")}.encode()[:20])
+	f.Close()
+
+	storage, err = OpenPackedStorage(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	names := []string{}
+	storage.List("", func(info StorageInfo) error {
+		names = append(names, info.Name)
+		return nil
+	})
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "kept" || names[1] != "moved" {
+		t.Errorf("want [kept moved] have %v", names)
+	}
+	if have := readAll(t, storage, "kept"); have != "kept and appended" {
+		t.Errorf("want kept and appended have %s", have)
+	}
+
+	// the pack is written on from the end of the last good record
+	if err := writeStorageFile(storage, "after", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+	storage, err = OpenPackedStorage(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := readAll(t, storage, "after"); have != "after" {
+		t.Errorf("want after have %s", have)
+	}
+}
+
+func TestPackedStorageBadLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.pack")
+	storage, err := OpenPackedStorage(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeStorageFile(storage, "kept", []byte("kept"))
+	storage.Close()
+
+	// a header saying the record is far longer than the pack is dropped
+	// without allocating for it
+	record := packedRecord{op: packedOpWrite, name: "huge", data: []byte("huge")}.encode()
+	binary.BigEndian.PutUint64(record[25:33], 1 << 62)
+	f, err := os.OpenFile(path, os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(record)
+	f.Close()
+
+	storage, err = OpenPackedStorage(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if storage.Has("huge") || readAll(t, storage, "kept") != "kept" {
+		t.Error("record with a bad length was not dropped")
+	}
+}
+
+func TestStoreOnEveryStorage(t *testing.T) {
+	for kind, storage := range storageBackends(t) {
+		t.Run(kind, func(t *testing.T) {
+			s := NewStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Storage: storage})
+			id := generateId()
+			data := []byte("some jpg bytes")
+
+			if _, err := s.Write(id, "photo.jpg", bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			_, r, err := s.Read(id, "photo.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+				t.Errorf("want %s have %s (%v)", data, b, err)
+			}
+			if keys, err := s.List(id, ""); err != nil || len(keys) != 1 || keys[0] != "photo.jpg" {
+				t.Errorf("want [photo.jpg] have %v (%v)", keys, err)
+			}
+
+			if _, err := s.WriteStaged(context.Background(), id, "staged", 0, bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Promote(id, "staged", id, "promoted", nil, ObjectMeta{}); err != nil {
+				t.Fatal(err)
+			}
+			if meta, err := s.Stat(id, "promoted"); err != nil || meta.Size != int64(len(data)) {
+				t.Errorf("unexpected %+v (%v)", meta, err)
+			}
+
+			if err := s.Delete(id, "photo.jpg"); err != nil {
+				t.Fatal(err)
+			}
+			if s.Has(id, "photo.jpg") {
+				t.Error("deleted file is still there")
+			}
+			if keys, _ := s.List(id, ""); len(keys) != 1 || keys[0] != "promoted" {
+				t.Errorf("want [promoted] have %v", keys)
+			}
+		})
+	}
+}
+
+func TestFileServerOnMemoryStorage(t *testing.T) {
+	s1 := newTestServerWithOpts(t, FileServerOpts{Storage: NewMemoryStorage()})
+	s2 := newTestServerWithOpts(t, FileServerOpts{Storage: NewMemoryStorage()}, s1)
+	waitFor(t, func() bool { return len(s1.peerList()) == 1 && len(s2.peerList()) == 1 })
+
+	data := []byte("kept in memory")
+	if err := s1.StoreWithOptions(context.Background(), "memory_file", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.store.Delete(s1.ID, "memory_file"); err != nil {
+		t.Fatal(err)
+	}
+
+	// fetched back from the replica s2 holds in memory
+	r, err := s1.Get("memory_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s (%v)", data, b, err)
+	}
+
+	for _, s := range []*FileServer{s1, s2} {
+		entries, err := os.ReadDir(s.store.Root)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(err)
+		}
+		if len(entries) > 0 {
+			t.Errorf("server wrote %d files to disk", len(entries))
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
-	"os"
+	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultRootFolderName = "GGNetwork"
@@ -58,10 +61,25 @@ type StoreOpts struct{
 	// Root is the folder name of the root, containing all the files and folders of the system
 	Root string
 	PathTransformFunc PathTransformFunc
+	// Durable also syncs the folder a file is renamed into after every
+	// write, so the file is still there after a power loss and not just
+	// after a crash of the process.
+	Durable bool
+	// Storage keeps the store's files, a DiskStorage below Root if it is
+	// not set.
+	Storage Storage
+	// Quotas caps what the namespaces hold, by their ID. The ones not
+	// listed are capped by DefaultQuota.
+	Quotas map[string]Quota
+	DefaultQuota Quota
 }
 
 type Store struct{
 	StoreOpts
+	index *keyIndex
+	usage *usageTracker
+	leaves *leafSet
+	locks *nameLocks
 }
 
 var DefaultPathTransformFunc = func (key string) PathKey {
@@ -80,24 +98,52 @@ func NewStore(opts StoreOpts) *Store{
 		opts.Root = defaultRootFolderName
 	}
 
-	return &Store{
+	if opts.Storage == nil {
+		opts.Storage = NewDiskStorage(opts.Root, opts.Durable)
+	}
+
+	s := &Store{
 		StoreOpts: opts,
+		locks: &nameLocks{names: make(map[string]*nameLock)},
+	}
+
+	index, err := loadKeyIndex(opts.Storage, keyIndexFileName, s.rebuildKeyIndex)
+	if err != nil {
+		log.Printf("could not load the key index, some keys may not be listed: %s", err)
 	}
+	s.index = index
+	s.leaves, s.usage = s.loadObjects()
+
+	return s
+}
+
+// objectName returns the name the object stored under key has in the
+// storage.
+func (s *Store) objectName(id, key string) string{
+	return fmt.Sprintf("%s/%s", id, s.pathOf(key))
 }
 
 func (s *Store) Has(id, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.fullPath())
+	return s.Storage.Has(s.objectName(id, key))
+}
 
-	_, err := os.Stat(fullPathWithRoot)
-	return !errors.Is(err, fs.ErrNotExist)
-	
+// modTime returns when the file was last written.
+func (s *Store) modTime(id, key string) (time.Time, error){
+	info, err := s.Storage.Stat(s.objectName(id, key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime, nil
 }
 
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	s.index.Reset()
+	s.usage.reset()
+	s.leaves.Reset()
+	return s.Storage.Clear()
 }
 
+// Delete removes the file along with its metadata.
 func (s *Store) Delete(id, key string) error{
 	pathKey := s.PathTransformFunc(key)
 
@@ -105,69 +151,362 @@ func (s *Store) Delete(id, key string) error{
 		log.Printf("deleted [%s] from disk", pathKey.FileName)
 	}()
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id,pathKey.FirstPathName())		
+	name := s.objectName(id, key)
+	unlock := s.locks.acquire(name)
+	defer unlock()
 
-	return os.RemoveAll(firstPathNameWithRoot)
+	size, existed := s.sizeOf(name)
+	account := s.chargedTo(name)
+	if err := s.Storage.Delete(name); err != nil {
+		return err
+	}
+	if existed {
+		s.release(account, size)
+	}
+	s.leaves.Remove(id, s.pathOf(key))
+	if err := s.Storage.Delete(metaName(name)); err != nil {
+		return err
+	}
+	return s.index.Remove(id, key)
 }
 
 func (s *Store) Write(id string,key string, r io.Reader) (int64, error){
 	return s.writeStream(id, key, r)
 }
 
+// WriteContext is like Write but stops copying once ctx is done, removing
+// the partially written file.
+func (s *Store) WriteContext(ctx context.Context, id string, key string, r io.Reader) (int64, error){
+	return s.writeStreamContext(ctx, id, key, r)
+}
+
+// WriteWithMeta is like WriteContext but records the content type, tags,
+// owner key and times meta holds along with the file. The times that are
+// not set default to now, keeping when the file was first created if it
+// is being replaced. The file counts against the quota of the namespace
+// meta.ChargedTo names, if it names one.
+func (s *Store) WriteWithMeta(ctx context.Context, id string, key string, r io.Reader, meta ObjectMeta) (int64, error){
+	chargedTo := meta.ChargedTo
+	meta = meta.userMeta()
+	meta.Key = key
+	meta.ChargedTo = chargedTo
+	return s.writeObject(ctx, id, s.objectName(id, key), r, meta)
+}
+
 func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader)(int64, error){
-	f, err := s.openFileForWriting(id, key)
+	return s.WriteDecryptContext(context.Background(), encKey, id, key, r)
+}
+
+// WriteDecryptContext is like WriteDecrypt but stops copying once ctx is
+// done, removing the partially written file.
+func (s *Store) WriteDecryptContext(ctx context.Context, encKey []byte, id string, key string, r io.Reader)(int64, error){
+	return s.WriteDecryptWithMeta(ctx, encKey, id, key, r, ObjectMeta{})
+}
+
+// WriteDecryptWithMeta is like WriteDecryptContext but records meta along
+// with the file, see WriteWithMeta.
+func (s *Store) WriteDecryptWithMeta(ctx context.Context, encKey []byte, id string, key string, r io.Reader, meta ObjectMeta)(int64, error){
+	pr, pw := io.Pipe()
+	go func ()  {
+		_, err := copyDecrypt(encKey, contextReader{ctx: ctx, r: r}, pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	return s.WriteWithMeta(ctx, id, key, pr, meta)
+}
+
+// writeObject writes the object to a temp file first, counts it against
+// the quota of its namespace, or the one meta.ChargedTo names, and only
+// then puts it in place along with its metadata, so a partial file is
+// never reported by Has and a complete one never lacks its metadata.
+func (s *Store) writeObject(ctx context.Context, id, name string, r io.Reader, meta ObjectMeta) (int64, error){
+	account := meta.ChargedTo
+	if len(account) == 0 || account == id {
+		account = id
+		meta.ChargedTo = ""
+	}
+
+	tmp := tempName(name)
+	hash := sha256.New()
+	r = s.quotaReader(account, name, contextReader{ctx: ctx, r: r})
+	n, err := s.Storage.Write(tmp, io.TeeReader(r, hash))
+	if err == nil {
+		err = s.placeObject(account, id, tmp, name, meta, n, hash.Sum(nil))
+	}
+
 	if err != nil {
-		return 0, err
+		s.Storage.Delete(tmp)
 	}
+	return n, err
+}
+
+// placeObject renames the complete file from into place as the object by
+// the name, counting it against the namespace account and recording meta
+// along with it. The object is locked meanwhile, and its metadata is
+// written to a temp file that only replaces the old one once the file
+// did, so the hash recorded always matches the file in place.
+func (s *Store) placeObject(account, id, from, name string, meta ObjectMeta, size int64, hash []byte) error{
+	unlock := s.locks.acquire(name)
+	defer unlock()
 
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+	uncharge, err := s.charge(account, name, size)
+	if err != nil {
+		return err
+	}
+
+	metaTmp := tempName(metaName(name))
+	err = s.writeMetaFile(metaTmp, s.completeMeta(name, meta, size, hash))
+	if err == nil && len(meta.Key) > 0 {
+		err = s.index.Add(id, meta.Key)
+	}
+	if err == nil {
+		err = s.Storage.Rename(from, name)
+	}
+	if err != nil {
+		s.Storage.Delete(metaTmp)
+		uncharge()
+		return err
+	}
+
+	if err := s.Storage.Rename(metaTmp, metaName(name)); err != nil {
+		// the file cannot be told from a corrupt one without its
+		// metadata, so it goes as well
+		s.Storage.Delete(metaTmp)
+		s.Storage.Delete(metaName(name))
+		s.Storage.Delete(name)
+		s.release(account, size)
+		s.leaves.Remove(id, strings.TrimPrefix(name, id + "/"))
+		if len(meta.Key) > 0 {
+			s.index.Remove(id, meta.Key)
+		}
+		return err
+	}
+
+	s.addLeaf(id, name, hash)
+	return nil
 }
 
-func (s *Store) openFileForWriting(id, key string)(*os.File, error){
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id,pathKey.PathName)
+// tempName returns a name for a temp file next to the file with the
+// given name.
+func tempName(name string) string{
+	dir, base := path.Split(name)
+	return dir + "." + base + tempFileMarker + generateId()[:16]
+}
 
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
+// nameLocks locks objects by their name, so an object is replaced,
+// deleted or opened by one caller at a time.
+type nameLocks struct{
+	lock sync.Mutex
+	names map[string]*nameLock
+}
+
+type nameLock struct{
+	sync.Mutex
+	// waiting counts the callers holding or waiting for the lock, it is
+	// dropped once there are none
+	waiting int
+}
+
+// acquire locks the object by the name, returning the func that unlocks
+// it.
+func (l *nameLocks) acquire(name string) func(){
+	l.lock.Lock()
+	nl, ok := l.names[name]
+	if !ok {
+		nl = &nameLock{}
+		l.names[name] = nl
+	}
+	nl.waiting++
+	l.lock.Unlock()
+
+	nl.Lock()
+	return func() {
+		nl.Unlock()
+
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		nl.waiting--
+		if nl.waiting == 0 {
+			delete(l.names, name)
+		}
 	}
+}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.fullPath())
+// tempFileMarker is part of the name of every temp file, so they are
+// never mistaken for objects.
+const tempFileMarker = ".tmp-"
 
-	return os.Create(fullPathWithRoot)
+func isTempFile(name string) bool{
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempFileMarker)
 }
 
 func (s *Store) writeStream(id, key string, r io.Reader) (int64,error){
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
+	return s.writeStreamContext(context.Background(), id, key, r)
+}
+
+func (s *Store) writeStreamContext(ctx context.Context, id, key string, r io.Reader) (int64,error){
+	return s.WriteWithMeta(ctx, id, key, r, ObjectMeta{})
+}
+
+// completeMeta fills in what the store records on its own into the
+// metadata of the file about to take the place of the one by the name.
+func (s *Store) completeMeta(name string, meta ObjectMeta, size int64, hash []byte) ObjectMeta{
+	meta.Size = size
+	meta.Hash = hash
+	if meta.Modified.IsZero() {
+		meta.Modified = time.Now()
 	}
-	return io.Copy(f, r)
+	if meta.Created.IsZero() {
+		meta.Created = meta.Modified
+		if old, err := s.readMeta(name); err == nil && !old.Created.IsZero() {
+			meta.Created = old.Created
+		}
+	}
+	return meta
 }
 
 func (s *Store) Read(id, key string) (int64, io.Reader, error){
 	return s.readStream(id, key)
 }
 
+// readStream opens the file for reading. Reading it to the end fails with
+// ErrCorrupt if it no longer matches the hash recorded when it was
+// written.
 func (s *Store) readStream(id, key string)(int64, io.ReadCloser, error){
-	pathKey := s.PathTransformFunc(key) 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s",s.Root,id, pathKey.fullPath())
+	return s.openVerified(s.objectName(id, key))
+}
 
-	// fi, err := os.Stat(fullPathWithRoot)
-	// if err != nil {
-	// 	return 0, nil, err
-	// }
+// walkObjects calls fn for every object in the store with the namespace
+// it belongs to and its path below that namespace.
+func (s *Store) walkObjects(fn func(id, path string, info StorageInfo) error) error{
+	return s.Storage.List("", func(info StorageInfo) error {
+		// files right below the root are the store's own bookkeeping,
+		// and so are the folders starting with a dot
+		id, rest, ok := strings.Cut(info.Name, "/")
+		if !ok || strings.HasPrefix(id, ".") || isTempFile(path.Base(rest)) {
+			return nil
+		}
+		return fn(id, rest, info)
+	})
+}
 
-	file, err := os.Open(fullPathWithRoot)
+// loadObjects builds the leaf of every object in the store from the hash
+// in its metadata, and counts what every namespace holds. Only the
+// objects written before hashes were recorded are read.
+func (s *Store) loadObjects() (*leafSet, *usageTracker){
+	leaves := newLeafSet()
+	usage := &usageTracker{usage: make(map[string]Usage)}
+	err := s.walkObjects(func(id, path string, info StorageInfo) error {
+		name := fmt.Sprintf("%s/%s", id, path)
+		meta, _ := s.readMeta(name)
+		account := id
+		if len(meta.ChargedTo) > 0 {
+			account = meta.ChargedTo
+		}
+		usage.add(account, Usage{Bytes: info.Size, Objects: 1})
+
+		hash := meta.Hash
+		if len(hash) == 0 {
+			_, fileHash, err := s.fileHash(name)
+			if err != nil {
+				return err
+			}
+			hash = fileHash
+		}
+		leaves.Set(MerkleLeaf{ID: id, Path: path, Hash: hash, ModTime: info.ModTime})
+		return nil
+	})
+	if err == nil {
+		err = s.loadStaged(usage)
+	}
 	if err != nil {
+		log.Printf("could not list the objects of the store, their usage starts out too low and anti-entropy misses some: %s", err)
+	}
+	return leaves, usage
+}
+
+// addLeaf records the object by the name that was just put in place.
+func (s *Store) addLeaf(id, name string, hash []byte){
+	modTime := time.Now()
+	if info, err := s.Storage.Stat(name); err == nil {
+		modTime = info.ModTime
+	}
+	s.leaves.Set(MerkleLeaf{ID: id, Path: strings.TrimPrefix(name, id + "/"), Hash: hash, ModTime: modTime})
+}
+
+// pathOf returns the path the object stored under key has below its
+// namespace, the same path walkObjects reports.
+func (s *Store) pathOf(key string) string{
+	return s.PathTransformFunc(key).fullPath()
+}
+
+// checkObjectPath fails unless the object at path below the namespace id
+// stays within it. A namespace is a single path element that does not
+// start with a dot, the store's own folders do.
+func checkObjectPath(id, path string) error{
+	if strings.Contains(id, "/") || strings.HasPrefix(id, ".") || !fs.ValidPath(id + "/" + path) {
+		return fmt.Errorf("invalid object path (%s/%s)", id, path)
+	}
+	return nil
+}
+
+// readPath is like Read but addresses the object by its path.
+func (s *Store) readPath(id, path string) (int64, io.ReadCloser, error){
+	if err := checkObjectPath(id, path); err != nil {
 		return 0, nil, err
 	}
 
-	fi ,err := file.Stat()
-	if err != nil {
-		return 0, nil ,err
+	return s.openVerified(fmt.Sprintf("%s/%s", id, path))
+}
+
+// writePathContext is like WriteWithMeta but addresses the object by its
+// path, with the key it is stored under taken from meta.
+func (s *Store) writePathContext(ctx context.Context, id, path string, r io.Reader, meta ObjectMeta) (int64, error){
+	if err := checkObjectPath(id, path); err != nil {
+		return 0, err
+	}
+
+	key, chargedTo := meta.Key, meta.ChargedTo
+	meta = meta.userMeta()
+	meta.Key = key
+	meta.ChargedTo = chargedTo
+	return s.writeObject(ctx, id, fmt.Sprintf("%s/%s", id, path), r, meta)
+}
+
+// contextReader fails reads once its context is done.
+type contextReader struct{
+	ctx context.Context
+	r io.Reader
+}
+
+func (c contextReader) Read(b []byte) (int, error){
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return fi.Size(), file, err
+	return c.r.Read(b)
 }
 
+// exactReader reads exactly remaining bytes from r, failing with
+// io.ErrUnexpectedEOF if r ends early.
+type exactReader struct{
+	r io.Reader
+	remaining int64
+}
 
+func (e *exactReader) Read(b []byte) (int, error){
+	if e.remaining <= 0{
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > e.remaining{
+		b = b[:e.remaining]
+	}
+
+	n, err := e.r.Read(b)
+	e.remaining -= int64(n)
+	if err == io.EOF && e.remaining > 0{
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"path/filepath"
 	"testing"
+	"testing/iotest"
 )
 
 func TestPathTransformFunc(t *testing.T){
@@ -72,4 +77,42 @@ func teardown(t *testing.T, s *Store){
 	if err := s.Clear(); err != nil {
 		t.Error(err)
 	}
-}
\ No newline at end of file
+}
+
+func TestStoreAtomicWrite(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		s := NewStore(StoreOpts{
+			Root: t.TempDir(),
+			PathTransformFunc: CASPathTransformFunc,
+			Durable: durable,
+		})
+		id := generateId()
+
+		if _, err := s.Write(id, "key", bytes.NewReader([]byte("old bytes"))); err != nil {
+			t.Fatal(err)
+		}
+
+		// a write that fails half way leaves the old file as it was
+		broken := io.MultiReader(bytes.NewReader([]byte("new")), iotest.ErrReader(errors.New("broken")))
+		if _, err := s.Write(id, "key", broken); err == nil {
+			t.Fatal("want the failed write reported")
+		}
+
+		_, r, err := s.Read(id, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		if string(b) != "old bytes" {
+			t.Errorf("want old bytes have %s", b)
+		}
+
+		filepath.WalkDir(s.Root, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && isTempFile(d.Name()) {
+				t.Errorf("temp file %s left behind", p)
+			}
+			return err
+		})
+	}
+}
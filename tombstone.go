@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultTombstoneTTL = 7 * 24 * time.Hour
+	tombstoneFileName = "tombstones.log"
+)
+
+// Tombstone records that the owner with the given ID deleted a file. Peers
+// keep it around so nodes that missed the delete drop their copy when they
+// rejoin instead of handing the file back out.
+type Tombstone struct{
+	ID string
+	Key string
+	Deleted time.Time
+}
+
+func (t Tombstone) expired(ttl time.Duration, now time.Time) bool{
+	return now.Sub(t.Deleted) > ttl
+}
+
+// tombstoneSet keeps the tombstones younger than ttl in a journal, so
+// they survive restarts.
+type tombstoneSet struct{
+	lock sync.Mutex
+	ttl time.Duration
+	tombstones *journal[Tombstone]
+	// version counts the changes to the set
+	version uint64
+}
+
+func tombstoneID(id, key string) string{
+	return id + "/" + key
+}
+
+// loadTombstones reads the tombstones stored under the name. The returned set is
+// usable even on error, it then holds the ones that could be read.
+func loadTombstones(storage Storage, name string, ttl time.Duration) (*tombstoneSet, error){
+	tombstones, err := loadJournal[Tombstone](storage, name)
+	return &tombstoneSet{ttl: ttl, tombstones: tombstones}, err
+}
+
+// Add records the tombstone unless it is expired or we already know of a
+// later delete of the same file. It reports whether the tombstone was kept.
+func (s *tombstoneSet) Add(t Tombstone) (bool, error){
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if t.expired(s.ttl, time.Now()){
+		return false, nil
+	}
+
+	if old, ok := s.tombstones.items[tombstoneID(t.ID, t.Key)]; ok && !old.Deleted.Before(t.Deleted){
+		return false, nil
+	}
+
+	s.version++
+	return true, s.tombstones.Put(tombstoneID(t.ID, t.Key), t)
+}
+
+// Remove forgets the tombstone of a file that was written again.
+func (s *tombstoneSet) Remove(id, key string) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.tombstones.items[tombstoneID(id, key)]; !ok{
+		return nil
+	}
+
+	s.version++
+	return s.tombstones.Delete(tombstoneID(id, key))
+}
+
+func (s *tombstoneSet) Get(id, key string) (Tombstone, bool){
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, ok := s.tombstones.items[tombstoneID(id, key)]
+	if !ok || t.expired(s.ttl, time.Now()){
+		return Tombstone{}, false
+	}
+	return t, true
+}
+
+// List returns the tombstones that have not expired yet, dropping the
+// ones that have.
+func (s *tombstoneSet) List() ([]Tombstone, error){
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	tombstones := []Tombstone{}
+	expired := []string{}
+	for id, t := range s.tombstones.items{
+		if t.expired(s.ttl, now){
+			expired = append(expired, id)
+			continue
+		}
+		tombstones = append(tombstones, t)
+	}
+
+	if len(expired) > 0{
+		s.version++
+		return tombstones, s.tombstones.Delete(expired...)
+	}
+	return tombstones, nil
+}
+
+func (s *tombstoneSet) Version() uint64{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.version
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTombstoneSet(t *testing.T){
+	storage := NewDiskStorage(t.TempDir(), false)
+	set, err := loadTombstones(storage, tombstoneFileName, time.Hour)
+	if err != nil{
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if added, err := set.Add(Tombstone{ID: "owner", Key: "key", Deleted: now}); err != nil || !added{
+		t.Fatalf("tombstone not added: %v", err)
+	}
+	if added, _ := set.Add(Tombstone{ID: "owner", Key: "key", Deleted: now.Add(-time.Minute)}); added{
+		t.Error("older tombstone replaced a newer one")
+	}
+	if added, _ := set.Add(Tombstone{ID: "owner", Key: "old", Deleted: now.Add(-2 * time.Hour)}); added{
+		t.Error("expired tombstone was added")
+	}
+
+	// tombstones survive a restart
+	set, err = loadTombstones(storage, tombstoneFileName, time.Hour)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if tombstone, ok := set.Get("owner", "key"); !ok || !tombstone.Deleted.Equal(now){
+		t.Errorf("want tombstone deleted at %s have %+v", now, tombstone)
+	}
+
+	if err := set.Remove("owner", "key"); err != nil{
+		t.Fatal(err)
+	}
+	if tombstones, _ := set.List(); len(tombstones) != 0{
+		t.Errorf("want no tombstones have %v", tombstones)
+	}
+}